@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -203,7 +204,7 @@ func (server *ApiServer) ResetState(response http.ResponseWriter, request *http.
 
 func (server *ApiServer) ProxyCreate(response http.ResponseWriter, request *http.Request) {
 	// Default fields to enable the proxy right away
-	input := Proxy{Enabled: true}
+	input := Proxy{Enabled: true, Protocol: ProtocolTCP, UpstreamStrategy: StrategyRoundRobin}
 	err := json.NewDecoder(request.Body).Decode(&input)
 	if server.apiError(response, joinError(err, ErrBadRequestBody)) {
 		return
@@ -213,12 +214,56 @@ func (server *ApiServer) ProxyCreate(response http.ResponseWriter, request *http
 		server.apiError(response, joinError(fmt.Errorf("name"), ErrMissingField))
 		return
 	}
-	if len(input.Upstream) < 1 {
+	if len(input.Upstream) < 1 && !DynamicProtocol(input.Protocol) {
 		server.apiError(response, joinError(fmt.Errorf("upstream"), ErrMissingField))
 		return
 	}
 
+	if !ValidProtocol(input.Protocol) {
+		server.apiError(response, ErrInvalidProtocol)
+		return
+	}
+
+	if !ValidProxyProtocol(input.SendProxyProtocol) {
+		server.apiError(response, ErrInvalidProxyProtocol)
+		return
+	}
+
+	if !ValidUpstreamStrategy(input.UpstreamStrategy) {
+		server.apiError(response, ErrInvalidUpstreamStrategy)
+		return
+	}
+
+	if !ValidUpstreamWeights(input.Upstream, input.UpstreamWeights) {
+		server.apiError(response, ErrInvalidUpstreamWeights)
+		return
+	}
+
+	if !ValidHosts(input.Protocol, input.AcceptProxyProtocol, input.Hosts) {
+		server.apiError(response, ErrInvalidHosts)
+		return
+	}
+
+	if !ValidSocketOptions(&input) {
+		server.apiError(response, ErrInvalidSocketOptions)
+		return
+	}
+
 	proxy := NewProxy(server, input.Name, input.Listen, input.Upstream)
+	proxy.Protocol = input.Protocol
+	proxy.SendProxyProtocol = input.SendProxyProtocol
+	proxy.AcceptProxyProtocol = input.AcceptProxyProtocol
+	proxy.Hosts = input.Hosts
+	proxy.UpstreamStrategy = input.UpstreamStrategy
+	proxy.UpstreamWeights = input.UpstreamWeights
+	proxy.KeepConnections = input.KeepConnections
+	proxy.ResolveInterval = input.ResolveInterval
+	proxy.DialTimeout = input.DialTimeout
+	proxy.TCPNoDelay = input.TCPNoDelay
+	proxy.KeepAlive = input.KeepAlive
+	proxy.ReadBuffer = input.ReadBuffer
+	proxy.WriteBuffer = input.WriteBuffer
+	proxy.SourceAddress = input.SourceAddress
 
 	err = server.Collection.Add(proxy, input.Enabled)
 	if server.apiError(response, err) {
@@ -306,13 +351,67 @@ func (server *ApiServer) ProxyUpdate(response http.ResponseWriter, request *http
 		return
 	}
 
-	// Default fields are the same as existing proxy
-	input := Proxy{Listen: proxy.Listen, Upstream: proxy.Upstream, Enabled: proxy.Enabled}
+	// Default fields are the same as existing proxy, with slices copied since
+	// decoding reuses their backing arrays
+	input := Proxy{
+		Listen:   proxy.Listen,
+		Upstream: proxy.Upstream,
+		Protocol: proxy.Protocol,
+		Enabled:  proxy.Enabled,
+
+		SendProxyProtocol:   proxy.SendProxyProtocol,
+		AcceptProxyProtocol: proxy.AcceptProxyProtocol,
+		Hosts:               slices.Clone(proxy.Hosts),
+		UpstreamStrategy:    proxy.UpstreamStrategy,
+		UpstreamWeights:     slices.Clone(proxy.UpstreamWeights),
+		KeepConnections:     proxy.KeepConnections,
+		ResolveInterval:     proxy.ResolveInterval,
+		DialTimeout:         proxy.DialTimeout,
+		KeepAlive:           proxy.KeepAlive,
+		ReadBuffer:          proxy.ReadBuffer,
+		WriteBuffer:         proxy.WriteBuffer,
+		SourceAddress:       proxy.SourceAddress,
+	}
+	// Decoding writes through pointers, which must not be shared with the proxy
+	if proxy.TCPNoDelay != nil {
+		noDelay := *proxy.TCPNoDelay
+		input.TCPNoDelay = &noDelay
+	}
 	err = json.NewDecoder(request.Body).Decode(&input)
 	if server.apiError(response, joinError(err, ErrBadRequestBody)) {
 		return
 	}
 
+	if !ValidProtocol(input.Protocol) {
+		server.apiError(response, ErrInvalidProtocol)
+		return
+	}
+
+	if !ValidProxyProtocol(input.SendProxyProtocol) {
+		server.apiError(response, ErrInvalidProxyProtocol)
+		return
+	}
+
+	if !ValidUpstreamStrategy(input.UpstreamStrategy) {
+		server.apiError(response, ErrInvalidUpstreamStrategy)
+		return
+	}
+
+	if !ValidUpstreamWeights(input.Upstream, input.UpstreamWeights) {
+		server.apiError(response, ErrInvalidUpstreamWeights)
+		return
+	}
+
+	if !ValidHosts(input.Protocol, input.AcceptProxyProtocol, input.Hosts) {
+		server.apiError(response, ErrInvalidHosts)
+		return
+	}
+
+	if !ValidSocketOptions(&input) {
+		server.apiError(response, ErrInvalidSocketOptions)
+		return
+	}
+
 	err = proxy.Update(&input)
 	if server.apiError(response, err) {
 		return
@@ -513,7 +612,34 @@ var (
 		"stream was invalid, can be either upstream or downstream",
 		http.StatusBadRequest,
 	)
+	ErrInvalidProtocol      = newError("invalid proxy protocol", http.StatusBadRequest)
+	ErrInvalidProxyProtocol = newError(
+		"invalid PROXY protocol version, can be either v1 or v2",
+		http.StatusBadRequest,
+	)
+	ErrInvalidUpstreamStrategy = newError(
+		"invalid upstream strategy, can be round_robin, random, weighted or failover",
+		http.StatusBadRequest,
+	)
+	ErrInvalidUpstreamWeights = newError(
+		"upstream weights must be positive, one for each upstream",
+		http.StatusBadRequest,
+	)
+	ErrInvalidHosts = newError(
+		"hosts can only be served by tcp proxies without accept_proxy_protocol",
+		http.StatusBadRequest,
+	)
+	ErrInvalidSocketOptions = newError(
+		"invalid socket options, buffer sizes can't be negative and source_address must be an IP",
+		http.StatusBadRequest,
+	)
+	ErrHostAlreadyServed = newError(
+		"host already served on this listen address",
+		http.StatusConflict,
+	)
 	ErrInvalidToxicType   = newError("invalid toxic type", http.StatusBadRequest)
+	ErrInvalidToxicAttrs  = newError("invalid toxic attributes", http.StatusBadRequest)
+	ErrDatagramToxic      = newError("toxic requires the udp or dns protocol", http.StatusBadRequest)
 	ErrToxicAlreadyExists = newError("toxic already exists", http.StatusConflict)
 	ErrToxicNotFound      = newError("toxic not found", http.StatusNotFound)
 )
@@ -541,12 +667,14 @@ func (server *ApiServer) apiError(resp http.ResponseWriter, err error) bool {
 
 type proxyToxics struct {
 	*Proxy
-	Toxics []toxics.Toxic `json:"toxics"`
+	Toxics   []toxics.Toxic      `json:"toxics"`
+	Resolved map[string][]string `json:"resolved_upstreams,omitempty"`
 }
 
 func proxyWithToxics(proxy *Proxy) (result proxyToxics) {
 	result.Proxy = proxy
 	result.Toxics = proxy.Toxics.GetToxicArray()
+	result.Resolved = proxy.resolvedUpstreams()
 	return
 }
 
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -534,6 +535,111 @@ func TestCreateProxyWithSave(t *testing.T) {
 	})
 }
 
+func TestCreateProxiesSharingListenWithHosts(t *testing.T) {
+	WithServer(t, func(addr string) {
+		for _, name := range []string{"web", "api"} {
+			testProxy := client.NewProxy()
+			testProxy.Name = name
+			testProxy.Listen = "localhost:3310"
+			testProxy.Upstream = "localhost:20001"
+			testProxy.Hosts = []string{name + ".example.com"}
+			testProxy.Enabled = true
+
+			err := testProxy.Save()
+			if err != nil {
+				t.Fatal("Unable to create proxy:", err)
+			}
+		}
+
+		testProxy := client.NewProxy()
+		testProxy.Name = "redis"
+		testProxy.Listen = "localhost:3310"
+		testProxy.Upstream = "localhost:20002"
+		testProxy.Protocol = "redis_cluster"
+		testProxy.Hosts = []string{"redis.example.com"}
+		testProxy.Enabled = true
+
+		err := testProxy.Save()
+		if err == nil || !strings.Contains(err.Error(), "hosts can only be served") {
+			t.Fatal("Expected hosts of a redis_cluster proxy to be rejected, got", err)
+		}
+	})
+}
+
+func TestUpdateProxySocketOptions(t *testing.T) {
+	WithServer(t, func(addr string) {
+		noDelay := true
+		testProxy := client.NewProxy()
+		testProxy.Name = "mysql_master"
+		testProxy.Listen = "localhost:3310"
+		testProxy.Upstream = "localhost:20001"
+		testProxy.TCPNoDelay = &noDelay
+		testProxy.Enabled = true
+
+		err := testProxy.Save()
+		if err != nil {
+			t.Fatal("Unable to create proxy:", err)
+		}
+
+		noDelay = false
+		testProxy.ReadBuffer = 4096
+		err = testProxy.Save()
+		if err != nil {
+			t.Fatal("Unable to update proxy:", err)
+		}
+
+		proxy, err := client.Proxy("mysql_master")
+		if err != nil {
+			t.Fatal("Unable to retrieve proxy:", err)
+		}
+		if proxy.TCPNoDelay == nil || *proxy.TCPNoDelay || proxy.ReadBuffer != 4096 {
+			t.Fatalf("Expected the socket options to be updated, got %+v", proxy)
+		}
+
+		testProxy.ReadBuffer = -1
+		err = testProxy.Save()
+		if err == nil || !strings.Contains(err.Error(), "invalid socket options") {
+			t.Fatal("Expected a negative buffer size to be rejected, got", err)
+		}
+	})
+}
+
+func TestCreateProxyResolvesUpstreams(t *testing.T) {
+	WithServer(t, func(addr string) {
+		testProxy := client.NewProxy()
+		testProxy.Name = "mysql_master"
+		testProxy.Listen = "localhost:3310"
+		testProxy.Upstream = "localhost:20001,127.0.0.1:20002"
+		testProxy.ResolveInterval = 50
+		testProxy.Enabled = true
+
+		err := testProxy.Save()
+		if err != nil {
+			t.Fatal("Unable to create proxy:", err)
+		}
+
+		var resolved map[string][]string
+		for i := 0; i < 20 && len(resolved) == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+			proxy, err := client.Proxy("mysql_master")
+			if err != nil {
+				t.Fatal("Unable to retrieve proxy:", err)
+			}
+			resolved = proxy.ResolvedUpstreams
+		}
+
+		// Upstreams with IP addresses aren't resolved
+		if len(resolved) != 1 || len(resolved["localhost:20001"]) == 0 {
+			t.Fatalf("Expected the host name of the upstream to be resolved, got %v", resolved)
+		}
+		for _, address := range resolved["localhost:20001"] {
+			if address != "127.0.0.1:20001" && address != "[::1]:20001" {
+				t.Errorf("Unexpected resolved address %s", address)
+			}
+		}
+	})
+}
+
 func TestCreateDisabledProxy(t *testing.T) {
 	WithServer(t, func(addr string) {
 		disabledProxy := client.NewProxy()
@@ -1124,6 +1230,150 @@ func TestInvalidStream(t *testing.T) {
 	})
 }
 
+func TestInvalidFramingAttributes(t *testing.T) {
+	WithServer(t, func(addr string) {
+		testProxy, err := client.CreateProxy("mysql_master", "localhost:3310", "localhost:20001")
+		if err != nil {
+			t.Fatal("Unable to create proxy:", err)
+		}
+
+		for _, attributes := range []tclient.Attributes{
+			{"framing": "uint24"},
+			{"framing": "line", "every": 0},
+		} {
+			_, err = testProxy.AddToxic("", "drop", "downstream", 1, attributes)
+			if err == nil || !strings.Contains(err.Error(), "invalid toxic attributes") {
+				t.Errorf("Expected drop toxic with %v to be rejected, got %v", attributes, err)
+			}
+		}
+
+		_, err = testProxy.AddToxic("", "latency", "downstream", 1, tclient.Attributes{"latency": 100})
+		if err != nil {
+			t.Fatal("Error setting toxic:", err)
+		}
+		_, err = testProxy.UpdateToxic("latency_downstream", 1, tclient.Attributes{"every": -1})
+		if err == nil || !strings.Contains(err.Error(), "invalid toxic attributes") {
+			t.Errorf("Expected update with a negative every to be rejected, got %v", err)
+		}
+		toxics, err := testProxy.Toxics()
+		if err != nil {
+			t.Fatal("Error returning toxics:", err)
+		}
+		toxic := AssertToxicExists(t, toxics, "latency_downstream", "latency", "downstream", true)
+		if toxic.Attributes["every"] != 1.0 {
+			t.Errorf("Expected the toxic to be left as is, got %v", toxic.Attributes)
+		}
+	})
+}
+
+func TestInvalidProtocolToxicAttributes(t *testing.T) {
+	WithServer(t, func(addr string) {
+		testProxy, err := client.CreateProxy("mysql_master", "localhost:3310", "localhost:20001")
+		if err != nil {
+			t.Fatal("Unable to create proxy:", err)
+		}
+
+		for _, tc := range []struct {
+			toxicType  string
+			attributes tclient.Attributes
+		}{
+			{"postgres", tclient.Attributes{"match": "("}},
+			{"postgres", tclient.Attributes{"error_code": "400"}},
+			{"postgres", tclient.Attributes{"error_code": "40001", "severity": "WARNING"}},
+			{"postgres", tclient.Attributes{"latency": -1}},
+			{"mysql", tclient.Attributes{"match": "(?<"}},
+			{"mysql", tclient.Attributes{"error_code": 70000}},
+			{"mysql", tclient.Attributes{"error_code": 1213, "sql_state": "4000"}},
+			{"redis", tclient.Attributes{"command": "GET", "key": "*"}},
+			{"redis", tclient.Attributes{"error": "READ ONLY"}},
+			{"redis", tclient.Attributes{"error": "ERR", "error_message": "a\r\n+OK"}},
+			{"mongodb", tclient.Attributes{"collection": "+"}},
+			{"mongodb", tclient.Attributes{"error": "SomethingElse"}},
+			{"mongodb", tclient.Attributes{"error": "WriteConflict", "error_code": -1}},
+			{"memcached", tclient.Attributes{"key": "a)"}},
+			{"memcached", tclient.Attributes{"action": "evict"}},
+			{"memcached", tclient.Attributes{"action": "error", "error_message": "a\r\nEND"}},
+			{"amqp", tclient.Attributes{"routing_key": "(a|"}},
+			{"amqp", tclient.Attributes{"action": "reject"}},
+			{"amqp", tclient.Attributes{"action": "channel_close", "reply_code": 70000}},
+			{"mqtt", tclient.Attributes{"topic": "sensors/[0-9"}},
+			{"mqtt", tclient.Attributes{"action": "drop"}},
+			{"mqtt", tclient.Attributes{"action": "disconnect", "reason_code": 256}},
+			{"nats", tclient.Attributes{"subject": "orders.(*"}},
+			{"nats", tclient.Attributes{"action": "drop_ping"}},
+			{"nats", tclient.Attributes{"action": "error", "error": "Slow\r\nConsumer"}},
+			{"cassandra", tclient.Attributes{"keyspace": "app", "table": "users("}},
+			{"cassandra", tclient.Attributes{"error": "Timeout"}},
+			{"smtp", tclient.Attributes{"argument": "@example\\.(com"}},
+			{"smtp", tclient.Attributes{"reply_code": 45}},
+			{"smtp", tclient.Attributes{"reply_code": 550, "reply_text": "no\r\n250 OK"}},
+			{"websocket", tclient.Attributes{"payload": "\\"}},
+			{"websocket", tclient.Attributes{"message_type": "ping"}},
+			{"websocket", tclient.Attributes{"action": "split"}},
+			{"websocket", tclient.Attributes{"action": "close", "close_code": 999}},
+			{"websocket", tclient.Attributes{"action": "fragment", "fragment_size": -1}},
+			{"dns", tclient.Attributes{"name": "example\\.com)"}},
+			{"dns", tclient.Attributes{"action": "refused"}},
+			{"dns", tclient.Attributes{"action": "address", "address": "example.com"}},
+			{"dns", tclient.Attributes{"action": "ttl", "ttl": -1}},
+		} {
+			_, err = testProxy.AddToxic("", tc.toxicType, "upstream", 1, tc.attributes)
+			if err == nil || !strings.Contains(err.Error(), "invalid toxic attributes") {
+				t.Errorf(
+					"Expected %s toxic with %v to be rejected, got %v", tc.toxicType, tc.attributes, err,
+				)
+			}
+		}
+
+		attributes := tclient.Attributes{"error_code": "40001"}
+		_, err = testProxy.AddToxic("", "postgres", "upstream", 1, attributes)
+		if err != nil {
+			t.Fatal("Error setting toxic:", err)
+		}
+		_, err = testProxy.UpdateToxic("postgres_upstream", 1, tclient.Attributes{"match": "["})
+		if err == nil || !strings.Contains(err.Error(), "invalid toxic attributes") {
+			t.Errorf("Expected update with a bad match to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestDatagramToxicsRequireUDPProxy(t *testing.T) {
+	WithServer(t, func(addr string) {
+		testProxy, err := client.CreateProxy("mysql_master", "localhost:3310", "localhost:20001")
+		if err != nil {
+			t.Fatal("Unable to create proxy:", err)
+		}
+		attributes := tclient.Attributes{"probability": 0.5}
+		_, err = testProxy.AddToxic("", "packet_loss", "downstream", 1, attributes)
+		if err == nil || !strings.Contains(err.Error(), "requires the udp or dns protocol") {
+			t.Fatal("Expected packet_loss on a tcp proxy to be rejected, got", err)
+		}
+
+		testProxy.Protocol = "udp"
+		err = testProxy.Save()
+		if err != nil {
+			t.Fatal("Unable to update proxy:", err)
+		}
+		_, err = testProxy.AddToxic("", "packet_loss", "downstream", 1, attributes)
+		if err != nil {
+			t.Fatal("Error setting toxic:", err)
+		}
+
+		testProxy.Protocol = "tcp"
+		err = testProxy.Save()
+		if err == nil || !strings.Contains(err.Error(), "requires the udp or dns protocol") {
+			t.Fatal("Expected the protocol change to be rejected, got", err)
+		}
+		proxy, err := client.Proxy("mysql_master")
+		if err != nil {
+			t.Fatal("Unable to retrieve proxy:", err)
+		}
+		if proxy.Protocol != "udp" {
+			t.Fatal("Expected the proxy to keep the udp protocol, got", proxy.Protocol)
+		}
+	})
+}
+
 func AssertToxicExists(
 	t *testing.T,
 	toxics tclient.Toxics,
@@ -149,10 +149,11 @@ func (client *Client) AddToxic(options *ToxicOptions) (*Toxic, error) {
 		return nil, fmt.Errorf("failed to retrieve proxy with name `%s`: %v", options.ProxyName, err)
 	}
 
-	toxic, err := proxy.AddToxic(
+	toxic, err := proxy.AddDestinationToxic(
 		options.ToxicName,
 		options.ToxicType,
 		options.Stream,
+		options.Destination,
 		options.Toxicity,
 		options.Attributes,
 	)
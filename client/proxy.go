@@ -11,10 +11,45 @@ import (
 )
 
 type Proxy struct {
-	Name     string `json:"name"`     // The name of the proxy
-	Listen   string `json:"listen"`   // The address the proxy listens on
-	Upstream string `json:"upstream"` // The upstream address to proxy to
-	Enabled  bool   `json:"enabled"`  // Whether the proxy is enabled
+	Name     string `json:"name"`               // The name of the proxy
+	Listen   string `json:"listen"`             // The address the proxy listens on
+	Upstream string `json:"upstream"`           // The upstream address to proxy to
+	Protocol string `json:"protocol,omitempty"` // The protocol the proxy speaks, defaults to tcp
+	Enabled  bool   `json:"enabled"`            // Whether the proxy is enabled
+
+	// The PROXY protocol version of the header sent to the upstream, v1 or v2
+	SendProxyProtocol string `json:"send_proxy_protocol"`
+	// Whether clients start with a PROXY protocol header
+	AcceptProxyProtocol bool `json:"accept_proxy_protocol"`
+	// The TLS server names or HTTP hosts the proxy serves, sharing its listen
+	// address with other proxies serving other hosts
+	Hosts []string `json:"hosts,omitempty"`
+	// How clients are spread over the comma separated upstream addresses:
+	// round_robin (default), random, weighted or failover
+	UpstreamStrategy string `json:"upstream_strategy,omitempty"`
+	// The weights of the upstreams for the weighted strategy
+	UpstreamWeights []int `json:"upstream_weights"`
+	// Whether changing the upstreams keeps established connections, only
+	// connecting new clients to the new upstreams
+	KeepConnections bool `json:"keep_connections"`
+	// Milliseconds between lookups of upstream host names, 0 looks them up on
+	// every dial
+	ResolveInterval int64 `json:"resolve_interval"`
+	// Milliseconds to connect to an upstream, 0 for no timeout
+	DialTimeout int64 `json:"dial_timeout"`
+	// TCP_NODELAY of client and upstream connections, nil keeps Go's default
+	// of true
+	TCPNoDelay *bool `json:"tcp_nodelay,omitempty"`
+	// Milliseconds between TCP keepalive probes, 0 keeps Go's default and a
+	// negative value disables them
+	KeepAlive int64 `json:"keepalive"`
+	// The SO_RCVBUF and SO_SNDBUF sizes in bytes, 0 keeps the system's default
+	ReadBuffer  int `json:"read_buffer"`
+	WriteBuffer int `json:"write_buffer"`
+	// The IP address, with an optional port, upstreams are dialed from
+	SourceAddress string `json:"source_address,omitempty"`
+	// The addresses the upstream host names last resolved to, by upstream
+	ResolvedUpstreams map[string][]string `json:"resolved_upstreams,omitempty"`
 
 	// The toxics active on this proxy. Note: you cannot set this
 	// when passing Proxy into Populate()
@@ -102,7 +137,26 @@ func (proxy *Proxy) AddToxic(
 	toxicity float32,
 	attrs Attributes,
 ) (*Toxic, error) {
-	toxic := Toxic{name, typeName, stream, toxicity, attrs}
+	return proxy.AddDestinationToxic(name, typeName, stream, "", toxicity, attrs)
+}
+
+// AddDestinationToxic adds a toxic to the given stream direction that only
+// applies to connections to destination, a host or host:port. Connections are
+// to the upstream a client was connected to, or to the destination the client
+// asked a socks5 proxy for.
+func (proxy *Proxy) AddDestinationToxic(
+	name, typeName, stream, destination string,
+	toxicity float32,
+	attrs Attributes,
+) (*Toxic, error) {
+	toxic := Toxic{
+		Name:        name,
+		Type:        typeName,
+		Stream:      stream,
+		Toxicity:    toxicity,
+		Destination: destination,
+		Attributes:  attrs,
+	}
 	if toxic.Toxicity == -1 {
 		toxic.Toxicity = 1 // Just to be consistent with a toxicity of -1 using the default
 	}
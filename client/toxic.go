@@ -7,11 +7,12 @@ package toxiproxy
 type Attributes map[string]interface{}
 
 type Toxic struct {
-	Name       string     `json:"name"`
-	Type       string     `json:"type"`
-	Stream     string     `json:"stream,omitempty"`
-	Toxicity   float32    `json:"toxicity"`
-	Attributes Attributes `json:"attributes"`
+	Name        string     `json:"name"`
+	Type        string     `json:"type"`
+	Stream      string     `json:"stream,omitempty"`
+	Toxicity    float32    `json:"toxicity"`
+	Destination string     `json:"destination,omitempty"` // Limits the toxic to a host or host:port
+	Attributes  Attributes `json:"attributes"`
 }
 
 type Toxics []Toxic
@@ -20,7 +21,8 @@ type ToxicOptions struct {
 	ProxyName,
 	ToxicName,
 	ToxicType,
-	Stream string
+	Stream,
+	Destination string
 	Toxicity   float32
 	Attributes Attributes
 }
@@ -34,8 +34,8 @@ func color(color string) string {
 
 var toxicDescription = `
   Default Toxics:
-  latency:    delay all data +/- jitter
-              latency=<ms>,jitter=<ms>
+  latency:    delay all data +/- jitter, or every Nth message with a framing
+              latency=<ms>,jitter=<ms>,framing=<framing>,every=<n>
 
   bandwidth:  limit to max kb/s
               rate=<KB/s>
@@ -43,8 +43,8 @@ var toxicDescription = `
   slow_close: delay from closing
               delay=<ms>
 
-  timeout:    stop all data and close after timeout
-              timeout=<ms>
+  timeout:    stop all data and close after timeout, or from the Nth message with a framing
+              timeout=<ms>,framing=<framing>,every=<n>
 
   reset_peer: simulate TCP RESET (Connection reset by peer) on the connections by closing
               the stub Input immediately or after a timeout
@@ -53,9 +53,26 @@ var toxicDescription = `
   slicer:     slice data into bits with optional delay
               average_size=<bytes>,size_variation=<bytes>,delay=<microseconds>
 
+  drop:       drop every Nth message
+              framing=<framing>,every=<n>
+
+  packet_loss, packet_duplicate: drop or duplicate UDP datagrams at random
+              probability=<0-1>
+
+  packet_reorder: hold UDP datagrams back at random
+              probability=<0-1>,gap=<datagrams>,delay=<ms>
+
+  packet_latency: delay each UDP datagram +/- jitter
+              latency=<ms>,jitter=<ms>
+
+  packet_rate: drop UDP datagrams over a rate
+              rate=<datagrams/s>,burst=<datagrams>
+
+  Framings: line, varint, uint8, uint16, uint32, uint64 (big-endian, or with an le suffix)
+
   toxic add:
     usage: toxiproxy-cli toxic add --type <toxicType> [--downstream|--upstream] \
-            --toxicName <toxicName> [--toxicity <float>] \
+            --toxicName <toxicName> [--toxicity <float>] [--destination <host[:port]>] \
             --attribute <key=value> [--attribute <key2=value2>] <proxyName>
 
 
@@ -121,7 +138,12 @@ func cliCommands() []*cli.Command {
 		{
 			Name: "create",
 			Usage: "create a new proxy\n\t" +
-				"usage: 'toxiproxy-cli create --listen <addr> --upstream <addr> <proxyName>'\n",
+				"usage: 'toxiproxy-cli create --listen <addr> [--upstream <addr>] " +
+				"[--protocol <protocol>] [--send-proxy-protocol <v1|v2>] [--accept-proxy-protocol] " +
+				"[--host <host>...] [--upstream-strategy <strategy>] [--upstream-weight <weight>...] " +
+				"[--resolve-interval <ms>] [--dial-timeout <ms>] [--tcp-nodelay[=false]] " +
+				"[--keepalive <ms>] [--read-buffer <bytes>] [--write-buffer <bytes>] " +
+				"[--source-address <ip>] <proxyName>'\n",
 			Aliases: []string{"c", "new"},
 			Flags: []cli.Flag{
 				&cli.StringFlag{
@@ -132,7 +154,63 @@ func cliCommands() []*cli.Command {
 				&cli.StringFlag{
 					Name:    "upstream",
 					Aliases: []string{"u"},
-					Usage:   "proxy will forward to this address",
+					Usage:   "proxy will forward to this address, or comma separated addresses",
+				},
+				&cli.StringFlag{
+					Name:    "protocol",
+					Aliases: []string{"p"},
+					Usage:   "protocol the proxy speaks",
+					Value:   "tcp",
+				},
+				&cli.StringFlag{
+					Name:  "send-proxy-protocol",
+					Usage: "send a PROXY protocol header of this version (v1 or v2) to the upstream",
+				},
+				&cli.BoolFlag{
+					Name:  "accept-proxy-protocol",
+					Usage: "clients start with a PROXY protocol header",
+				},
+				&cli.StringSliceFlag{
+					Name: "host",
+					Usage: "TLS server name or HTTP host served on a listen address shared with " +
+						"other proxies",
+				},
+				&cli.StringFlag{
+					Name:  "upstream-strategy",
+					Usage: "how clients are spread over upstreams: round_robin, random, weighted or failover",
+				},
+				&cli.IntSliceFlag{
+					Name:  "upstream-weight",
+					Usage: "weight of an upstream for the weighted strategy, once for each upstream",
+				},
+				&cli.Int64Flag{
+					Name:  "resolve-interval",
+					Usage: "milliseconds between lookups of the upstream host names, 0 for every dial",
+				},
+				&cli.Int64Flag{
+					Name:  "dial-timeout",
+					Usage: "milliseconds to connect to an upstream, 0 for no timeout",
+				},
+				&cli.BoolFlag{
+					Name: "tcp-nodelay",
+					Usage: "set TCP_NODELAY of client and upstream connections, " +
+						"--tcp-nodelay=false to clear it",
+				},
+				&cli.Int64Flag{
+					Name:  "keepalive",
+					Usage: "milliseconds between TCP keepalive probes, negative to disable them",
+				},
+				&cli.IntFlag{
+					Name:  "read-buffer",
+					Usage: "SO_RCVBUF size in bytes of client and upstream connections",
+				},
+				&cli.IntFlag{
+					Name:  "write-buffer",
+					Usage: "SO_SNDBUF size in bytes of client and upstream connections",
+				},
+				&cli.StringFlag{
+					Name:  "source-address",
+					Usage: "IP address, with an optional port, to dial upstreams from",
 				},
 			},
 			Action: withToxi(createProxy),
@@ -191,6 +269,10 @@ func cliToxiAddSubCommand() *cli.Command {
 				Usage:       "toxicity of toxic should be a float between 0 and 1",
 				DefaultText: "1.0",
 			},
+			&cli.StringFlag{
+				Name:  "destination",
+				Usage: "only apply the toxic to connections to this host or host:port",
+			},
 			&cli.StringSliceFlag{
 				Name:    "attribute",
 				Aliases: []string{"a"},
@@ -414,11 +496,37 @@ func createProxy(c *cli.Context, t *toxiproxy.Client) error {
 	if err != nil {
 		return err
 	}
-	upstream, err := getArgOrFail(c, "upstream")
-	if err != nil {
-		return err
+	// socks5 and http_proxy proxies connect clients to the destinations they
+	// ask for
+	upstream := c.String("upstream")
+	if protocol := c.String("protocol"); protocol != "socks5" && protocol != "http_proxy" {
+		upstream, err = getArgOrFail(c, "upstream")
+		if err != nil {
+			return err
+		}
 	}
-	_, err = t.CreateProxy(proxyName, listen, upstream)
+	proxy := t.NewProxy()
+	proxy.Name = proxyName
+	proxy.Listen = listen
+	proxy.Upstream = upstream
+	proxy.Protocol = c.String("protocol")
+	proxy.SendProxyProtocol = c.String("send-proxy-protocol")
+	proxy.AcceptProxyProtocol = c.Bool("accept-proxy-protocol")
+	proxy.Hosts = c.StringSlice("host")
+	proxy.UpstreamStrategy = c.String("upstream-strategy")
+	proxy.UpstreamWeights = c.IntSlice("upstream-weight")
+	proxy.ResolveInterval = c.Int64("resolve-interval")
+	proxy.DialTimeout = c.Int64("dial-timeout")
+	if c.IsSet("tcp-nodelay") {
+		noDelay := c.Bool("tcp-nodelay")
+		proxy.TCPNoDelay = &noDelay
+	}
+	proxy.KeepAlive = c.Int64("keepalive")
+	proxy.ReadBuffer = c.Int("read-buffer")
+	proxy.WriteBuffer = c.Int("write-buffer")
+	proxy.SourceAddress = c.String("source-address")
+	proxy.Enabled = true
+	err = proxy.Save()
 	if err != nil {
 		return errorf("Failed to create proxy: %s\n", err.Error())
 	}
@@ -567,6 +675,7 @@ func parseAddToxicParams(c *cli.Context) (*toxiproxy.ToxicOptions, error) {
 		stream = "upstream"
 	}
 	result.Stream = stream
+	result.Destination = c.String("destination")
 
 	result.Toxicity, err = parseToxicity(c, 1.0)
 	if err != nil {
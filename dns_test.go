@@ -0,0 +1,170 @@
+package toxiproxy_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/Shopify/toxiproxy/v2"
+)
+
+// dnsAnswer answers a query with an A record for 10.0.0.1.
+func dnsAnswer(query []byte) []byte {
+	msg := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(msg[2:], 0x8180)
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	msg = append(msg, 0xC0, 12, 0, 1, 0, 1, 0, 0, 1, 0x2C, 0, 4, 10, 0, 0, 1)
+	return msg
+}
+
+// WithDNSServer runs a fake DNS server answering every query with dnsAnswer,
+// over UDP and TCP on the same port.
+func WithDNSServer(t *testing.T, f func(addr string)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+	packets, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("Failed to create UDP server", err)
+	}
+	defer packets.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := packets.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packets.WriteTo(dnsAnswer(buf[:n]), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					query, err := readDNSMessage(conn)
+					if err != nil {
+						return
+					}
+					conn.Write(dnsFramed(dnsAnswer(query)))
+				}
+			}(conn)
+		}
+	}()
+
+	f(ln.Addr().String())
+}
+
+func NewDNSProxy(upstream string) (*toxiproxy.ApiServer, *toxiproxy.Proxy) {
+	srv := toxiproxy.NewServer(
+		toxiproxy.NewMetricsContainer(prometheus.NewRegistry()),
+		zerolog.Nop(),
+	)
+	proxy := toxiproxy.NewProxy(srv, "dns", "127.0.0.1:0", upstream)
+	proxy.Protocol = toxiproxy.ProtocolDNS
+	return srv, proxy
+}
+
+func dnsQuery(id uint16, name string) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, 1, 0, 1)
+}
+
+func dnsFramed(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+}
+
+func readDNSMessage(conn net.Conn) ([]byte, error) {
+	msg := make([]byte, 2)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	msg = make([]byte, binary.BigEndian.Uint16(msg))
+	_, err := io.ReadFull(conn, msg)
+	return msg, err
+}
+
+func dnsRoundTrip(t *testing.T, network, addr string, query []byte) []byte {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal("Unable to dial DNS proxy", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	if network == "tcp" {
+		conn.Write(dnsFramed(query))
+		response, err := readDNSMessage(conn)
+		if err != nil {
+			t.Fatal("Unable to read DNS response", err)
+		}
+		return response
+	}
+
+	conn.Write(query)
+	response := make([]byte, 512)
+	n, err := conn.Read(response)
+	if err != nil {
+		t.Fatal("Unable to read DNS response", err)
+	}
+	return response[:n]
+}
+
+func TestDNSProxiesUDPAndTCP(t *testing.T) {
+	WithDNSServer(t, func(upstream string) {
+		_, proxy := NewDNSProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		for i, network := range []string{"udp", "tcp", "udp"} {
+			query := dnsQuery(uint16(i), "example.com")
+			response := dnsRoundTrip(t, network, proxy.Listen, query)
+			if string(response) != string(dnsAnswer(query)) {
+				t.Errorf("Expected answer over %s, got %x", network, response)
+			}
+		}
+	})
+}
+
+func TestDNSToxicOverUDP(t *testing.T) {
+	WithDNSServer(t, func(upstream string) {
+		_, proxy := NewDNSProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		_, err := proxy.Toxics.AddToxicJson(strings.NewReader(`{"type": "dns", "stream": "upstream",
+			"attributes": {"name": "^db\\.", "action": "servfail"}}`))
+		if err != nil {
+			t.Fatal("Failed to add toxic", err)
+		}
+
+		response := dnsRoundTrip(t, "udp", proxy.Listen, dnsQuery(1, "db.example.com"))
+		if len(response) < 4 || response[3]&0x0F != 2 {
+			t.Errorf("Expected SERVFAIL, got %x", response)
+		}
+		query := dnsQuery(2, "www.example.com")
+		response = dnsRoundTrip(t, "udp", proxy.Listen, query)
+		if string(response) != string(dnsAnswer(query)) {
+			t.Errorf("Expected answer for other names, got %x", response)
+		}
+	})
+}
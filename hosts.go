@@ -0,0 +1,351 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ValidHosts reports whether a proxy can serve hosts on a shared listener.
+// Only tcp proxies whose clients start with a TLS ClientHello or an HTTP
+// request can be told apart, and hosts may contain * and ? wildcards.
+func ValidHosts(protocol string, acceptProxyProtocol bool, hosts []string) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+	if protocol != ProtocolTCP || acceptProxyProtocol {
+		return false
+	}
+	for _, host := range hosts {
+		if _, err := path.Match(host, ""); host == "" || err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Listeners shared by the proxies serving hosts, by listen address.
+var hostListeners = struct {
+	sync.Mutex
+	listeners map[string]*sharedListener
+}{listeners: make(map[string]*sharedListener)}
+
+// sharedListener accepts the clients of several proxies, and hands each one
+// to the proxy serving the host it asks for.
+type sharedListener struct {
+	listener net.Listener
+	address  string
+	// Guarded by the hostListeners lock
+	routes map[*hostListener]bool
+	logger zerolog.Logger
+}
+
+// hostListener is the listener of a proxy serving hosts, accepting the clients
+// of its shared listener that ask for them.
+type hostListener struct {
+	shared  *sharedListener
+	hosts   []string
+	clients chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+// listenHosts returns a listener for the clients asking for the hosts of a
+// proxy, sharing the listener of the other proxies on its listen address.
+func listenHosts(proxy *Proxy) (net.Listener, error) {
+	network, address := splitAddress(proxy.Listen)
+	key := proxy.Listen
+	if network == "tcp" {
+		if addr, err := net.ResolveTCPAddr("tcp", address); err == nil {
+			key = addr.String()
+		}
+	}
+
+	route := &hostListener{
+		clients: make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	for _, host := range proxy.Hosts {
+		route.hosts = append(route.hosts, strings.ToLower(host))
+	}
+
+	hostListeners.Lock()
+	defer hostListeners.Unlock()
+
+	shared, ok := hostListeners.listeners[key]
+	if ok {
+		for other := range shared.routes {
+			for _, host := range route.hosts {
+				if slices.Contains(other.hosts, host) {
+					return nil, ErrHostAlreadyServed
+				}
+			}
+		}
+	} else {
+		listener, err := proxy.listenConfig().Listen(context.Background(), network, address)
+		if err != nil {
+			return nil, err
+		}
+		if network == "tcp" {
+			// Proxies on a random port share it with the address it got
+			key = listener.Addr().String()
+		}
+		shared = &sharedListener{
+			listener: listener,
+			address:  key,
+			routes:   make(map[*hostListener]bool),
+			logger:   proxy.apiServer.Logger.With().Str("listen", key).Logger(),
+		}
+		hostListeners.listeners[key] = shared
+		go shared.serve()
+	}
+	route.shared = shared
+	shared.routes[route] = true
+	return route, nil
+}
+
+func (shared *sharedListener) serve() {
+	for {
+		client, err := shared.listener.Accept()
+		if err != nil {
+			return
+		}
+		go shared.route(client)
+	}
+}
+
+// route hands a client to the proxy serving the host it asks for.
+func (shared *sharedListener) route(client net.Conn) {
+	err := client.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		client.Close()
+		return
+	}
+	host, conn, err := sniffHost(client)
+	if err == nil {
+		err = client.SetReadDeadline(time.Time{})
+	}
+	if err != nil {
+		shared.logger.
+			Warn().
+			Err(err).
+			Str("client", client.RemoteAddr().String()).
+			Msg("Unable to read the host a client asks for")
+		client.Close()
+		return
+	}
+
+	route := shared.lookup(host)
+	if route == nil {
+		shared.logger.
+			Warn().
+			Str("client", client.RemoteAddr().String()).
+			Str("host", host).
+			Msg("No proxy serves the host a client asks for")
+		client.Close()
+		return
+	}
+	select {
+	case route.clients <- conn:
+	case <-route.done:
+		client.Close()
+	}
+}
+
+// lookup returns the route serving host, preferring exact names over the
+// longest matching pattern.
+func (shared *sharedListener) lookup(host string) *hostListener {
+	host = strings.ToLower(host)
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.Trim(host, "[]")
+
+	hostListeners.Lock()
+	defer hostListeners.Unlock()
+
+	var match *hostListener
+	longest := -1
+	for route := range shared.routes {
+		for _, pattern := range route.hosts {
+			if pattern == host {
+				return route
+			}
+			if ok, _ := path.Match(pattern, host); ok && len(pattern) > longest {
+				match, longest = route, len(pattern)
+			}
+		}
+	}
+	return match
+}
+
+func (l *hostListener) Accept() (net.Conn, error) {
+	select {
+	case client := <-l.clients:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops routing clients to the proxy, and closes the shared listener
+// once no proxy is left on it.
+func (l *hostListener) Close() error {
+	err := net.ErrClosed
+	l.once.Do(func() {
+		err = nil
+		close(l.done)
+
+		hostListeners.Lock()
+		defer hostListeners.Unlock()
+		delete(l.shared.routes, l)
+		if len(l.shared.routes) == 0 {
+			delete(hostListeners.listeners, l.shared.address)
+			err = l.shared.listener.Close()
+		}
+	})
+	return err
+}
+
+func (l *hostListener) Addr() net.Addr {
+	return l.shared.listener.Addr()
+}
+
+// sniffHost reads the host a client asks for, from the server name of a TLS
+// ClientHello or the Host header of an HTTP request. Only the first request
+// is read, so later requests on a kept-alive connection go to the same proxy
+// whatever their Host. It returns the client with what was read put back.
+func sniffHost(client net.Conn) (string, net.Conn, error) {
+	var sniffed bytes.Buffer
+	reader := bufio.NewReader(io.TeeReader(client, &sniffed))
+	conn := &rewriteConn{Conn: client, reader: io.MultiReader(&sniffed, client)}
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", conn, err
+	}
+	if first[0] == tlsRecordHandshake {
+		host, err := readServerName(reader)
+		return host, conn, err
+	}
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return "", conn, err
+	}
+	return request.Host, conn, nil
+}
+
+const (
+	tlsRecordHandshake     = 22
+	tlsClientHello         = 1
+	tlsServerNameExtension = 0
+	tlsHostName            = 0
+)
+
+// Size of the largest ClientHello read, which is well above what clients send
+// but bounds what is buffered for clients sending garbage.
+const maxClientHelloSize = 1 << 16
+
+var errInvalidClientHello = errors.New("invalid TLS ClientHello")
+
+// tlsMessageSize returns the size of the body of the handshake message at the
+// start of data, which has at least its 4-byte header.
+func tlsMessageSize(data []byte) int {
+	return int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+}
+
+// readServerName reads the TLS records of the ClientHello a client starts with,
+// which may be split over several records, and returns its server name, or ""
+// if it has none.
+func readServerName(reader io.Reader) (string, error) {
+	var message []byte
+	for len(message) < 4 || len(message) < 4+tlsMessageSize(message) {
+		header := make([]byte, 5)
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			return "", err
+		}
+		size := int(header[3])<<8 | int(header[4])
+		if header[0] != tlsRecordHandshake || size == 0 ||
+			len(message)+size > maxClientHelloSize {
+			return "", errInvalidClientHello
+		}
+		record := make([]byte, size)
+		_, err = io.ReadFull(reader, record)
+		if err != nil {
+			return "", err
+		}
+		message = append(message, record...)
+	}
+
+	hello := &tlsReader{data: message[:4+tlsMessageSize(message)]}
+	if hello.uint(1) != tlsClientHello {
+		return "", errInvalidClientHello
+	}
+	// Length, version and random
+	hello.bytes(3 + 2 + 32)
+	// Session ID, cipher suites and compression methods
+	hello.bytes(hello.uint(1))
+	hello.bytes(hello.uint(2))
+	hello.bytes(hello.uint(1))
+	if hello.short {
+		return "", errInvalidClientHello
+	}
+
+	extensions := &tlsReader{data: hello.bytes(hello.uint(2))}
+	for len(extensions.data) > 0 {
+		kind := extensions.uint(2)
+		data := &tlsReader{data: extensions.bytes(extensions.uint(2))}
+		if kind != tlsServerNameExtension {
+			continue
+		}
+		names := &tlsReader{data: data.bytes(data.uint(2))}
+		for len(names.data) > 0 {
+			kind := names.uint(1)
+			name := names.bytes(names.uint(2))
+			if kind == tlsHostName && !names.short {
+				return string(name), nil
+			}
+		}
+	}
+	if extensions.short {
+		return "", errInvalidClientHello
+	}
+	return "", nil
+}
+
+// tlsReader reads the fields of a TLS message, and remembers if it ran short.
+type tlsReader struct {
+	data  []byte
+	short bool
+}
+
+func (r *tlsReader) bytes(n int) []byte {
+	if n > len(r.data) {
+		r.short = true
+		r.data = nil
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlsReader) uint(n int) int {
+	v := 0
+	for _, b := range r.bytes(n) {
+		v = v<<8 | int(b)
+	}
+	return v
+}
@@ -0,0 +1,206 @@
+package toxiproxy_test
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/Shopify/toxiproxy/v2"
+)
+
+// NewHostsProxies returns a started proxy for each upstream, serving its hosts
+// on a shared listen address.
+func NewHostsProxies(t *testing.T, upstreams []string, hosts [][]string) []*toxiproxy.Proxy {
+	srv := toxiproxy.NewServer(
+		toxiproxy.NewMetricsContainer(prometheus.NewRegistry()),
+		zerolog.Nop(),
+	)
+	listen := "localhost:0"
+	var proxies []*toxiproxy.Proxy
+	for i, upstream := range upstreams {
+		proxy := toxiproxy.NewProxy(srv, upstream, listen, upstream)
+		proxy.Hosts = hosts[i]
+		err := proxy.Start()
+		if err != nil {
+			t.Fatal("Failed to start proxy", err)
+		}
+		listen = proxy.Listen
+		proxies = append(proxies, proxy)
+	}
+	return proxies
+}
+
+func stopProxies(proxies []*toxiproxy.Proxy) {
+	for _, proxy := range proxies {
+		proxy.Stop()
+	}
+}
+
+// clientHello returns the first TLS record of a client asking for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+
+	record := make([]byte, 16384)
+	n, err := server.Read(record)
+	if err != nil {
+		t.Fatal("Failed to read ClientHello", err)
+	}
+	client.Close()
+	return record[:n]
+}
+
+// sendForName sends data to a shared listener, and returns the name of the
+// server that got it, after checking it echoes data back.
+func sendForName(t *testing.T, addr string, data []byte) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	conn.Write(data)
+	reply := make([]byte, 1+len(data))
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return ""
+	}
+	if string(reply[1:]) != string(data) {
+		t.Errorf("Expected the server to get %q, got %q", data, reply[1:])
+	}
+	return string(reply[:1])
+}
+
+func TestHostsRoutesByServerName(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxies := NewHostsProxies(t, addrs, [][]string{{"a.test"}, {"B.test"}})
+		defer stopProxies(proxies)
+
+		for _, host := range []string{"a", "b", "a"} {
+			name := sendForName(t, proxies[0].Listen, clientHello(t, host+".test"))
+			if name != host {
+				t.Errorf("Expected server %s for %s.test, got %q", host, host, name)
+			}
+		}
+	})
+}
+
+func TestHostsRoutesByServerNameOverSeveralRecords(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxies := NewHostsProxies(t, addrs, [][]string{{"a.test"}, {"b.test"}})
+		defer stopProxies(proxies)
+
+		// Split the ClientHello in two records, as clients with large hellos do
+		record := clientHello(t, "b.test")
+		message, split := record[5:], 10
+		var data []byte
+		for _, fragment := range [][]byte{message[:split], message[split:]} {
+			data = append(data, record[:3]...)
+			data = binary.BigEndian.AppendUint16(data, uint16(len(fragment)))
+			data = append(data, fragment...)
+		}
+		if name := sendForName(t, proxies[0].Listen, data); name != "b" {
+			t.Errorf("Expected server b for b.test, got %q", name)
+		}
+	})
+}
+
+func TestHostsRoutesByHostHeader(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxies := NewHostsProxies(t, addrs, [][]string{{"*.a.test"}, {"b.test", "*"}})
+		defer stopProxies(proxies)
+
+		for host, expected := range map[string]string{
+			"x.a.test:8080": "a",
+			"b.test":        "b",
+			"other":         "b",
+		} {
+			request := "GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+			if name := sendForName(t, proxies[0].Listen, []byte(request)); name != expected {
+				t.Errorf("Expected server %s for %s, got %q", expected, host, name)
+			}
+		}
+	})
+}
+
+func TestHostsDropsUnknownHosts(t *testing.T) {
+	WithNamedServers(t, []string{"a"}, func(addrs []string) {
+		proxies := NewHostsProxies(t, addrs, [][]string{{"a.test"}})
+		defer stopProxies(proxies)
+
+		if name := sendForName(t, proxies[0].Listen, clientHello(t, "b.test")); name != "" {
+			t.Errorf("Expected the client to be dropped, got server %s", name)
+		}
+	})
+}
+
+func TestHostsAlreadyServed(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxies := NewHostsProxies(t, addrs[:1], [][]string{{"a.test"}})
+		defer stopProxies(proxies)
+
+		srv := toxiproxy.NewServer(
+			toxiproxy.NewMetricsContainer(prometheus.NewRegistry()),
+			zerolog.Nop(),
+		)
+		proxy := toxiproxy.NewProxy(srv, "b", proxies[0].Listen, addrs[1])
+		proxy.Hosts = []string{"a.test"}
+		if err := proxy.Start(); err != toxiproxy.ErrHostAlreadyServed {
+			t.Errorf("Expected %v, got %v", toxiproxy.ErrHostAlreadyServed, err)
+		}
+	})
+}
+
+func TestHostsListenerClosedWithLastProxy(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxies := NewHostsProxies(t, addrs, [][]string{{"a.test"}, {"b.test"}})
+		listen := proxies[0].Listen
+
+		proxies[0].Stop()
+		if name := sendForName(t, listen, clientHello(t, "b.test")); name != "b" {
+			t.Errorf("Expected server b after stopping a, got %q", name)
+		}
+
+		proxies[1].Stop()
+		if conn, err := net.Dial("tcp", listen); err == nil {
+			conn.Close()
+			t.Error("Expected the shared listener to be closed")
+		}
+	})
+}
+
+func TestHostsUpdatedThroughAPI(t *testing.T) {
+	WithNamedServers(t, []string{"a"}, func(addrs []string) {
+		WithServer(t, func(addr string) {
+			testProxy := client.NewProxy()
+			testProxy.Name = "web"
+			testProxy.Listen = "localhost:0"
+			testProxy.Upstream = addrs[0]
+			testProxy.Hosts = []string{"a.test"}
+			testProxy.Enabled = true
+
+			err := testProxy.Save()
+			if err != nil {
+				t.Fatal("Unable to create proxy:", err)
+			}
+
+			testProxy.Hosts = []string{"b.test"}
+			err = testProxy.Save()
+			if err != nil {
+				t.Fatal("Unable to update proxy:", err)
+			}
+
+			if name := sendForName(t, testProxy.Listen, clientHello(t, "b.test")); name != "a" {
+				t.Errorf("Expected the updated host to be served, got %q", name)
+			}
+		})
+	})
+}
@@ -0,0 +1,113 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Headers for the proxy itself, not forwarded to destinations.
+var httpProxyHeaders = []string{"Proxy-Connection", "Proxy-Authorization", "Keep-Alive"}
+
+// dialHTTPProxy reads the request of an HTTP proxy client and connects to the
+// destination it asks for, until ctx is done. CONNECT requests are answered once the destination
+// is dialed, and the connection is tunneled. Requests for http:// URLs are
+// forwarded to the destination, asking it to close the connection after the
+// response, so that every request gets its own connection and destination.
+//
+// It returns the client with the rest of what it sent, preceded by the
+// forwarded request, and the destination as host:port.
+func (proxy *Proxy) dialHTTPProxy(
+	ctx context.Context,
+	client net.Conn,
+) (net.Conn, net.Conn, string, error) {
+	reader := bufio.NewReader(client)
+	tunnel := &rewriteConn{Conn: client, reader: reader}
+
+	err := client.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return tunnel, nil, "", err
+	}
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		writeHTTPProxyError(client, http.StatusBadRequest)
+		return tunnel, nil, "", err
+	}
+	err = client.SetReadDeadline(time.Time{})
+	if err != nil {
+		return tunnel, nil, "", err
+	}
+
+	destination, err := httpProxyDestination(request)
+	if err != nil {
+		writeHTTPProxyError(client, http.StatusBadRequest)
+		return tunnel, nil, "", err
+	}
+
+	upstream, err := proxy.dialDestination(ctx, destination)
+	if err != nil {
+		status := http.StatusBadGateway
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			status = http.StatusGatewayTimeout
+		}
+		writeHTTPProxyError(client, status)
+		return tunnel, nil, destination, err
+	}
+
+	if request.Method == http.MethodConnect {
+		_, err = io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+		if err != nil {
+			upstream.Close()
+			return tunnel, nil, destination, err
+		}
+		return tunnel, upstream, destination, nil
+	}
+
+	// Forward the request in origin form, followed by its body
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s HTTP/%d.%d\r\n", request.Method, request.URL.RequestURI(),
+		request.ProtoMajor, request.ProtoMinor)
+	fmt.Fprintf(&head, "Host: %s\r\n", request.Host)
+	for _, header := range httpProxyHeaders {
+		request.Header.Del(header)
+	}
+	if len(request.TransferEncoding) > 0 {
+		request.Header.Set("Transfer-Encoding", strings.Join(request.TransferEncoding, ", "))
+	}
+	request.Header.Set("Connection", "close")
+	request.Header.Write(&head)
+	head.WriteString("\r\n")
+
+	tunnel.reader = io.MultiReader(&head, reader)
+	return tunnel, upstream, destination, nil
+}
+
+// httpProxyDestination returns the host:port an HTTP proxy request is for.
+func httpProxyDestination(request *http.Request) (string, error) {
+	if request.Method == http.MethodConnect {
+		_, _, err := net.SplitHostPort(request.Host)
+		return request.Host, err
+	}
+
+	if request.URL.Scheme != "http" || request.URL.Host == "" {
+		return "", fmt.Errorf("unsupported HTTP proxy request for %s", request.URL)
+	}
+	port := request.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(request.URL.Hostname(), port), nil
+}
+
+func writeHTTPProxyError(client io.Writer, status int) {
+	fmt.Fprintf(client, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status))
+}
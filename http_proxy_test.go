@@ -0,0 +1,167 @@
+package toxiproxy_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/Shopify/toxiproxy/v2"
+)
+
+func NewHTTPProxy() *toxiproxy.Proxy {
+	srv := toxiproxy.NewServer(
+		toxiproxy.NewMetricsContainer(prometheus.NewRegistry()),
+		zerolog.Nop(),
+	)
+	proxy := toxiproxy.NewProxy(srv, "http", "localhost:0", "")
+	proxy.Protocol = toxiproxy.ProtocolHTTPProxy
+	return proxy
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	WithNamedServers(t, []string{"a"}, func(addrs []string) {
+		proxy := NewHTTPProxy()
+		proxy.Start()
+		defer proxy.Stop()
+
+		conn, err := net.Dial("tcp", proxy.Listen)
+		if err != nil {
+			t.Fatal("Unable to dial proxy", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		target := "localhost:" + listenPort(t, addrs[0])
+		io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+
+		expected := "HTTP/1.1 200 Connection established\r\n\r\na"
+		reply := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != expected {
+			t.Errorf("Expected %q, got %q %v", expected, reply, err)
+		}
+	})
+}
+
+func TestHTTPProxyIdleClientDoesNotBlockOthers(t *testing.T) {
+	WithNamedServers(t, []string{"a"}, func(addrs []string) {
+		proxy := NewHTTPProxy()
+		proxy.Start()
+		defer proxy.Stop()
+
+		idle, err := net.Dial("tcp", proxy.Listen)
+		if err != nil {
+			t.Fatal("Unable to dial proxy", err)
+		}
+		defer idle.Close()
+
+		conn, err := net.Dial("tcp", proxy.Listen)
+		if err != nil {
+			t.Fatal("Unable to dial proxy", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		target := "localhost:" + listenPort(t, addrs[0])
+		io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+
+		expected := "HTTP/1.1 200 Connection established\r\n\r\na"
+		reply := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != expected {
+			t.Errorf("Expected %q past the idle client, got %q %v", expected, reply, err)
+		}
+	})
+}
+
+func TestHTTPProxyForwardsRequests(t *testing.T) {
+	WithRecordingServer(t, func(upstream string, received <-chan []byte) {
+		proxy := NewHTTPProxy()
+		proxy.Start()
+		defer proxy.Stop()
+
+		sendThroughProxy(t, proxy.Listen, "POST http://"+upstream+"/path?q=1 HTTP/1.1\r\n"+
+			"Host: "+upstream+"\r\n"+
+			"Proxy-Connection: keep-alive\r\n"+
+			"Content-Length: 5\r\n"+
+			"\r\n"+
+			"hello")
+
+		expected := "POST /path?q=1 HTTP/1.1\r\n" +
+			"Host: " + upstream + "\r\n" +
+			"Connection: close\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello"
+		if data := awaitReceived(t, received); string(data) != expected {
+			t.Errorf("Expected %q, got %q", expected, data)
+		}
+	})
+}
+
+func TestHTTPProxyWithHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	proxy := NewHTTPProxy()
+	proxy.Start()
+	defer proxy.Stop()
+
+	_, err := proxy.Toxics.AddToxicJson(strings.NewReader(
+		`{"type": "latency", "destination": "*:` + listenPort(t, server.Listener.Addr().String()) +
+			`", "attributes": {"latency": 100}}`,
+	))
+	if err != nil {
+		t.Fatal("Failed to add toxic", err)
+	}
+
+	proxyURL, _ := url.Parse("http://" + proxy.Listen)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	for _, path := range []string{"/first", "/second"} {
+		start := time.Now()
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatal("Request through the proxy failed", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != path {
+			t.Errorf("Expected %q, got %q", path, body)
+		}
+		if time.Since(start) < 100*time.Millisecond {
+			t.Error("Expected the toxic for the destination to delay the response")
+		}
+	}
+}
+
+func TestHTTPProxyRepliesToDialErrors(t *testing.T) {
+	proxy := NewHTTPProxy()
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	target := closedAddress(t)
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal("Failed to read response", err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected a bad gateway response, got %s", resp.Status)
+	}
+}
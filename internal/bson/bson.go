@@ -0,0 +1,135 @@
+// Package bson reads and writes the few parts of BSON documents that the
+// MongoDB proxy and toxic need, without decoding whole documents.
+package bson
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// Element types.
+const (
+	Double   = 0x01
+	String   = 0x02
+	Document = 0x03
+	Array    = 0x04
+	Boolean  = 0x08
+	Int32    = 0x10
+)
+
+// ForEachElement calls f with the top level elements of a document, both as
+// raw bytes and as their value, stopping at the first invalid element.
+func ForEachElement(doc []byte, f func(key string, kind byte, raw, value []byte)) {
+	if len(doc) < 5 {
+		return
+	}
+	data := doc[4 : len(doc)-1]
+	for len(data) > 0 {
+		kind := data[0]
+		end := bytes.IndexByte(data[1:], 0)
+		if end < 0 {
+			return
+		}
+		key := string(data[1 : 1+end])
+		size := ValueSize(kind, data[2+end:])
+		if size < 0 || size > len(data)-2-end {
+			return
+		}
+		f(key, kind, data[:2+end+size], data[2+end:2+end+size])
+		data = data[2+end+size:]
+	}
+}
+
+// ValueSize returns the size of a value of the given type at the start of
+// data, or -1 if it can't be determined.
+func ValueSize(kind byte, data []byte) int {
+	switch kind {
+	case 0x06, 0x0A, 0x7F, 0xFF: // undefined, null, max key, min key
+		return 0
+	case Boolean:
+		return 1
+	case Int32:
+		return 4
+	case Double, 0x09, 0x11, 0x12: // datetime, timestamp, int64
+		return 8
+	case 0x07: // object id
+		return 12
+	case 0x13: // decimal128
+		return 16
+	case 0x0B: // regular expression
+		pattern := bytes.IndexByte(data, 0)
+		if pattern < 0 {
+			return -1
+		}
+		options := bytes.IndexByte(data[pattern+1:], 0)
+		if options < 0 {
+			return -1
+		}
+		return pattern + options + 2
+	}
+	if len(data) < 4 {
+		return -1
+	}
+	length := int(int32(binary.LittleEndian.Uint32(data)))
+	if length < 0 {
+		return -1
+	}
+	switch kind {
+	case String, 0x0D, 0x0E: // JavaScript code, symbol
+		return 4 + length
+	case Document, Array, 0x0F: // code with scope
+		return length
+	case 0x05: // binary
+		return 5 + length
+	case 0x0C: // DB pointer
+		return 16 + length
+	}
+	return -1
+}
+
+// StringValue returns the string a String value holds.
+func StringValue(value []byte) string {
+	if len(value) < 5 {
+		return ""
+	}
+	return string(value[4 : len(value)-1])
+}
+
+// AppendKey appends the type and key of an element to doc.
+func AppendKey(doc []byte, kind byte, key string) []byte {
+	doc = append(doc, kind)
+	doc = append(doc, key...)
+	return append(doc, 0)
+}
+
+func AppendDouble(doc []byte, key string, value float64) []byte {
+	doc = AppendKey(doc, Double, key)
+	return binary.LittleEndian.AppendUint64(doc, math.Float64bits(value))
+}
+
+func AppendInt32(doc []byte, key string, value int32) []byte {
+	doc = AppendKey(doc, Int32, key)
+	return binary.LittleEndian.AppendUint32(doc, uint32(value))
+}
+
+func AppendString(doc []byte, key, value string) []byte {
+	doc = AppendKey(doc, String, key)
+	doc = binary.LittleEndian.AppendUint32(doc, uint32(len(value)+1))
+	doc = append(doc, value...)
+	return append(doc, 0)
+}
+
+// AppendDocument appends a Document or Array element holding the encoded
+// elements to doc.
+func AppendDocument(doc []byte, kind byte, key string, elements []byte) []byte {
+	doc = AppendKey(doc, kind, key)
+	return append(doc, NewDocument(elements)...)
+}
+
+// NewDocument wraps encoded elements into a document.
+func NewDocument(elements []byte) []byte {
+	doc := binary.LittleEndian.AppendUint32(nil, uint32(len(elements)+5))
+	doc = append(doc, elements...)
+	return append(doc, 0)
+}
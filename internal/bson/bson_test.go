@@ -0,0 +1,45 @@
+package bson
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestForEachElement(t *testing.T) {
+	var elements []byte
+	elements = AppendString(elements, "name", "toxiproxy")
+	elements = AppendInt32(elements, "port", 8474)
+	elements = AppendDocument(elements, Array, "hosts", AppendString(nil, "0", "a:1"))
+	doc := NewDocument(elements)
+
+	var keys []string
+	var raw []byte
+	ForEachElement(doc, func(key string, kind byte, element, value []byte) {
+		keys = append(keys, key)
+		raw = append(raw, element...)
+		if key == "name" && (kind != String || StringValue(value) != "toxiproxy") {
+			t.Errorf("Expected the name string, got type %d and %q", kind, value)
+		}
+	})
+	if len(keys) != 3 || keys[2] != "hosts" {
+		t.Errorf("Expected name, port and hosts, got %v", keys)
+	}
+	if !bytes.Equal(raw, elements) {
+		t.Errorf("Expected the raw elements to make up the document, got %q", raw)
+	}
+}
+
+func TestForEachElementStopsAtInvalidElements(t *testing.T) {
+	elements := AppendString(nil, "name", "toxiproxy")
+	// A string claiming to be longer than the document
+	elements = append(elements, String, 'x', 0, 0xff, 0, 0, 0)
+	doc := NewDocument(elements)
+
+	var keys []string
+	ForEachElement(doc, func(key string, _ byte, _, _ []byte) {
+		keys = append(keys, key)
+	})
+	if len(keys) != 1 || keys[0] != "name" {
+		t.Errorf("Expected only the valid element, got %v", keys)
+	}
+}
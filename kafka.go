@@ -0,0 +1,387 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	kafkaMetadata        = 3
+	kafkaFindCoordinator = 10
+
+	kafkaMaxMessageSize = 100 * 1024 * 1024
+)
+
+var errKafkaInvalid = errors.New("invalid Kafka message")
+
+type kafkaRequest struct {
+	apiKey     int16
+	apiVersion int16
+}
+
+// kafkaRequests tracks the Metadata and FindCoordinator requests sent to a
+// broker, so their responses can be told apart by correlation id.
+type kafkaRequests struct {
+	sync.Mutex
+	pending map[int32]kafkaRequest
+
+	// Parsing state of the request stream
+	header []byte
+	skip   int
+	broken bool
+}
+
+func newKafkaRequests() *kafkaRequests {
+	return &kafkaRequests{
+		pending: make(map[int32]kafkaRequest),
+		header:  make([]byte, 0, 12),
+	}
+}
+
+// observe parses request headers from the data sent to the broker.
+func (k *kafkaRequests) observe(p []byte) {
+	k.Lock()
+	defer k.Unlock()
+
+	for len(p) > 0 && !k.broken {
+		if k.skip > 0 {
+			n := min(k.skip, len(p))
+			k.skip -= n
+			p = p[n:]
+			continue
+		}
+
+		n := min(cap(k.header)-len(k.header), len(p))
+		k.header = append(k.header, p[:n]...)
+		p = p[n:]
+		if len(k.header) < cap(k.header) {
+			return
+		}
+
+		// size, api_key, api_version, correlation_id
+		size := int32(binary.BigEndian.Uint32(k.header))
+		if size < 8 || size > kafkaMaxMessageSize {
+			// Encrypted or not Kafka at all
+			k.broken = true
+			return
+		}
+		request := kafkaRequest{
+			apiKey:     int16(binary.BigEndian.Uint16(k.header[4:])),
+			apiVersion: int16(binary.BigEndian.Uint16(k.header[6:])),
+		}
+		if request.apiKey == kafkaMetadata || request.apiKey == kafkaFindCoordinator {
+			k.pending[int32(binary.BigEndian.Uint32(k.header[8:]))] = request
+		}
+		k.skip = int(size) - 8
+		k.header = k.header[:0]
+	}
+}
+
+func (k *kafkaRequests) take(correlationID int32) (kafkaRequest, bool) {
+	k.Lock()
+	defer k.Unlock()
+
+	request, ok := k.pending[correlationID]
+	delete(k.pending, correlationID)
+	return request, ok
+}
+
+// kafkaRequestWriter observes requests on their way to the broker.
+type kafkaRequestWriter struct {
+	conn     net.Conn
+	requests *kafkaRequests
+}
+
+func (w *kafkaRequestWriter) Write(p []byte) (int, error) {
+	w.requests.observe(p)
+	return w.conn.Write(p)
+}
+
+// kafkaReader reads responses from a Kafka broker and rewrites the broker
+// addresses in Metadata and FindCoordinator responses to toxiproxy listeners,
+// creating a proxy for each advertised broker.
+type kafkaReader struct {
+	proxy     *Proxy
+	reader    *bufio.Reader
+	requests  *kafkaRequests
+	listeners *discoveredListeners
+
+	pending     []byte
+	skip        int
+	passthrough bool
+}
+
+func newKafkaReader(proxy *Proxy, client, upstream net.Conn, requests *kafkaRequests) *kafkaReader {
+	return &kafkaReader{
+		proxy:     proxy,
+		reader:    bufio.NewReader(upstream),
+		requests:  requests,
+		listeners: newDiscoveredListeners(proxy, client),
+	}
+}
+
+func (r *kafkaReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.passthrough {
+			return r.reader.Read(p)
+		}
+		if r.skip > 0 {
+			n, err := r.reader.Read(p[:min(len(p), r.skip)])
+			r.skip -= n
+			return n, err
+		}
+
+		// size, correlation_id
+		header := make([]byte, 8)
+		n, err := io.ReadFull(r.reader, header)
+		if err != nil {
+			if n == 0 {
+				return 0, err
+			}
+			r.pending = header[:n]
+			r.passthrough = true
+			return r.flush(p)
+		}
+
+		size := int32(binary.BigEndian.Uint32(header))
+		request, ok := r.requests.take(int32(binary.BigEndian.Uint32(header[4:])))
+		if size < 4 || size > kafkaMaxMessageSize {
+			r.passthrough = true
+			ok = false
+		}
+		if !ok {
+			r.pending = header
+			r.skip = max(int(size)-4, 0)
+			return r.flush(p)
+		}
+
+		body := make([]byte, size-4)
+		n, err = io.ReadFull(r.reader, body)
+		if err != nil {
+			r.pending = append(header, body[:n]...)
+			r.passthrough = true
+			return r.flush(p)
+		}
+
+		rewritten, err := r.rewrite(request, body)
+		if err != nil {
+			r.proxy.Logger.
+				Debug().
+				Err(err).
+				Int16("api_key", request.apiKey).
+				Int16("api_version", request.apiVersion).
+				Msg("Unable to rewrite Kafka response")
+			rewritten = body
+		}
+		r.pending = binary.BigEndian.AppendUint32(header[:0], uint32(len(rewritten)+4))
+		r.pending = append(r.pending, header[4:8]...)
+		r.pending = append(r.pending, rewritten...)
+	}
+	return r.flush(p)
+}
+
+func (r *kafkaReader) flush(p []byte) (int, error) {
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *kafkaReader) rewrite(request kafkaRequest, body []byte) ([]byte, error) {
+	version := request.apiVersion
+	var flexible bool
+	switch request.apiKey {
+	case kafkaMetadata:
+		flexible = version >= 9
+	case kafkaFindCoordinator:
+		flexible = version >= 3
+	}
+
+	d := &kafkaDecoder{data: body, flexible: flexible}
+	if flexible {
+		// Response header tagged fields
+		d.taggedFields()
+	}
+
+	switch request.apiKey {
+	case kafkaMetadata:
+		if version >= 3 {
+			d.skip(4) // throttle_time_ms
+		}
+		for i := d.arrayLength(); i > 0 && d.err == nil; i-- {
+			d.skip(4) // node_id
+			r.rewriteBroker(d)
+			if version >= 1 {
+				d.nullableString() // rack
+			}
+			if flexible {
+				d.taggedFields()
+			}
+		}
+	case kafkaFindCoordinator:
+		if version >= 1 {
+			d.skip(4) // throttle_time_ms
+		}
+		if version < 4 {
+			d.skip(2) // error_code
+			if version >= 1 {
+				d.nullableString() // error_message
+			}
+			d.skip(4) // node_id
+			r.rewriteBroker(d)
+			break
+		}
+		for i := d.arrayLength(); i > 0 && d.err == nil; i-- {
+			d.nullableString() // key
+			d.skip(4)          // node_id
+			r.rewriteBroker(d)
+			d.skip(2)          // error_code
+			d.nullableString() // error_message
+			d.taggedFields()
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.apply(), nil
+}
+
+// rewriteBroker replaces the host and port fields at the decoder's position
+// with the listener of the broker's proxy.
+func (r *kafkaReader) rewriteBroker(d *kafkaDecoder) {
+	hostStart := d.pos
+	host := d.nullableString()
+	portStart := d.pos
+	d.skip(4)
+	if d.err != nil {
+		return
+	}
+	port := int32(binary.BigEndian.Uint32(d.data[portStart:]))
+
+	listenHost, listenPort, ok := r.listeners.lookup(host, strconv.Itoa(int(port)))
+	if !ok {
+		return
+	}
+	newPort, err := strconv.Atoi(listenPort)
+	if err != nil {
+		return
+	}
+	d.replace(hostStart, portStart, d.encodeString(listenHost))
+	d.replace(portStart, portStart+4, binary.BigEndian.AppendUint32(nil, uint32(newPort)))
+}
+
+type kafkaReplacement struct {
+	start, end int
+	data       []byte
+}
+
+// kafkaDecoder walks through a Kafka response body and records replacements
+// to apply to it.
+type kafkaDecoder struct {
+	data         []byte
+	pos          int
+	flexible     bool
+	err          error
+	replacements []kafkaReplacement
+}
+
+func (d *kafkaDecoder) skip(n int) {
+	if d.err != nil {
+		return
+	}
+	if n < 0 || d.pos+n > len(d.data) {
+		d.err = errKafkaInvalid
+		return
+	}
+	d.pos += n
+}
+
+func (d *kafkaDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data[d.pos:])
+	if n <= 0 {
+		d.err = errKafkaInvalid
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	start := d.pos
+	d.skip(2)
+	if d.err != nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(d.data[start:]))
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	start := d.pos
+	d.skip(4)
+	if d.err != nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(d.data[start:]))
+}
+
+func (d *kafkaDecoder) nullableString() string {
+	var length int
+	if d.flexible {
+		length = int(d.uvarint()) - 1
+	} else {
+		length = int(d.int16())
+	}
+	if length < 0 {
+		return ""
+	}
+	start := d.pos
+	d.skip(length)
+	if d.err != nil {
+		return ""
+	}
+	return string(d.data[start:d.pos])
+}
+
+func (d *kafkaDecoder) arrayLength() int {
+	if d.flexible {
+		return int(d.uvarint()) - 1
+	}
+	return int(d.int32())
+}
+
+func (d *kafkaDecoder) taggedFields() {
+	for i := d.uvarint(); i > 0 && d.err == nil; i-- {
+		d.uvarint() // tag
+		d.skip(int(d.uvarint()))
+	}
+}
+
+func (d *kafkaDecoder) encodeString(s string) []byte {
+	if d.flexible {
+		return append(binary.AppendUvarint(nil, uint64(len(s)+1)), s...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func (d *kafkaDecoder) replace(start, end int, data []byte) {
+	d.replacements = append(d.replacements, kafkaReplacement{start, end, data})
+}
+
+// apply returns the data with all replacements made, in order.
+func (d *kafkaDecoder) apply() []byte {
+	result := make([]byte, 0, len(d.data))
+	pos := 0
+	for _, r := range d.replacements {
+		result = append(result, d.data[pos:r.start]...)
+		result = append(result, r.data...)
+		pos = r.end
+	}
+	return append(result, d.data[pos:]...)
+}
@@ -0,0 +1,165 @@
+package toxiproxy_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/Shopify/toxiproxy/v2"
+)
+
+// WithKafkaBroker runs a fake Kafka broker that answers every request with the
+// body returned by f, keeping the request's correlation id.
+func WithKafkaBroker(t *testing.T, reply func(apiKey int16) []byte, f func(addr string)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					request, err := readKafkaMessage(conn)
+					if err != nil {
+						return
+					}
+					apiKey := int16(binary.BigEndian.Uint16(request))
+					body := append([]byte{}, request[4:8]...)
+					body = append(body, reply(apiKey)...)
+					conn.Write(kafkaMessage(body))
+				}
+			}(conn)
+		}
+	}()
+
+	f(ln.Addr().String())
+}
+
+func NewKafkaProxy(upstream string) (*toxiproxy.ApiServer, *toxiproxy.Proxy) {
+	srv := toxiproxy.NewServer(
+		toxiproxy.NewMetricsContainer(prometheus.NewRegistry()),
+		zerolog.Nop(),
+	)
+	proxy := toxiproxy.NewProxy(srv, "kafka", "localhost:0", upstream)
+	proxy.Protocol = toxiproxy.ProtocolKafka
+	return srv, proxy
+}
+
+func kafkaMessage(body []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...)
+}
+
+func readKafkaMessage(conn net.Conn) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(size))
+	_, err := io.ReadFull(conn, body)
+	return body, err
+}
+
+func kafkaString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+// kafkaMetadataV1 returns a Metadata v1 response body listing a single broker.
+func kafkaMetadataV1(addr string) []byte {
+	host, portString, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portString)
+
+	body := binary.BigEndian.AppendUint32(nil, 1) // brokers
+	body = binary.BigEndian.AppendUint32(body, 1) // node_id
+	body = append(body, kafkaString(host)...)
+	body = binary.BigEndian.AppendUint32(body, uint32(port))
+	body = binary.BigEndian.AppendUint16(body, 0xffff) // rack
+	body = binary.BigEndian.AppendUint32(body, 1)      // controller_id
+	return binary.BigEndian.AppendUint32(body, 0)      // topics
+}
+
+func kafkaRoundTrip(t *testing.T, addr string, apiKey int16) []byte {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	defer conn.Close()
+
+	// api_key, api_version, correlation_id, client_id, topics
+	request := binary.BigEndian.AppendUint16(nil, uint16(apiKey))
+	request = binary.BigEndian.AppendUint16(request, 1)
+	request = binary.BigEndian.AppendUint32(request, 42)
+	request = binary.BigEndian.AppendUint16(request, 0xffff)
+	request = binary.BigEndian.AppendUint32(request, 0xffffffff)
+	if _, err := conn.Write(kafkaMessage(request)); err != nil {
+		t.Fatal("Failed writing to proxy", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	response, err := readKafkaMessage(conn)
+	if err != nil {
+		t.Fatal("Failed reading from proxy", err)
+	}
+	if binary.BigEndian.Uint32(response) != 42 {
+		t.Errorf("Expected correlation id 42, got %d", binary.BigEndian.Uint32(response))
+	}
+	return response[4:]
+}
+
+func TestKafkaRewritesMetadata(t *testing.T) {
+	WithKafkaBroker(t, func(int16) []byte { return nil }, func(broker string) {
+		WithKafkaBroker(t, func(int16) []byte {
+			return kafkaMetadataV1(broker)
+		}, func(upstream string) {
+			srv, proxy := NewKafkaProxy(upstream)
+			proxy.Start()
+			defer proxy.Stop()
+
+			response := kafkaRoundTrip(t, proxy.Listen, 3)
+
+			discovered, err := srv.Collection.Get("kafka_" + strings.ReplaceAll(broker, ":", "_"))
+			if err != nil {
+				t.Fatal("Expected a proxy to be created for the broker", err)
+			}
+			defer discovered.Stop()
+
+			if discovered.Upstream != broker || discovered.Protocol != toxiproxy.ProtocolKafka {
+				t.Errorf("Unexpected discovered proxy: %s %s", discovered.Upstream, discovered.Protocol)
+			}
+			expected := kafkaMetadataV1("127.0.0.1:" + listenPort(t, discovered.Listen))
+			if string(response) != string(expected) {
+				t.Errorf("Expected %x, got %x", expected, response)
+			}
+		})
+	})
+}
+
+func TestKafkaPassesThroughOtherResponses(t *testing.T) {
+	// Only responses to Metadata and FindCoordinator requests are rewritten
+	body := kafkaMetadataV1("10.0.0.1:9092")
+	WithKafkaBroker(t, func(int16) []byte { return body }, func(upstream string) {
+		srv, proxy := NewKafkaProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		if response := kafkaRoundTrip(t, proxy.Listen, 18); string(response) != string(body) {
+			t.Errorf("Expected %x, got %x", body, response)
+		}
+		if len(srv.Collection.Proxies()) != 0 {
+			t.Error("Expected no proxies to be created")
+		}
+	})
+}
@@ -22,13 +22,15 @@ import (
 // |             v           v
 // | Input > ToxicStub > ToxicStub > Output.
 type ToxicLink struct {
-	stubs     []*toxics.ToxicStub
-	proxy     *Proxy
-	toxics    *ToxicCollection
-	input     *stream.ChanWriter
-	output    *stream.ChanReader
-	direction stream.Direction
-	Logger    *zerolog.Logger
+	stubs       []*toxics.ToxicStub
+	proxy       *Proxy
+	toxics      *ToxicCollection
+	input       *stream.ChanWriter
+	output      *stream.ChanReader
+	reply       *toxics.Replies
+	direction   stream.Direction
+	destination string // Address the link's connection was dialed to
+	Logger      *zerolog.Logger
 }
 
 func NewToxicLink(
@@ -66,6 +68,49 @@ func NewToxicLink(
 	return link
 }
 
+// lingerer is implemented by connections that can discard unsent data on
+// close, such as *net.TCPConn.
+type lingerer interface {
+	SetLinger(sec int) error
+}
+
+// replier is implemented by connections that serialize what they are sent
+// with the replies toxics answer them with.
+type replier interface {
+	Replies() *toxics.Replies
+}
+
+// replyConn is a connection whose writes are ordered with the replies toxics
+// answer it with.
+type replyConn struct {
+	net.Conn
+	replies *toxics.Replies
+}
+
+func newReplyConn(conn net.Conn) *replyConn {
+	return &replyConn{Conn: conn, replies: toxics.NewReplies(conn)}
+}
+
+func (c *replyConn) Write(p []byte) (int, error) {
+	return c.replies.Write(p)
+}
+
+func (c *replyConn) Replies() *toxics.Replies {
+	return c.replies
+}
+
+func (c *replyConn) Close() error {
+	c.replies.Close()
+	return c.Conn.Close()
+}
+
+func (c *replyConn) SetLinger(sec int) error {
+	if conn, ok := c.Conn.(lingerer); ok {
+		return conn.SetLinger(sec)
+	}
+	return nil
+}
+
 // Start the link with the specified toxics.
 func (link *ToxicLink) Start(
 	server *ApiServer,
@@ -83,26 +128,39 @@ func (link *ToxicLink) Start(
 		link.Direction(),
 		link.proxy.Name,
 		link.proxy.Listen,
-		link.proxy.Upstream}
+		link.proxy.currentUpstream()}
+
+	// Toxics may answer the source directly, e.g. with a protocol error.
+	if conn, ok := source.(replier); ok {
+		link.reply = conn.Replies()
+	} else if conn, ok := source.(io.Writer); ok {
+		link.reply = toxics.NewReplies(conn)
+	}
 
 	go link.read(labels, server, source)
 
 	for i, toxic := range link.toxics.chain[link.direction] {
+		link.stubs[i].Reply = link.reply
+		link.stubs[i].Destination = link.destination
 		if stateful, ok := toxic.Toxic.(toxics.StatefulToxic); ok {
 			link.stubs[i].State = stateful.NewState()
 		}
 
 		if _, ok := toxic.Toxic.(*toxics.ResetToxic); ok {
-			if err := source.(*net.TCPConn).SetLinger(0); err != nil {
-				logger.Err(err).
-					Str("toxic", toxic.Type).
-					Msg("source: Unable to setLinger(ms)")
+			if conn, ok := source.(lingerer); ok {
+				if err := conn.SetLinger(0); err != nil {
+					logger.Err(err).
+						Str("toxic", toxic.Type).
+						Msg("source: Unable to setLinger(ms)")
+				}
 			}
 
-			if err := dest.(*net.TCPConn).SetLinger(0); err != nil {
-				logger.Err(err).
-					Str("toxic", toxic.Type).
-					Msg("dest: Unable to setLinger(ms)")
+			if conn, ok := dest.(lingerer); ok {
+				if err := conn.SetLinger(0); err != nil {
+					logger.Err(err).
+						Str("toxic", toxic.Type).
+						Msg("dest: Unable to setLinger(ms)")
+				}
 			}
 		}
 
@@ -173,6 +231,8 @@ func (link *ToxicLink) AddToxic(toxic *toxics.ToxicWrapper) {
 
 	newin := make(chan *stream.StreamChunk, toxic.BufferSize)
 	link.stubs = append(link.stubs, toxics.NewToxicStub(newin, link.stubs[i-1].Output))
+	link.stubs[i].Reply = link.reply
+	link.stubs[i].Destination = link.destination
 
 	// Interrupt the last toxic so that we don't have a race when moving channels
 	if link.stubs[i-1].InterruptToxic() {
@@ -0,0 +1,230 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/Shopify/toxiproxy/v2/internal/bson"
+)
+
+const (
+	mongoOpReply = 1
+	mongoOpMsg   = 2013
+
+	mongoChecksumPresent = 1 << 0
+
+	mongoMaxMessageSize = 48 * 1000 * 1000
+	mongoDefaultPort    = "27017"
+)
+
+// mongoReader reads replies from a MongoDB replica set member and rewrites the
+// member addresses in hello replies to toxiproxy listeners, creating a proxy
+// for each member.
+type mongoReader struct {
+	proxy     *Proxy
+	reader    *bufio.Reader
+	listeners *discoveredListeners
+
+	pending     []byte
+	skip        int
+	passthrough bool
+}
+
+func newMongoReader(proxy *Proxy, client, upstream net.Conn) *mongoReader {
+	return &mongoReader{
+		proxy:     proxy,
+		reader:    bufio.NewReader(upstream),
+		listeners: newDiscoveredListeners(proxy, client),
+	}
+}
+
+func (r *mongoReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.passthrough {
+			return r.reader.Read(p)
+		}
+		if r.skip > 0 {
+			n, err := r.reader.Read(p[:min(len(p), r.skip)])
+			r.skip -= n
+			return n, err
+		}
+
+		// messageLength, requestID, responseTo, opCode
+		header := make([]byte, 16)
+		n, err := io.ReadFull(r.reader, header)
+		if err != nil {
+			if n == 0 {
+				return 0, err
+			}
+			r.pending = header[:n]
+			r.passthrough = true
+			return r.flush(p)
+		}
+
+		size := int(int32(binary.LittleEndian.Uint32(header)))
+		opCode := binary.LittleEndian.Uint32(header[12:])
+		if size < 16 || size > mongoMaxMessageSize {
+			r.pending = header
+			r.passthrough = true
+			return r.flush(p)
+		}
+		if opCode != mongoOpMsg && opCode != mongoOpReply {
+			r.pending = header
+			r.skip = size - 16
+			return r.flush(p)
+		}
+
+		msg := make([]byte, size)
+		copy(msg, header)
+		n, err = io.ReadFull(r.reader, msg[16:])
+		if err != nil {
+			r.pending = msg[:16+n]
+			r.passthrough = true
+			return r.flush(p)
+		}
+
+		if opCode == mongoOpMsg {
+			r.pending = r.rewriteMsg(msg)
+		} else {
+			r.pending = r.rewriteReply(msg)
+		}
+	}
+	return r.flush(p)
+}
+
+func (r *mongoReader) flush(p []byte) (int, error) {
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// rewriteMsg rewrites the body of an OP_MSG reply. The checksum is dropped
+// from rewritten messages.
+func (r *mongoReader) rewriteMsg(msg []byte) []byte {
+	if len(msg) < 21 {
+		return msg
+	}
+	flags := binary.LittleEndian.Uint32(msg[16:])
+	sections := msg[20:]
+	if flags&mongoChecksumPresent != 0 {
+		if len(sections) < 4 {
+			return msg
+		}
+		sections = sections[:len(sections)-4]
+	}
+
+	var rewritten []byte
+	changed := false
+	for len(sections) > 5 {
+		kind := sections[0]
+		size := int(binary.LittleEndian.Uint32(sections[1:]))
+		if size < 5 || size > len(sections)-1 {
+			return msg
+		}
+		section := sections[:1+size]
+		if kind == 0 {
+			if doc, ok := r.rewriteHello(section[1:]); ok {
+				section = append([]byte{0}, doc...)
+				changed = true
+			}
+		}
+		rewritten = append(rewritten, section...)
+		sections = sections[1+size:]
+	}
+	if !changed {
+		return msg
+	}
+
+	result := make([]byte, 20, 20+len(rewritten))
+	copy(result, msg[:20])
+	binary.LittleEndian.PutUint32(result, uint32(20+len(rewritten)))
+	binary.LittleEndian.PutUint32(result[16:], flags&^mongoChecksumPresent)
+	return append(result, rewritten...)
+}
+
+// rewriteReply rewrites the first document of an OP_REPLY, which answers
+// commands sent with the legacy OP_QUERY during the initial handshake.
+func (r *mongoReader) rewriteReply(msg []byte) []byte {
+	// header, responseFlags, cursorID, startingFrom, numberReturned
+	if len(msg) < 36+5 {
+		return msg
+	}
+	size := int(binary.LittleEndian.Uint32(msg[36:]))
+	if size < 5 || size > len(msg)-36 {
+		return msg
+	}
+	doc, ok := r.rewriteHello(msg[36 : 36+size])
+	if !ok {
+		return msg
+	}
+
+	result := make([]byte, 36, len(msg)-size+len(doc))
+	copy(result, msg[:36])
+	result = append(result, doc...)
+	result = append(result, msg[36+size:]...)
+	binary.LittleEndian.PutUint32(result, uint32(len(result)))
+	return result
+}
+
+// rewriteHello rewrites the member addresses in a replica set hello reply. It
+// returns false if doc isn't one or nothing was rewritten.
+func (r *mongoReader) rewriteHello(doc []byte) ([]byte, bool) {
+	replicaSet := false
+	bson.ForEachElement(doc, func(key string, _ byte, _, _ []byte) {
+		if key == "setName" {
+			replicaSet = true
+		}
+	})
+	if !replicaSet {
+		return nil, false
+	}
+
+	var elements []byte
+	changed := false
+	bson.ForEachElement(doc, func(key string, kind byte, raw, value []byte) {
+		switch {
+		case kind == bson.String && (key == "me" || key == "primary"):
+			if addr, ok := r.rewriteAddr(bson.StringValue(value)); ok {
+				elements = bson.AppendString(elements, key, addr)
+				changed = true
+				return
+			}
+		case kind == bson.Array && (key == "hosts" || key == "passives" || key == "arbiters"):
+			var items []byte
+			arrayChanged := false
+			bson.ForEachElement(value, func(index string, kind byte, raw, value []byte) {
+				if kind == bson.String {
+					if addr, ok := r.rewriteAddr(bson.StringValue(value)); ok {
+						items = bson.AppendString(items, index, addr)
+						arrayChanged = true
+						return
+					}
+				}
+				items = append(items, raw...)
+			})
+			if arrayChanged {
+				elements = bson.AppendDocument(elements, bson.Array, key, items)
+				changed = true
+				return
+			}
+		}
+		elements = append(elements, raw...)
+	})
+	if !changed {
+		return nil, false
+	}
+	return bson.NewDocument(elements), true
+}
+
+func (r *mongoReader) rewriteAddr(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, mongoDefaultPort
+	}
+	if host, port, ok := r.listeners.lookup(host, port); ok {
+		return net.JoinHostPort(host, port), true
+	}
+	return "", false
+}
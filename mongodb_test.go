@@ -0,0 +1,181 @@
+package toxiproxy_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/Shopify/toxiproxy/v2"
+)
+
+// WithMongoNode runs a fake MongoDB node that answers every OP_MSG with the
+// document returned by f.
+func WithMongoNode(t *testing.T, reply func(addr string) []byte, f func(addr string)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					request, err := readMongoMessage(conn)
+					if err != nil {
+						return
+					}
+					requestID := int32(binary.LittleEndian.Uint32(request[4:]))
+					conn.Write(mongoMessage(0, requestID, reply(ln.Addr().String())))
+				}
+			}(conn)
+		}
+	}()
+
+	f(ln.Addr().String())
+}
+
+func NewMongoProxy(upstream string) (*toxiproxy.ApiServer, *toxiproxy.Proxy) {
+	srv := toxiproxy.NewServer(
+		toxiproxy.NewMetricsContainer(prometheus.NewRegistry()),
+		zerolog.Nop(),
+	)
+	proxy := toxiproxy.NewProxy(srv, "mongo", "localhost:0", upstream)
+	proxy.Protocol = toxiproxy.ProtocolMongoDB
+	return srv, proxy
+}
+
+func bsonString(key, value string) []byte {
+	element := append([]byte{0x02}, key...)
+	element = append(element, 0)
+	element = binary.LittleEndian.AppendUint32(element, uint32(len(value)+1))
+	element = append(element, value...)
+	return append(element, 0)
+}
+
+func bsonDocument(elements ...[]byte) []byte {
+	body := bytes.Join(elements, nil)
+	doc := binary.LittleEndian.AppendUint32(nil, uint32(len(body)+5))
+	doc = append(doc, body...)
+	return append(doc, 0)
+}
+
+func bsonArray(key string, values ...string) []byte {
+	var items [][]byte
+	for i, value := range values {
+		items = append(items, bsonString(string(rune('0'+i)), value))
+	}
+	element := append([]byte{0x04}, key...)
+	element = append(element, 0)
+	return append(element, bsonDocument(items...)...)
+}
+
+func mongoHello(me string, hosts ...string) []byte {
+	return bsonDocument(
+		bsonString("setName", "rs0"),
+		bsonArray("hosts", hosts...),
+		bsonString("primary", me),
+		bsonString("me", me),
+	)
+}
+
+func mongoMessage(requestID, responseTo int32, body []byte) []byte {
+	msg := binary.LittleEndian.AppendUint32(nil, uint32(21+len(body)))
+	msg = binary.LittleEndian.AppendUint32(msg, uint32(requestID))
+	msg = binary.LittleEndian.AppendUint32(msg, uint32(responseTo))
+	msg = binary.LittleEndian.AppendUint32(msg, 2013)
+	msg = binary.LittleEndian.AppendUint32(msg, 0)
+	msg = append(msg, 0)
+	return append(msg, body...)
+}
+
+func readMongoMessage(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.LittleEndian.Uint32(header))
+	copy(msg, header)
+	_, err := io.ReadFull(conn, msg[16:])
+	return msg, err
+}
+
+func mongoRoundTrip(t *testing.T, addr string) []byte {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	defer conn.Close()
+
+	hello := mongoMessage(7, 0, bsonDocument(bsonString("hello", "1"), bsonString("$db", "admin")))
+	if _, err := conn.Write(hello); err != nil {
+		t.Fatal("Failed writing to proxy", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	reply, err := readMongoMessage(conn)
+	if err != nil {
+		t.Fatal("Failed reading from proxy", err)
+	}
+	if responseTo := binary.LittleEndian.Uint32(reply[8:]); responseTo != 7 {
+		t.Errorf("Expected reply to request 7, got %d", responseTo)
+	}
+	return reply[21:]
+}
+
+func TestMongoDBRewritesHello(t *testing.T) {
+	WithMongoNode(t, func(string) []byte { return bsonDocument() }, func(secondary string) {
+		WithMongoNode(t, func(primary string) []byte {
+			return mongoHello(primary, primary, secondary)
+		}, func(upstream string) {
+			srv, proxy := NewMongoProxy(upstream)
+			proxy.Start()
+			defer proxy.Stop()
+
+			reply := mongoRoundTrip(t, proxy.Listen)
+
+			discovered, err := srv.Collection.Get("mongo_" + strings.ReplaceAll(secondary, ":", "_"))
+			if err != nil {
+				t.Fatal("Expected a proxy to be created for the secondary", err)
+			}
+			defer discovered.Stop()
+
+			if discovered.Upstream != secondary || discovered.Protocol != toxiproxy.ProtocolMongoDB {
+				t.Errorf("Unexpected discovered proxy: %s %s", discovered.Upstream, discovered.Protocol)
+			}
+			primary := "127.0.0.1:" + listenPort(t, proxy.Listen)
+			expected := mongoHello(primary, primary, "127.0.0.1:"+listenPort(t, discovered.Listen))
+			if !bytes.Equal(reply, expected) {
+				t.Errorf("Expected %q, got %q", expected, reply)
+			}
+		})
+	})
+}
+
+func TestMongoDBPassesThroughOtherReplies(t *testing.T) {
+	doc := bsonDocument(bsonArray("hosts", "10.0.0.1:27017"), bsonString("me", "10.0.0.1:27017"))
+	WithMongoNode(t, func(string) []byte { return doc }, func(upstream string) {
+		srv, proxy := NewMongoProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		if reply := mongoRoundTrip(t, proxy.Listen); !bytes.Equal(reply, doc) {
+			t.Errorf("Expected %q, got %q", doc, reply)
+		}
+		if len(srv.Collection.Proxies()) != 0 {
+			t.Error("Expected no proxies to be created")
+		}
+	})
+}
@@ -1,9 +1,17 @@
 package toxiproxy
 
 import (
+	"context"
 	"errors"
+	"io"
 	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog"
 	tomb "gopkg.in/tomb.v1"
@@ -22,13 +30,52 @@ type Proxy struct {
 	Name     string `json:"name"`
 	Listen   string `json:"listen"`
 	Upstream string `json:"upstream"`
+	Protocol string `json:"protocol"`
 	Enabled  bool   `json:"enabled"`
 
+	// PROXY protocol version of the header sent to the upstream, if any
+	SendProxyProtocol string `json:"send_proxy_protocol"`
+	// Whether clients start with a PROXY protocol header
+	AcceptProxyProtocol bool `json:"accept_proxy_protocol"`
+	// TLS server names or HTTP hosts the proxy serves, on a listener shared
+	// with the other proxies serving hosts on its listen address
+	Hosts []string `json:"hosts"`
+
+	// How clients are spread over the comma separated addresses of Upstream
+	UpstreamStrategy string `json:"upstream_strategy"`
+	// Weights of the upstreams for the weighted strategy
+	UpstreamWeights []int `json:"upstream_weights"`
+	// Whether updating the upstreams keeps established connections
+	KeepConnections bool `json:"keep_connections"`
+	// Milliseconds between lookups of the upstream host names, or 0 to look
+	// them up on every dial
+	ResolveInterval int64 `json:"resolve_interval"`
+	// Milliseconds to connect to an upstream, or 0 for no timeout
+	DialTimeout int64 `json:"dial_timeout"`
+
+	// TCP_NODELAY of client and upstream connections, or nil for Go's default
+	TCPNoDelay *bool `json:"tcp_nodelay,omitempty"`
+	// Milliseconds between TCP keepalive probes, 0 for Go's default or
+	// negative to disable them
+	KeepAlive int64 `json:"keepalive"`
+	// SO_RCVBUF and SO_SNDBUF sizes in bytes, or 0 for the system's default
+	ReadBuffer  int `json:"read_buffer"`
+	WriteBuffer int `json:"write_buffer"`
+	// IP address, with an optional port, to dial upstreams from
+	SourceAddress string `json:"source_address"`
+
 	listener net.Listener
-	started  chan error
+	// Listener for the UDP datagrams of dns proxies
+	packetListener net.PacketConn
+	// Upstreams new clients are connected to
+	upstreams atomic.Pointer[upstreamBalancer]
+	started   chan error
 
 	tomb        tomb.Tomb
 	connections ConnectionList
+	// Clients of unix domain sockets accepted so far, which name them as they
+	// have no address. It isn't reset on restarts so names stay unique.
+	unixClients atomic.Uint64
 	Toxics      *ToxicCollection `json:"-"`
 	apiServer   *ApiServer
 	Logger      *zerolog.Logger
@@ -49,6 +96,49 @@ func (c *ConnectionList) Unlock() {
 
 var ErrProxyAlreadyStarted = errors.New("Proxy already started")
 
+// Time clients have to send a PROXY header or a proxy request before they are
+// dropped.
+const handshakeTimeout = 5 * time.Second
+
+const (
+	ProtocolTCP          = "tcp"
+	ProtocolRedisCluster = "redis_cluster"
+	ProtocolKafka        = "kafka"
+	ProtocolMongoDB      = "mongodb"
+	ProtocolDNS          = "dns"
+	ProtocolUDP          = "udp"
+	ProtocolSOCKS5       = "socks5"
+	ProtocolHTTPProxy    = "http_proxy"
+)
+
+var protocols = map[string]bool{
+	ProtocolTCP:          true,
+	ProtocolRedisCluster: true,
+	ProtocolKafka:        true,
+	ProtocolMongoDB:      true,
+	ProtocolDNS:          true,
+	ProtocolUDP:          true,
+	ProtocolSOCKS5:       true,
+	ProtocolHTTPProxy:    true,
+}
+
+// ValidProtocol reports whether protocol is a known proxy protocol.
+func ValidProtocol(protocol string) bool {
+	return protocols[protocol]
+}
+
+// DynamicProtocol reports whether proxies with protocol connect clients to the
+// destinations they ask for, rather than to an upstream.
+func DynamicProtocol(protocol string) bool {
+	return protocol == ProtocolSOCKS5 || protocol == ProtocolHTTPProxy
+}
+
+// DatagramProtocol reports whether proxies with protocol forward UDP
+// datagrams, which datagram toxics need.
+func DatagramProtocol(protocol string) bool {
+	return protocol == ProtocolUDP || protocol == ProtocolDNS
+}
+
 func NewProxy(server *ApiServer, name, listen, upstream string) *Proxy {
 	l := server.Logger.
 		With().
@@ -58,13 +148,15 @@ func NewProxy(server *ApiServer, name, listen, upstream string) *Proxy {
 		Logger()
 
 	proxy := &Proxy{
-		Name:        name,
-		Listen:      listen,
-		Upstream:    upstream,
-		started:     make(chan error),
-		connections: ConnectionList{list: make(map[string]net.Conn)},
-		apiServer:   server,
-		Logger:      &l,
+		Name:             name,
+		Listen:           listen,
+		Upstream:         upstream,
+		Protocol:         ProtocolTCP,
+		UpstreamStrategy: StrategyRoundRobin,
+		started:          make(chan error),
+		connections:      ConnectionList{list: make(map[string]net.Conn)},
+		apiServer:        server,
+		Logger:           &l,
 	}
 	proxy.Toxics = NewToxicCollection(proxy)
 	return proxy
@@ -85,12 +177,35 @@ func (proxy *Proxy) Update(input *Proxy) error {
 	if err != nil {
 		return err
 	}
+	if !DatagramProtocol(input.Protocol) && proxy.Toxics.hasDatagramToxics() {
+		return ErrDatagramToxic
+	}
 
 	if differs {
-		stop(proxy)
-		proxy.Listen = input.Listen
-		proxy.Upstream = input.Upstream
+		listenerDiffers, _ := proxy.listenerDiffers(input)
+		if input.KeepConnections && proxy.Enabled && !listenerDiffers {
+			// Only new clients are connected to the new upstreams, the links
+			// of established connections keep running.
+			proxy.setUpstream(input)
+			balancer := newUpstreamBalancer(proxy)
+			balancer.start()
+			proxy.upstreams.Swap(balancer).close()
+		} else {
+			stop(proxy)
+			proxy.Listen = input.Listen
+			proxy.Protocol = input.Protocol
+			proxy.SendProxyProtocol = input.SendProxyProtocol
+			proxy.AcceptProxyProtocol = input.AcceptProxyProtocol
+			proxy.Hosts = input.Hosts
+			proxy.TCPNoDelay = input.TCPNoDelay
+			proxy.KeepAlive = input.KeepAlive
+			proxy.ReadBuffer = input.ReadBuffer
+			proxy.WriteBuffer = input.WriteBuffer
+			proxy.SourceAddress = input.SourceAddress
+			proxy.setUpstream(input)
+		}
 	}
+	proxy.KeepConnections = input.KeepConnections
 
 	if input.Enabled != proxy.Enabled {
 		if input.Enabled {
@@ -101,6 +216,16 @@ func (proxy *Proxy) Update(input *Proxy) error {
 	return nil
 }
 
+func (proxy *Proxy) setUpstream(input *Proxy) {
+	proxy.Upstream = input.Upstream
+	if input.UpstreamStrategy != "" {
+		proxy.UpstreamStrategy = input.UpstreamStrategy
+	}
+	proxy.UpstreamWeights = input.UpstreamWeights
+	proxy.ResolveInterval = input.ResolveInterval
+	proxy.DialTimeout = input.DialTimeout
+}
+
 func (proxy *Proxy) Stop() {
 	proxy.Lock()
 	defer proxy.Unlock()
@@ -110,12 +235,34 @@ func (proxy *Proxy) Stop() {
 
 func (proxy *Proxy) listen() error {
 	var err error
-	proxy.listener, err = net.Listen("tcp", proxy.Listen)
-	if err != nil {
-		proxy.started <- err
-		return err
+	proxy.listener = nil
+	if proxy.Protocol != ProtocolUDP {
+		network, address := splitAddress(proxy.Listen)
+		if len(proxy.Hosts) > 0 {
+			proxy.listener, err = listenHosts(proxy)
+		} else {
+			proxy.listener, err = proxy.listenConfig().Listen(context.Background(), network, address)
+		}
+		if err != nil {
+			proxy.started <- err
+			return err
+		}
+		if network == "tcp" {
+			proxy.Listen = proxy.listener.Addr().String()
+		}
+	}
+	if DatagramProtocol(proxy.Protocol) {
+		proxy.packetListener, err = proxy.listenConfig().
+			ListenPacket(context.Background(), "udp", proxy.Listen)
+		if err != nil {
+			if proxy.listener != nil {
+				proxy.listener.Close()
+			}
+			proxy.started <- err
+			return err
+		}
+		proxy.Listen = proxy.packetListener.LocalAddr().String()
 	}
-	proxy.Listen = proxy.listener.Addr().String()
 	proxy.started <- nil
 
 	proxy.Logger.
@@ -127,28 +274,82 @@ func (proxy *Proxy) listen() error {
 
 func (proxy *Proxy) close() {
 	// Unblock proxy.listener.Accept()
-	err := proxy.listener.Close()
-	if err != nil {
-		proxy.Logger.
-			Warn().
-			Err(err).
-			Msg("Attempted to close an already closed proxy server")
+	if proxy.listener != nil {
+		err := proxy.listener.Close()
+		if err != nil {
+			proxy.Logger.
+				Warn().
+				Err(err).
+				Msg("Attempted to close an already closed proxy server")
+		}
+	}
+	// Unblock proxy.packetListener.ReadFrom()
+	if proxy.packetListener != nil {
+		proxy.packetListener.Close()
+		proxy.packetListener = nil
 	}
 }
 
 func (proxy *Proxy) Differs(other *Proxy) (bool, error) {
-	newResolvedListen, err := net.ResolveTCPAddr("tcp", other.Listen)
-	if err != nil {
-		return false, err
+	differs, err := proxy.listenerDiffers(other)
+	if err != nil || differs {
+		return differs, err
 	}
+	return proxy.upstreamDiffers(other), nil
+}
 
-	if proxy.Listen != newResolvedListen.String() || proxy.Upstream != other.Upstream {
+// listenerDiffers reports whether other has to be served by another listener.
+func (proxy *Proxy) listenerDiffers(other *Proxy) (bool, error) {
+	listen := other.Listen
+	if network, _ := splitAddress(other.Listen); network == "tcp" {
+		newResolvedListen, err := net.ResolveTCPAddr("tcp", other.Listen)
+		if err != nil {
+			return false, err
+		}
+		listen = newResolvedListen.String()
+	}
+
+	if proxy.Listen != listen {
+		return true, nil
+	}
+
+	if other.Protocol != "" && proxy.Protocol != other.Protocol {
+		return true, nil
+	}
+
+	if proxy.SendProxyProtocol != other.SendProxyProtocol ||
+		proxy.AcceptProxyProtocol != other.AcceptProxyProtocol {
+		return true, nil
+	}
+
+	if !slices.Equal(proxy.Hosts, other.Hosts) {
+		return true, nil
+	}
+
+	if proxy.socketOptionsDiffer(other) {
 		return true, nil
 	}
 
 	return false, nil
 }
 
+// upstreamDiffers reports whether other connects clients to other upstreams.
+func (proxy *Proxy) upstreamDiffers(other *Proxy) bool {
+	if proxy.Upstream != other.Upstream {
+		return true
+	}
+
+	if other.UpstreamStrategy != "" && proxy.UpstreamStrategy != other.UpstreamStrategy {
+		return true
+	}
+
+	if proxy.ResolveInterval != other.ResolveInterval || proxy.DialTimeout != other.DialTimeout {
+		return true
+	}
+
+	return !slices.Equal(proxy.UpstreamWeights, other.UpstreamWeights)
+}
+
 // This channel is to kill the blocking Accept() call below by closing the
 // net.Listener.
 func (proxy *Proxy) freeBlocker(acceptTomb *tomb.Tomb) {
@@ -175,10 +376,34 @@ func (proxy *Proxy) server() {
 	acceptTomb := &tomb.Tomb{}
 	defer acceptTomb.Done()
 
+	if proxy.packetListener != nil {
+		// Stop reading datagrams before the accept loop is done
+		var packets sync.WaitGroup
+		defer packets.Wait()
+		packets.Add(1)
+		go func(listener net.PacketConn) {
+			defer packets.Done()
+			proxy.servePackets(listener)
+		}(proxy.packetListener)
+	}
+
 	// This channel is to kill the blocking Accept() call below by closing the
 	// net.Listener.
 	go proxy.freeBlocker(acceptTomb)
 
+	if proxy.listener == nil {
+		// Only UDP datagrams are proxied
+		<-acceptTomb.Dying()
+		return
+	}
+
+	// Clients are handed to their own goroutines to read their handshake and
+	// dial their upstream, which are stopped and waited for with the proxy.
+	ctx, cancel := context.WithCancel(context.Background())
+	var handshakes sync.WaitGroup
+	defer handshakes.Wait()
+	defer cancel()
+
 	for {
 		client, err := proxy.listener.Accept()
 		if err != nil {
@@ -198,29 +423,329 @@ func (proxy *Proxy) server() {
 			return
 		}
 
+		name := client.RemoteAddr().String()
+		if _, ok := client.(*net.UnixConn); ok {
+			// Clients of unix domain sockets have no address
+			name = "unix:" + strconv.FormatUint(proxy.unixClients.Add(1), 10)
+		}
+
+		handshakes.Add(1)
+		go func() {
+			defer handshakes.Done()
+			proxy.serveClient(ctx, name, client)
+		}()
+	}
+}
+
+// serveClient reads the PROXY header or proxy request of an accepted client,
+// dials its upstream and starts its links. The client is closed if ctx is done
+// first.
+func (proxy *Proxy) serveClient(ctx context.Context, name string, client net.Conn) {
+	stopClosing := context.AfterFunc(ctx, func() {
+		client.Close()
+	})
+	defer stopClosing()
+
+	var err error
+	if proxy.AcceptProxyProtocol {
+		conn, err := acceptProxyHeader(client)
+		if err != nil {
+			proxy.Logger.
+				Warn().
+				Err(err).
+				Str("client", name).
+				Msg("Unable to read PROXY protocol header")
+			client.Close()
+			return
+		}
+		client = conn
+	}
+
+	proxy.Logger.
+		Info().
+		Str("client", name).
+		Str("source", client.RemoteAddr().String()).
+		Msg("Accepted client")
+
+	err = proxy.setSocketOptions(client)
+	if err != nil {
 		proxy.Logger.
-			Info().
-			Str("client", client.RemoteAddr().String()).
-			Msg("Accepted client")
+			Warn().
+			Err(err).
+			Str("client", name).
+			Msg("Unable to set socket options of client")
+	}
 
-		upstream, err := net.Dial("tcp", proxy.Upstream)
+	// The header is for the client as accepted, before it is wrapped
+	var header []byte
+	if proxy.SendProxyProtocol != "" {
+		header = proxyHeader(proxy.SendProxyProtocol, client)
+	}
+
+	var upstream net.Conn
+	var destination string
+	switch proxy.Protocol {
+	case ProtocolSOCKS5:
+		upstream, destination, err = proxy.dialSocks5(ctx, client)
+	case ProtocolHTTPProxy:
+		client, upstream, destination, err = proxy.dialHTTPProxy(ctx, client)
+	default:
+		upstream, destination, err = proxy.dialUpstream(ctx, proxy.dialStream)
+	}
+	if err != nil {
+		proxy.Logger.
+			Err(err).
+			Str("client", name).
+			Msg("Unable to open connection to upstream")
+		client.Close()
+		return
+	}
+	err = proxy.setSocketOptions(upstream)
+	if err != nil {
+		proxy.Logger.
+			Warn().
+			Err(err).
+			Str("client", name).
+			Msg("Unable to set socket options of upstream")
+	}
+	if header != nil {
+		_, err = upstream.Write(header)
 		if err != nil {
 			proxy.Logger.
 				Err(err).
-				Str("client", client.RemoteAddr().String()).
-				Msg("Unable to open connection to upstream")
+				Str("client", name).
+				Msg("Unable to send PROXY protocol header to upstream")
 			client.Close()
-			continue
+			upstream.Close()
+			return
 		}
+	}
+	if !stopClosing() {
+		// The proxy stopped during the handshake
+		upstream.Close()
+		return
+	}
+	upstream = proxy.wrapUpstream(client, upstream)
+	proxy.startLinks(name, destination, client, upstream)
+}
 
-		name := client.RemoteAddr().String()
-		proxy.connections.Lock()
-		proxy.connections.list[name+"upstream"] = upstream
-		proxy.connections.list[name+"downstream"] = client
-		proxy.connections.Unlock()
-		proxy.Toxics.StartLink(proxy.apiServer, name+"upstream", client, upstream, stream.Upstream)
-		proxy.Toxics.StartLink(proxy.apiServer, name+"downstream", upstream, client, stream.Downstream)
+// startLinks connects a client to the upstream dialed at destination through
+// the toxics.
+func (proxy *Proxy) startLinks(name, destination string, client, upstream net.Conn) {
+	client = newReplyConn(client)
+	upstream = newReplyConn(upstream)
+	proxy.connections.Lock()
+	proxy.connections.list[name+"upstream"] = upstream
+	proxy.connections.list[name+"downstream"] = client
+	proxy.connections.Unlock()
+	proxy.Toxics.StartLink(
+		proxy.apiServer, name+"upstream", destination, client, upstream, stream.Upstream,
+	)
+	proxy.Toxics.StartLink(
+		proxy.apiServer, name+"downstream", destination, upstream, client, stream.Downstream,
+	)
+}
+
+// wrapUpstream lets protocol-aware proxies rewrite what the upstream sends
+// before it reaches the toxics.
+func (proxy *Proxy) wrapUpstream(client, upstream net.Conn) net.Conn {
+	switch proxy.Protocol {
+	case ProtocolRedisCluster:
+		requests := new(redisRequests)
+		return &rewriteConn{
+			Conn:   upstream,
+			reader: newRedisClusterReader(proxy, client, upstream, requests),
+			writer: &redisRequestWriter{upstream, requests},
+		}
+	case ProtocolKafka:
+		requests := newKafkaRequests()
+		return &rewriteConn{
+			Conn:   upstream,
+			reader: newKafkaReader(proxy, client, upstream, requests),
+			writer: &kafkaRequestWriter{upstream, requests},
+		}
+	case ProtocolMongoDB:
+		return &rewriteConn{Conn: upstream, reader: newMongoReader(proxy, client, upstream)}
+	}
+	return upstream
+}
+
+// rewriteConn is a connection whose reads go through a rewriting reader, and
+// whose writes optionally go through another writer.
+type rewriteConn struct {
+	net.Conn
+	reader io.Reader
+	writer io.Writer
+}
+
+func (c *rewriteConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *rewriteConn) Write(p []byte) (int, error) {
+	if c.writer != nil {
+		return c.writer.Write(p)
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *rewriteConn) SetLinger(sec int) error {
+	if conn, ok := c.Conn.(lingerer); ok {
+		return conn.SetLinger(sec)
 	}
+	return nil
+}
+
+// discoveredProxy returns the proxy forwarding to upstream, creating and
+// starting one like this proxy if there is none. Protocol-aware proxies use it
+// to send clients through toxiproxy when the upstream tells them about other
+// servers.
+func (proxy *Proxy) discoveredProxy(upstream string) (*Proxy, error) {
+	// The proxy can be updated while its connections read replies
+	proxy.Lock()
+	forwards := proxy.hasUpstream(upstream)
+	protocol, listen := proxy.Protocol, proxy.Listen
+	sendProxyProtocol, acceptProxyProtocol := proxy.SendProxyProtocol, proxy.AcceptProxyProtocol
+	proxy.Unlock()
+	if forwards {
+		return proxy, nil
+	}
+
+	collection := proxy.apiServer.Collection
+	for _, other := range collection.Proxies() {
+		if other.forwardsTo(protocol, upstream) {
+			return other, nil
+		}
+	}
+
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	name := proxy.Name + "_" + strings.NewReplacer(":", "_", "[", "", "]", "").Replace(upstream)
+	discovered := NewProxy(proxy.apiServer, name, net.JoinHostPort(host, "0"), upstream)
+	discovered.Protocol = protocol
+	discovered.SendProxyProtocol = sendProxyProtocol
+	discovered.AcceptProxyProtocol = acceptProxyProtocol
+
+	err = collection.Add(discovered, true)
+	if err == ErrProxyAlreadyExists {
+		return collection.Get(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	proxy.Logger.
+		Info().
+		Str("proxy", discovered.Name).
+		Str("upstream", upstream).
+		Msg("Created proxy for discovered upstream")
+	return discovered, nil
+}
+
+// discoveredListeners maps the servers a protocol-aware proxy learns about on
+// a connection to the listeners of the proxies forwarding to them.
+type discoveredListeners struct {
+	proxy *Proxy
+	// Host the client used to reach toxiproxy
+	host string
+	// Listen ports by server address
+	ports map[string]string
+}
+
+func newDiscoveredListeners(proxy *Proxy, client net.Conn) *discoveredListeners {
+	host, _, _ := net.SplitHostPort(client.LocalAddr().String())
+	return &discoveredListeners{
+		proxy: proxy,
+		host:  host,
+		ports: make(map[string]string),
+	}
+}
+
+// lookup returns the host and port clients should use instead of a server's
+// address, or false if the server can't be proxied.
+func (l *discoveredListeners) lookup(host, port string) (string, string, bool) {
+	if host == "" || port == "" || port == "0" || strings.HasPrefix(port, "-") {
+		return "", "", false
+	}
+	addr := net.JoinHostPort(host, port)
+	if listen, ok := l.ports[addr]; ok {
+		return l.host, listen, true
+	}
+
+	discovered, err := l.proxy.discoveredProxy(addr)
+	if err != nil {
+		l.proxy.Logger.
+			Warn().
+			Err(err).
+			Str("server", addr).
+			Msg("Unable to create proxy for discovered server")
+		return "", "", false
+	}
+	_, listen, err := net.SplitHostPort(discovered.Listen)
+	if err != nil {
+		return "", "", false
+	}
+	l.ports[addr] = listen
+	return l.host, listen, true
+}
+
+// forwardsTo reports whether the proxy speaks protocol and has addr as one of
+// its upstreams, taking the proxy's lock.
+func (proxy *Proxy) forwardsTo(protocol, addr string) bool {
+	proxy.Lock()
+	defer proxy.Unlock()
+	return proxy.Protocol == protocol && proxy.hasUpstream(addr)
+}
+
+// hasUpstream reports whether addr is one of the proxy's upstreams, or one of
+// the addresses they last resolved to. Nothing is looked up, as it runs while
+// replies are read. It assumes the proxy's lock is held.
+func (proxy *Proxy) hasUpstream(addr string) bool {
+	for _, upstream := range upstreamAddresses(proxy.currentUpstream()) {
+		if sameAddress(upstream, addr) {
+			return true
+		}
+	}
+	for _, addresses := range proxy.resolvedUpstreams() {
+		for _, address := range addresses {
+			if sameAddress(address, addr) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameAddress reports whether two host:port addresses are the same, comparing
+// IP addresses by value and host names regardless of case.
+func sameAddress(a, b string) bool {
+	if strings.EqualFold(a, b) {
+		return true
+	}
+	addrA, err := netip.ParseAddrPort(a)
+	if err != nil {
+		return false
+	}
+	addrB, err := netip.ParseAddrPort(b)
+	if err != nil {
+		return false
+	}
+	return addrA.Addr().Unmap() == addrB.Addr().Unmap() && addrA.Port() == addrB.Port()
+}
+
+// unixScheme prefixes the Listen and Upstream addresses of unix domain
+// sockets, e.g. unix:///var/run/docker.sock.
+const unixScheme = "unix://"
+
+// splitAddress returns the network and address to listen on or dial for a
+// Listen or Upstream address.
+func splitAddress(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		return "unix", path
+	}
+	return "tcp", addr
 }
 
 func (proxy *Proxy) RemoveConnection(name string) {
@@ -236,8 +761,15 @@ func start(proxy *Proxy) error {
 	}
 
 	proxy.tomb = tomb.Tomb{} // Reset tomb, from previous starts/stops
+	balancer := newUpstreamBalancer(proxy)
+	proxy.upstreams.Store(balancer)
 	go proxy.server()
 	err := <-proxy.started
+	if err == nil {
+		balancer.start()
+	} else {
+		proxy.upstreams.Store(nil)
+	}
 	// Only enable the proxy if it successfully started
 	proxy.Enabled = err == nil
 	return err
@@ -252,6 +784,7 @@ func stop(proxy *Proxy) {
 
 	proxy.tomb.Killf("Shutting down from stop()")
 	proxy.tomb.Wait() // Wait until we stop accepting new connections
+	proxy.upstreams.Swap(nil).close()
 
 	proxy.connections.Lock()
 	defer proxy.connections.Unlock()
@@ -91,18 +91,68 @@ func (collection *ProxyCollection) PopulateJson(
 		if len(input[i].Name) < 1 {
 			return nil, joinError(fmt.Errorf("name at proxy %d", i+1), ErrMissingField)
 		}
-		if len(input[i].Upstream) < 1 {
-			return nil, joinError(fmt.Errorf("upstream at proxy %d", i+1), ErrMissingField)
-		}
 		if input[i].Enabled == nil {
 			input[i].Enabled = &t
 		}
+		if input[i].Protocol == "" {
+			input[i].Protocol = ProtocolTCP
+		}
+		if len(input[i].Upstream) < 1 && !DynamicProtocol(input[i].Protocol) {
+			return nil, joinError(fmt.Errorf("upstream at proxy %d", i+1), ErrMissingField)
+		}
+		if !ValidProtocol(input[i].Protocol) {
+			return nil, joinError(fmt.Errorf("protocol at proxy %d", i+1), ErrInvalidProtocol)
+		}
+		if !ValidProxyProtocol(input[i].SendProxyProtocol) {
+			return nil, joinError(
+				fmt.Errorf("send_proxy_protocol at proxy %d", i+1),
+				ErrInvalidProxyProtocol,
+			)
+		}
+		if input[i].UpstreamStrategy == "" {
+			input[i].UpstreamStrategy = StrategyRoundRobin
+		}
+		if !ValidUpstreamStrategy(input[i].UpstreamStrategy) {
+			return nil, joinError(
+				fmt.Errorf("upstream_strategy at proxy %d", i+1),
+				ErrInvalidUpstreamStrategy,
+			)
+		}
+		if !ValidUpstreamWeights(input[i].Upstream, input[i].UpstreamWeights) {
+			return nil, joinError(
+				fmt.Errorf("upstream_weights at proxy %d", i+1),
+				ErrInvalidUpstreamWeights,
+			)
+		}
+		if !ValidHosts(input[i].Protocol, input[i].AcceptProxyProtocol, input[i].Hosts) {
+			return nil, joinError(fmt.Errorf("hosts at proxy %d", i+1), ErrInvalidHosts)
+		}
+		if !ValidSocketOptions(&input[i].Proxy) {
+			return nil, joinError(
+				fmt.Errorf("socket options at proxy %d", i+1),
+				ErrInvalidSocketOptions,
+			)
+		}
 	}
 
 	proxies := make([]*Proxy, 0, len(input))
 
 	for i := range input {
 		proxy := NewProxy(server, input[i].Name, input[i].Listen, input[i].Upstream)
+		proxy.Protocol = input[i].Protocol
+		proxy.SendProxyProtocol = input[i].SendProxyProtocol
+		proxy.AcceptProxyProtocol = input[i].AcceptProxyProtocol
+		proxy.Hosts = input[i].Hosts
+		proxy.UpstreamStrategy = input[i].UpstreamStrategy
+		proxy.UpstreamWeights = input[i].UpstreamWeights
+		proxy.KeepConnections = input[i].KeepConnections
+		proxy.ResolveInterval = input[i].ResolveInterval
+		proxy.DialTimeout = input[i].DialTimeout
+		proxy.TCPNoDelay = input[i].TCPNoDelay
+		proxy.KeepAlive = input[i].KeepAlive
+		proxy.ReadBuffer = input[i].ReadBuffer
+		proxy.WriteBuffer = input[i].WriteBuffer
+		proxy.SourceAddress = input[i].SourceAddress
 		addedOrReplaced, err := collection.AddOrReplace(proxy, *input[i].Enabled)
 		if err != nil {
 			return proxies, err
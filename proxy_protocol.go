@@ -0,0 +1,227 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versions of the PROXY protocol, as described in
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// ValidProxyProtocol reports whether version can be sent to upstreams. An
+// empty version sends no header.
+func ValidProxyProtocol(version string) bool {
+	return version == "" || version == ProxyProtocolV1 || version == ProxyProtocolV2
+}
+
+// Longest v1 header, including the CRLF.
+const proxyHeaderV1MaxSize = 107
+
+var (
+	proxyHeaderV1Prefix  = []byte("PROXY ")
+	proxyHeaderSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// proxyProtocolConn is a client connection that started with a PROXY header.
+// It reports the client address of the header as its remote address.
+type proxyProtocolConn struct {
+	rewriteConn
+	// Addresses of the header, nil for connections the sender made itself
+	source      net.Addr
+	destination net.Addr
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// acceptProxyHeader reads the PROXY header, of either version, a client
+// starts with.
+func acceptProxyHeader(client net.Conn) (*proxyProtocolConn, error) {
+	err := client.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(client)
+	source, destination, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	err = client.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{
+		rewriteConn: rewriteConn{Conn: client, reader: reader},
+		source:      source,
+		destination: destination,
+	}, nil
+}
+
+// readProxyHeader returns the source and destination addresses of a PROXY
+// header. They are nil if the header carries no addresses.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	start, err := reader.Peek(len(proxyHeaderSignature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(start, proxyHeaderSignature) {
+		return readProxyHeaderV2(reader)
+	}
+	if bytes.HasPrefix(start, proxyHeaderV1Prefix) {
+		return readProxyHeaderV1(reader)
+	}
+	return nil, nil, errInvalidProxyHeader
+}
+
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil || len(line) > proxyHeaderV1MaxSize || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errInvalidProxyHeader
+	}
+	source, err := parseProxyAddress(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := parseProxyAddress(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+func parseProxyAddress(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, errInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	command := header[12]
+	if command>>4 != 2 || command&0xf > 1 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	_, err = io.ReadFull(reader, addresses)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// LOCAL connections were made by the sender itself
+	if command&0xf == 0 {
+		return nil, nil, nil
+	}
+	size := 0
+	switch header[13] >> 4 {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		// Unspecified and unix addresses can't be reported
+		return nil, nil, nil
+	}
+	if len(addresses) < 2*size+4 {
+		return nil, nil, errInvalidProxyHeader
+	}
+	source := &net.TCPAddr{
+		IP:   net.IP(addresses[:size]),
+		Port: int(binary.BigEndian.Uint16(addresses[2*size:])),
+	}
+	destination := &net.TCPAddr{
+		IP:   net.IP(addresses[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(addresses[2*size+2:])),
+	}
+	return source, destination, nil
+}
+
+// proxyHeader returns the PROXY header of the given version for a client,
+// carrying the addresses of the PROXY header the client sent if there was one.
+func proxyHeader(version string, client net.Conn) []byte {
+	source, destination := client.RemoteAddr(), client.LocalAddr()
+	if conn, ok := client.(*proxyProtocolConn); ok && conn.destination != nil {
+		destination = conn.destination
+	}
+
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+	if version == ProxyProtocolV1 {
+		return proxyHeaderV1(src, dst, srcOk && dstOk)
+	}
+	return proxyHeaderV2(src, dst, srcOk && dstOk)
+}
+
+func proxyHeaderV1(source, destination *net.TCPAddr, ok bool) []byte {
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family, srcIP, dstIP := "TCP4", source.IP.String(), destination.IP.String()
+	if source.IP.To4() == nil || destination.IP.To4() == nil {
+		family = "TCP6"
+		srcIP, dstIP = proxyIPv6(source.IP), proxyIPv6(destination.IP)
+	}
+	return []byte(fmt.Sprintf(
+		"PROXY %s %s %s %d %d\r\n",
+		family, srcIP, dstIP, source.Port, destination.Port,
+	))
+}
+
+// proxyIPv6 formats ip as an IPv6 address, mapping IPv4 addresses.
+func proxyIPv6(ip net.IP) string {
+	if ip.To4() != nil {
+		return "::ffff:" + ip.String()
+	}
+	return ip.String()
+}
+
+func proxyHeaderV2(source, destination *net.TCPAddr, ok bool) []byte {
+	header := append([]byte{}, proxyHeaderSignature...)
+	if !ok {
+		// LOCAL command, without addresses
+		return append(header, 0x20, 0x00, 0, 0)
+	}
+
+	family, srcIP, dstIP := byte(0x11), source.IP.To4(), destination.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		family, srcIP, dstIP = 0x21, source.IP.To16(), destination.IP.To16()
+	}
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(source.Port))
+	return binary.BigEndian.AppendUint16(header, uint16(destination.Port))
+}
@@ -0,0 +1,198 @@
+package toxiproxy_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// WithRecordingServer runs a TCP server that sends everything it reads on a
+// connection to received once the connection is closed.
+func WithRecordingServer(t *testing.T, f func(addr string, received <-chan []byte)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		data, _ := io.ReadAll(conn)
+		received <- data
+	}()
+
+	f(ln.Addr().String(), received)
+}
+
+func sendThroughProxy(t *testing.T, addr string, data string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, data)
+	if err != nil {
+		t.Fatal("Failed writing to proxy", err)
+	}
+	// Wait for the data to go through before closing the connection
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	conn.Read(make([]byte, 1))
+}
+
+func awaitReceived(t *testing.T, received <-chan []byte) []byte {
+	select {
+	case data := <-received:
+		return data
+	case <-time.After(2 * time.Second):
+		t.Fatal("Upstream didn't receive a connection")
+		return nil
+	}
+}
+
+func TestProxySendsProxyProtocolV1(t *testing.T) {
+	WithRecordingServer(t, func(upstream string, received <-chan []byte) {
+		proxy := NewTestProxy("test", upstream)
+		proxy.SendProxyProtocol = "v1"
+		proxy.Start()
+		defer proxy.Stop()
+
+		conn, err := net.Dial("tcp", proxy.Listen)
+		if err != nil {
+			t.Fatal("Unable to dial proxy", err)
+		}
+		io.WriteString(conn, "hello")
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+
+		expected := fmt.Sprintf(
+			"PROXY TCP4 127.0.0.1 127.0.0.1 %s %s\r\nhello",
+			listenPort(t, conn.LocalAddr().String()),
+			listenPort(t, proxy.Listen),
+		)
+		if data := awaitReceived(t, received); string(data) != expected {
+			t.Errorf("Expected %q, got %q", expected, data)
+		}
+	})
+}
+
+func TestProxyForwardsAcceptedProxyProtocol(t *testing.T) {
+	WithRecordingServer(t, func(upstream string, received <-chan []byte) {
+		proxy := NewTestProxy("test", upstream)
+		proxy.AcceptProxyProtocol = true
+		proxy.SendProxyProtocol = "v2"
+		proxy.Start()
+		defer proxy.Stop()
+
+		sendThroughProxy(t, proxy.Listen, "PROXY TCP6 2001:db8::1 2001:db8::2 5678 443\r\nhello")
+
+		expected := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24")
+		expected = append(expected, net.ParseIP("2001:db8::1")...)
+		expected = append(expected, net.ParseIP("2001:db8::2")...)
+		expected = binary.BigEndian.AppendUint16(expected, 5678)
+		expected = binary.BigEndian.AppendUint16(expected, 443)
+		expected = append(expected, "hello"...)
+		if data := awaitReceived(t, received); !bytes.Equal(data, expected) {
+			t.Errorf("Expected %q, got %q", expected, data)
+		}
+	})
+}
+
+func TestProxyAcceptsProxyProtocolV2(t *testing.T) {
+	WithRecordingServer(t, func(upstream string, received <-chan []byte) {
+		proxy := NewTestProxy("test", upstream)
+		proxy.AcceptProxyProtocol = true
+		proxy.SendProxyProtocol = "v1"
+		proxy.Start()
+		defer proxy.Stop()
+
+		header := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+		header = append(header, 10, 0, 0, 1, 10, 0, 0, 2)
+		header = binary.BigEndian.AppendUint16(header, 5678)
+		header = binary.BigEndian.AppendUint16(header, 80)
+		sendThroughProxy(t, proxy.Listen, string(header)+"hello")
+
+		expected := "PROXY TCP4 10.0.0.1 10.0.0.2 5678 80\r\nhello"
+		if data := awaitReceived(t, received); string(data) != expected {
+			t.Errorf("Expected %q, got %q", expected, data)
+		}
+	})
+}
+
+func TestProxyAcceptsProxyProtocolWithoutAddresses(t *testing.T) {
+	WithRecordingServer(t, func(upstream string, received <-chan []byte) {
+		proxy := NewTestProxy("test", upstream)
+		proxy.AcceptProxyProtocol = true
+		proxy.Start()
+		defer proxy.Stop()
+
+		// LOCAL command, as sent by load balancer health checks
+		sendThroughProxy(t, proxy.Listen, "\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00hello")
+
+		if data := awaitReceived(t, received); string(data) != "hello" {
+			t.Errorf("Expected %q, got %q", "hello", data)
+		}
+	})
+}
+
+func TestProxyDropsClientsWithoutProxyProtocol(t *testing.T) {
+	WithRecordingServer(t, func(upstream string, received <-chan []byte) {
+		proxy := NewTestProxy("test", upstream)
+		proxy.AcceptProxyProtocol = true
+		proxy.Start()
+		defer proxy.Stop()
+
+		conn, err := net.Dial("tcp", proxy.Listen)
+		if err != nil {
+			t.Fatal("Unable to dial proxy", err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Error("Expected the proxy to close the connection, got", err)
+		}
+		select {
+		case <-received:
+			t.Error("Expected no connection to the upstream")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestProxyReadsProxyProtocolOfClientsConcurrently(t *testing.T) {
+	WithRecordingServer(t, func(upstream string, received <-chan []byte) {
+		proxy := NewTestProxy("test", upstream)
+		proxy.AcceptProxyProtocol = true
+		proxy.Start()
+		defer proxy.Stop()
+
+		idle, err := net.Dial("tcp", proxy.Listen)
+		if err != nil {
+			t.Fatal("Unable to dial proxy", err)
+		}
+		defer idle.Close()
+
+		sendThroughProxy(t, proxy.Listen, "PROXY TCP4 10.0.0.1 10.0.0.2 5678 80\r\nhello")
+		if data := awaitReceived(t, received); string(data) != "hello" {
+			t.Errorf("Expected %q, got %q", "hello", data)
+		}
+
+		proxy.Stop()
+		idle.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := idle.Read(make([]byte, 1)); err != io.EOF {
+			t.Error("Expected stopping the proxy to close the idle client, got", err)
+		}
+	})
+}
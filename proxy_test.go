@@ -290,3 +290,55 @@ func TestProxyDiffers(t *testing.T) {
 		}
 	})
 }
+
+func TestProxyUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	ln, err := net.Listen("unix", dir+"/upstream.sock")
+	if err != nil {
+		t.Fatal("Failed to create unix socket server", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+
+	proxy := NewTestProxy("test", "unix://"+dir+"/upstream.sock")
+	proxy.Listen = "unix://" + dir + "/proxy.sock"
+	if err := proxy.Start(); err != nil {
+		t.Fatal("Failed to start proxy", err)
+	}
+	defer proxy.Stop()
+
+	if proxy.Listen != "unix://"+dir+"/proxy.sock" {
+		t.Errorf("Unexpected listen address %s", proxy.Listen)
+	}
+	differs, err := proxy.Differs(&toxiproxy.Proxy{Listen: proxy.Listen, Upstream: proxy.Upstream})
+	if err != nil || differs {
+		t.Error("Proxy should not differ", err)
+	}
+
+	// Clients of unix sockets share the same empty address
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", dir+"/proxy.sock")
+		if err != nil {
+			t.Fatal("Unable to dial proxy", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		conn.Write([]byte("hello"))
+		reply := make([]byte, 5)
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "hello" {
+			t.Errorf("Expected echo through the proxy, got %q %v", reply, err)
+		}
+	}
+}
@@ -0,0 +1,607 @@
+package toxiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const (
+	redisMaxDepth = 32
+	redisMaxLine  = 64 * 1024
+)
+
+var (
+	errRedisInvalid = errors.New("invalid RESP data")
+
+	redisNodeID   = regexp.MustCompile(`^[0-9a-f]{40}$`)
+	redisNodeLine = regexp.MustCompile(`(?m)^([0-9a-f]{40} )([^ @,\n]+)(@[0-9]+)?(,[^ \n]*)?`)
+)
+
+// redisValue is a parsed RESP2 or RESP3 value.
+type redisValue struct {
+	kind      byte
+	text      []byte
+	items     []*redisValue
+	null      bool
+	attribute *redisValue
+}
+
+func (v *redisValue) isString() bool {
+	switch v.kind {
+	case '+', '$', '=':
+		return !v.null
+	}
+	return false
+}
+
+func (v *redisValue) isAggregate() bool {
+	switch v.kind {
+	case '*', '%', '~', '>', '|':
+		return true
+	}
+	return false
+}
+
+func (v *redisValue) encode(buf *bytes.Buffer) {
+	if v.attribute != nil {
+		v.attribute.encode(buf)
+	}
+	buf.WriteByte(v.kind)
+	switch {
+	case v.null:
+		buf.WriteString("-1\r\n")
+	case v.kind == '$' || v.kind == '!' || v.kind == '=':
+		buf.WriteString(strconv.Itoa(len(v.text)))
+		buf.WriteString("\r\n")
+		buf.Write(v.text)
+		buf.WriteString("\r\n")
+	case v.isAggregate():
+		count := len(v.items)
+		if v.kind == '%' || v.kind == '|' {
+			count /= 2
+		}
+		buf.WriteString(strconv.Itoa(count))
+		buf.WriteString("\r\n")
+		for _, item := range v.items {
+			item.encode(buf)
+		}
+	default:
+		buf.Write(v.text)
+		buf.WriteString("\r\n")
+	}
+}
+
+// redisParser reads RESP values, keeping the raw bytes of the value being
+// parsed so they can be passed on untouched if it turns out to be invalid.
+type redisParser struct {
+	reader *bufio.Reader
+	raw    bytes.Buffer
+}
+
+func (p *redisParser) line() ([]byte, error) {
+	line, err := p.reader.ReadBytes('\n')
+	p.raw.Write(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisInvalid
+	}
+	return line[:len(line)-2], nil
+}
+
+func (p *redisParser) read(depth int) (*redisValue, error) {
+	if depth > redisMaxDepth {
+		return nil, errRedisInvalid
+	}
+	line, err := p.line()
+	if err != nil {
+		return nil, err
+	}
+	value := &redisValue{kind: line[0], text: line[1:]}
+
+	switch value.kind {
+	case '+', '-', ':', ',', '#', '_', '(':
+		return value, nil
+	case '$', '!', '=':
+		length, err := strconv.Atoi(string(value.text))
+		if err != nil || length < -1 || length > stream.MaxMessageSize {
+			return nil, errRedisInvalid
+		}
+		if length == -1 {
+			value.null = true
+			return value, nil
+		}
+		data := make([]byte, length+2)
+		n, err := io.ReadFull(p.reader, data)
+		p.raw.Write(data[:n])
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(data, []byte("\r\n")) {
+			return nil, errRedisInvalid
+		}
+		value.text = data[:length]
+		return value, nil
+	case '*', '%', '~', '>', '|':
+		count, err := strconv.Atoi(string(value.text))
+		if err != nil || count < -1 {
+			return nil, errRedisInvalid
+		}
+		if count == -1 {
+			value.null = true
+			return value, nil
+		}
+		if value.kind == '%' || value.kind == '|' {
+			count *= 2
+		}
+		value.items = make([]*redisValue, 0, min(count, 1024))
+		for i := 0; i < count; i++ {
+			item, err := p.read(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			value.items = append(value.items, item)
+		}
+		if value.kind == '|' {
+			// Attributes precede the value they describe
+			next, err := p.read(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			next.attribute = value
+			return next, nil
+		}
+		return value, nil
+	}
+	return nil, errRedisInvalid
+}
+
+// redisRequests tracks the commands sent to a Redis node, so the replies to
+// the ones reporting node addresses can be told apart. Replies come in the
+// order of the commands, except in subscribed mode where messages come
+// unasked.
+type redisRequests struct {
+	sync.Mutex
+	// Whether the reply to each command waiting for one reports addresses
+	pending    []bool
+	subscribed bool
+
+	// Parsing state of the command stream
+	line    []byte
+	args    int
+	skip    int
+	keep    bool
+	bulk    []byte
+	command [][]byte
+	broken  bool
+}
+
+// observe parses the commands sent to the node.
+func (r *redisRequests) observe(p []byte) {
+	r.Lock()
+	defer r.Unlock()
+
+	for len(p) > 0 && !r.broken {
+		if r.skip > 0 {
+			n := min(r.skip, len(p))
+			if r.keep {
+				r.bulk = append(r.bulk, p[:n]...)
+			}
+			r.skip -= n
+			p = p[n:]
+			if r.skip == 0 {
+				r.argument(bytes.TrimSuffix(r.bulk, []byte("\r\n")))
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			r.line = append(r.line, p...)
+			r.broken = len(r.line) > redisMaxLine
+			return
+		}
+		line := bytes.TrimSuffix(append(r.line, p[:i]...), []byte("\r"))
+		r.line = r.line[:0]
+		p = p[i+1:]
+
+		var err error
+		switch {
+		case r.args > 0:
+			length := -1
+			if len(line) > 0 && line[0] == '$' {
+				length, err = strconv.Atoi(string(line[1:]))
+			}
+			if err != nil || length < 0 {
+				r.broken = true
+				return
+			}
+			r.skip = length + 2
+			// Only the command and subcommand names are needed
+			r.keep = len(r.command) < 2 && length <= redisMaxLine
+			r.bulk = r.bulk[:0]
+		case len(line) > 0 && line[0] == '*':
+			count, err := strconv.Atoi(string(line[1:]))
+			if err != nil {
+				r.broken = true
+				return
+			}
+			r.args = max(count, 0)
+		default:
+			// Inline command, empty ones aren't answered
+			fields := bytes.Fields(line)
+			if len(fields) > 0 {
+				r.command = append(r.command[:0], fields[:min(len(fields), 2)]...)
+				r.sent()
+			}
+		}
+	}
+}
+
+func (r *redisRequests) argument(arg []byte) {
+	if len(r.command) < 2 {
+		r.command = append(r.command, bytes.Clone(arg))
+	}
+	r.args--
+	if r.args == 0 {
+		r.sent()
+	}
+}
+
+// sent records the command that was just parsed.
+func (r *redisRequests) sent() {
+	name := strings.ToUpper(string(r.command[0]))
+	var subcommand string
+	if len(r.command) > 1 {
+		subcommand = strings.ToUpper(string(r.command[1]))
+	}
+	switch name {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE":
+		r.subscribed = true
+	}
+	addresses := name == "SENTINEL" || name == "CLUSTER" && (subcommand == "SLOTS" ||
+		subcommand == "SHARDS" || subcommand == "NODES" || subcommand == "REPLICAS" ||
+		subcommand == "SLAVES")
+	r.pending = append(r.pending, addresses)
+	r.command = r.command[:0]
+}
+
+// answered returns whether the reply to the oldest command waiting for one
+// reports addresses, and whether messages may come unasked.
+func (r *redisRequests) answered() (addresses, subscribed bool) {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.pending) > 0 {
+		addresses = r.pending[0]
+		r.pending = r.pending[1:]
+	}
+	return addresses, r.subscribed
+}
+
+// unsubscribed leaves subscribed mode, once the client has no subscriptions
+// left.
+func (r *redisRequests) unsubscribed() {
+	r.Lock()
+	defer r.Unlock()
+	r.subscribed = false
+}
+
+func (r *redisRequests) isSubscribed() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.subscribed
+}
+
+// redisRequestWriter observes commands on their way to the node.
+type redisRequestWriter struct {
+	conn     net.Conn
+	requests *redisRequests
+}
+
+func (w *redisRequestWriter) Write(p []byte) (int, error) {
+	w.requests.observe(p)
+	return w.conn.Write(p)
+}
+
+// redisClusterReader reads replies from a Redis Cluster or Sentinel upstream
+// and rewrites the node addresses in them to toxiproxy listeners, creating
+// proxies for nodes as they are discovered. This covers MOVED and ASK
+// redirections, the replies to CLUSTER SLOTS, SHARDS, NODES and REPLICAS and
+// to SENTINEL commands, and the +switch-master messages Sentinel publishes.
+// Other replies are passed on as they are read.
+type redisClusterReader struct {
+	proxy       *Proxy
+	parser      redisParser
+	requests    *redisRequests
+	pending     []byte
+	passthrough bool
+	listeners   *discoveredListeners
+	// Host of the upstream, which Redis leaves out of addresses on the same host
+	upstreamHost string
+
+	// Values left in the reply being passed on, bytes left in the bulk string
+	// being passed on, and whether the line being passed on was too long to
+	// be read at once
+	values int
+	skip   int
+	inLine bool
+}
+
+func newRedisClusterReader(
+	proxy *Proxy,
+	client, upstream net.Conn,
+	requests *redisRequests,
+) *redisClusterReader {
+	upstreamHost, _, _ := net.SplitHostPort(upstream.RemoteAddr().String())
+	return &redisClusterReader{
+		proxy:        proxy,
+		parser:       redisParser{reader: bufio.NewReader(upstream)},
+		requests:     requests,
+		listeners:    newDiscoveredListeners(proxy, client),
+		upstreamHost: upstreamHost,
+	}
+}
+
+func (r *redisClusterReader) Read(p []byte) (int, error) {
+	if len(r.pending) > 0 {
+		return r.flush(p)
+	}
+	reader := r.parser.reader
+	if r.passthrough {
+		return reader.Read(p)
+	}
+	if r.skip > 0 {
+		n, err := reader.Read(p[:min(len(p), r.skip)])
+		r.skip -= n
+		return n, err
+	}
+
+	if r.values == 0 {
+		rewrite, err := r.startReply()
+		if err != nil {
+			return 0, err
+		}
+		if rewrite {
+			return r.readRewritten(p)
+		}
+		r.values = 1
+	}
+
+	// Pass on the next line of the reply, and the bulk string it starts
+	line, err := reader.ReadSlice('\n')
+	r.pending = append(r.pending[:0], line...)
+	if err == bufio.ErrBufferFull {
+		// Only simple strings and errors have lines that long
+		r.inLine = true
+		return r.flush(p)
+	}
+	if err != nil {
+		r.passthrough = true
+		if len(r.pending) == 0 {
+			return 0, err
+		}
+		return r.flush(p)
+	}
+	r.values--
+	if r.inLine {
+		r.inLine = false
+		return r.flush(p)
+	}
+	count, _ := strconv.Atoi(string(bytes.TrimRight(line[1:], "\r\n")))
+	switch line[0] {
+	case '$', '!', '=':
+		if count >= 0 {
+			r.skip = count + 2
+		}
+	case '*', '~', '>':
+		r.values += max(count, 0)
+	case '%':
+		r.values += 2 * max(count, 0)
+	case '|':
+		// Attributes precede the value they describe
+		r.values += 2*max(count, 0) + 1
+	}
+	return r.flush(p)
+}
+
+// startReply reads the type of the next reply, and returns whether it has to
+// be parsed to be rewritten.
+func (r *redisClusterReader) startReply() (bool, error) {
+	first, err := r.parser.reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	switch first[0] {
+	case '-', '!':
+		r.requests.answered()
+		return true, nil
+	case '>':
+		// Pushes answer no command, but carry Sentinel's messages
+		return r.requests.isSubscribed(), nil
+	}
+	addresses, subscribed := r.requests.answered()
+	return addresses || subscribed && first[0] == '*', nil
+}
+
+// readRewritten parses the next reply and rewrites the addresses in it.
+func (r *redisClusterReader) readRewritten(p []byte) (int, error) {
+	r.parser.raw.Reset()
+	value, err := r.parser.read(0)
+	if err != nil {
+		// Pass on whatever was read and stop parsing
+		if r.parser.raw.Len() == 0 {
+			return 0, err
+		}
+		r.passthrough = true
+		r.pending = bytes.Clone(r.parser.raw.Bytes())
+		if err != errRedisInvalid {
+			r.proxy.Logger.Debug().Err(err).Msg("Unable to read Redis reply")
+		}
+		return r.flush(p)
+	}
+	if redisUnsubscribed(value) {
+		r.requests.unsubscribed()
+	}
+	r.rewrite(value)
+	var buf bytes.Buffer
+	value.encode(&buf)
+	r.pending = buf.Bytes()
+	return r.flush(p)
+}
+
+// redisUnsubscribed returns whether a reply confirms an unsubscription that
+// left no subscriptions: [unsubscribe, channel, 0].
+func redisUnsubscribed(value *redisValue) bool {
+	items := value.items
+	if !value.isAggregate() || len(items) != 3 || !items[0].isString() || items[2].kind != ':' {
+		return false
+	}
+	switch strings.ToLower(string(items[0].text)) {
+	case "unsubscribe", "punsubscribe", "sunsubscribe":
+		return string(items[2].text) == "0"
+	}
+	return false
+}
+
+func (r *redisClusterReader) flush(p []byte) (int, error) {
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// listener returns the host and port clients should use instead of a node's
+// address, or false if the node can't be proxied.
+func (r *redisClusterReader) listener(host, port string) (string, string, bool) {
+	if host == "" {
+		host = r.upstreamHost
+	}
+	if host == "?" {
+		return "", "", false
+	}
+	return r.listeners.lookup(host, port)
+}
+
+func (r *redisClusterReader) rewriteAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host, port, ok := r.listener(host, port); ok {
+		return net.JoinHostPort(host, port)
+	}
+	return addr
+}
+
+func (r *redisClusterReader) rewrite(value *redisValue) {
+	switch {
+	case value.kind == '-' || value.kind == '!':
+		// -MOVED 3999 127.0.0.1:6381
+		fields := strings.Split(string(value.text), " ")
+		if len(fields) == 3 && (fields[0] == "MOVED" || fields[0] == "ASK") {
+			fields[2] = r.rewriteAddr(fields[2])
+			value.text = []byte(strings.Join(fields, " "))
+		}
+	case value.isString():
+		// CLUSTER NODES and CLUSTER REPLICAS
+		if redisNodeLine.Match(value.text) {
+			value.text = redisNodeLine.ReplaceAllFunc(value.text, func(line []byte) []byte {
+				parts := redisNodeLine.FindSubmatch(line)
+				rewritten := append([]byte{}, parts[1]...)
+				rewritten = append(rewritten, r.rewriteAddr(string(parts[2]))...)
+				rewritten = append(rewritten, parts[3]...)
+				return append(rewritten, parts[4]...)
+			})
+		}
+	case value.isAggregate() && !value.null:
+		r.rewriteNode(value)
+		for _, item := range value.items {
+			r.rewrite(item)
+		}
+	}
+}
+
+// rewriteNode rewrites aggregates that describe a single node.
+func (r *redisClusterReader) rewriteNode(value *redisValue) {
+	items := value.items
+
+	// CLUSTER SLOTS: [ip, port, id, ...]
+	if len(items) >= 2 && items[0].isString() && items[1].kind == ':' &&
+		(len(items) == 2 && net.ParseIP(string(items[0].text)) != nil ||
+			len(items) >= 3 && items[2].isString() && redisNodeID.Match(items[2].text)) {
+		if host, port, ok := r.listener(string(items[0].text), string(items[1].text)); ok {
+			items[0].text = []byte(host)
+			items[1].text = []byte(port)
+		}
+		return
+	}
+
+	// SENTINEL GET-MASTER-ADDR-BY-NAME: [ip, port]
+	if len(items) == 2 && items[0].isString() && items[1].isString() &&
+		net.ParseIP(string(items[0].text)) != nil {
+		if _, err := strconv.Atoi(string(items[1].text)); err == nil {
+			if host, port, ok := r.listener(string(items[0].text), string(items[1].text)); ok {
+				items[0].text = []byte(host)
+				items[1].text = []byte(port)
+			}
+		}
+		return
+	}
+
+	// Pub/sub message: [message, +switch-master, "name old-ip old-port new-ip new-port"]
+	if len(items) == 3 && items[1].isString() && string(items[1].text) == "+switch-master" &&
+		items[2].isString() {
+		fields := strings.Split(string(items[2].text), " ")
+		if len(fields) == 5 {
+			for i := 1; i < 5; i += 2 {
+				if host, port, ok := r.listener(fields[i], fields[i+1]); ok {
+					fields[i], fields[i+1] = host, port
+				}
+			}
+			items[2].text = []byte(strings.Join(fields, " "))
+		}
+		return
+	}
+
+	// CLUSTER SHARDS and SENTINEL MASTERS/REPLICAS: {ip: ..., port: ..., ...}
+	if len(items)%2 != 0 {
+		return
+	}
+	var host, port *redisValue
+	var names []*redisValue
+	for i := 0; i < len(items); i += 2 {
+		key, field := items[i], items[i+1]
+		if !key.isString() || !(field.isString() || field.kind == ':') {
+			continue
+		}
+		switch string(key.text) {
+		case "ip", "endpoint":
+			host = field
+			names = append(names, field)
+		case "hostname":
+			if len(field.text) > 0 {
+				names = append(names, field)
+			}
+		case "port":
+			port = field
+		}
+	}
+	if host == nil || port == nil {
+		return
+	}
+	if listenHost, listenPort, ok := r.listener(string(host.text), string(port.text)); ok {
+		for _, name := range names {
+			name.text = []byte(listenHost)
+		}
+		port.text = []byte(listenPort)
+	}
+}
@@ -0,0 +1,254 @@
+package toxiproxy_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/Shopify/toxiproxy/v2"
+)
+
+// WithRedisNode runs a fake Redis node that answers every inline command it
+// reads with the reply returned for it.
+func WithRedisNode(t *testing.T, reply func(addr, command string) string, f func(addr string)) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				scan := bufio.NewScanner(conn)
+				for scan.Scan() {
+					io.WriteString(conn, reply(ln.Addr().String(), scan.Text()))
+				}
+			}(conn)
+		}
+	}()
+
+	f(ln.Addr().String())
+}
+
+func NewRedisClusterProxy(upstream string) (*toxiproxy.ApiServer, *toxiproxy.Proxy) {
+	srv := toxiproxy.NewServer(
+		toxiproxy.NewMetricsContainer(prometheus.NewRegistry()),
+		zerolog.Nop(),
+	)
+	proxy := toxiproxy.NewProxy(srv, "redis", "localhost:0", upstream)
+	proxy.Protocol = toxiproxy.ProtocolRedisCluster
+	return srv, proxy
+}
+
+func redisRoundTrip(t *testing.T, addr, command string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, command+"\r\n")
+	if err != nil {
+		t.Fatal("Failed writing to proxy", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	var reply []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		reply = append(reply, buf[:n]...)
+		if err != nil {
+			return string(reply)
+		}
+	}
+}
+
+func listenPort(t *testing.T, addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal("Failed to split host and port", err)
+	}
+	return port
+}
+
+func TestRedisClusterRewritesMoved(t *testing.T) {
+	WithRedisNode(t, func(string, string) string { return "+OK\r\n" }, func(node string) {
+		WithRedisNode(t, func(string, string) string {
+			return "-MOVED 3999 " + node + "\r\n"
+		}, func(upstream string) {
+			srv, proxy := NewRedisClusterProxy(upstream)
+			proxy.Start()
+			defer proxy.Stop()
+
+			reply := redisRoundTrip(t, proxy.Listen, "GET foo")
+
+			discovered, err := srv.Collection.Get("redis_" + strings.ReplaceAll(node, ":", "_"))
+			if err != nil {
+				t.Fatal("Expected a proxy to be created for the node", err)
+			}
+			defer discovered.Stop()
+
+			if discovered.Upstream != node || discovered.Protocol != toxiproxy.ProtocolRedisCluster {
+				t.Errorf("Unexpected discovered proxy: %s %s", discovered.Upstream, discovered.Protocol)
+			}
+			expected := "-MOVED 3999 127.0.0.1:" + listenPort(t, discovered.Listen) + "\r\n"
+			if reply != expected {
+				t.Errorf("Expected %q, got %q", expected, reply)
+			}
+
+			if reply := redisRoundTrip(t, discovered.Listen, "GET foo"); reply != "+OK\r\n" {
+				t.Errorf("Expected discovered proxy to reach the node, got %q", reply)
+			}
+		})
+	})
+}
+
+func TestRedisClusterRewritesClusterSlots(t *testing.T) {
+	WithRedisNode(t, func(upstream, _ string) string {
+		host, port, _ := net.SplitHostPort(upstream)
+		id := strings.Repeat("a", 40)
+		return fmt.Sprintf(
+			"*1\r\n*3\r\n:0\r\n:16383\r\n*3\r\n$%d\r\n%s\r\n:%s\r\n$40\r\n%s\r\n",
+			len(host), host, port, id,
+		)
+	}, func(upstream string) {
+		srv, proxy := NewRedisClusterProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		reply := redisRoundTrip(t, proxy.Listen, "CLUSTER SLOTS")
+
+		// The node is the proxy's own upstream, so no proxy is created.
+		if len(srv.Collection.Proxies()) != 0 {
+			t.Error("Expected no proxies to be created")
+		}
+		port := listenPort(t, proxy.Listen)
+		expected := fmt.Sprintf(
+			"*1\r\n*3\r\n:0\r\n:16383\r\n*3\r\n$9\r\n127.0.0.1\r\n:%s\r\n$40\r\n%s\r\n",
+			port, strings.Repeat("a", 40),
+		)
+		if reply != expected {
+			t.Errorf("Expected %q, got %q", expected, reply)
+		}
+	})
+}
+
+func TestRedisClusterPassesThroughOtherReplies(t *testing.T) {
+	value := "*2\r\n$7\r\n1.2.3.4\r\n$5\r\nhello\r\n"
+	WithRedisNode(t, func(string, string) string { return value }, func(upstream string) {
+		_, proxy := NewRedisClusterProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		if reply := redisRoundTrip(t, proxy.Listen, "MGET a b"); reply != value {
+			t.Errorf("Expected %q, got %q", value, reply)
+		}
+	})
+}
+
+func TestRedisClusterRewritesOnlyAddressReplies(t *testing.T) {
+	// A node as CLUSTER SLOTS reports it: [ip, port, id]
+	node := func(addr string) string {
+		host, port, _ := net.SplitHostPort(addr)
+		return fmt.Sprintf(
+			"*3\r\n$%d\r\n%s\r\n:%s\r\n$40\r\n%s\r\n",
+			len(host), host, port, strings.Repeat("a", 40),
+		)
+	}
+	WithRedisNode(t, func(upstream, command string) string {
+		if command == "CLUSTER SLOTS" {
+			return "*1\r\n*3\r\n:0\r\n:16383\r\n" + node(upstream)
+		}
+		return node(upstream)
+	}, func(upstream string) {
+		_, proxy := NewRedisClusterProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		reply := redisRoundTrip(t, proxy.Listen, "LRANGE nodes 0 -1\r\nCLUSTER SLOTS")
+
+		listen := "127.0.0.1:" + listenPort(t, proxy.Listen)
+		expected := node(upstream) + "*1\r\n*3\r\n:0\r\n:16383\r\n" + node(listen)
+		if reply != expected {
+			t.Errorf("Expected only the CLUSTER SLOTS reply to be rewritten, got %q", reply)
+		}
+	})
+}
+
+func TestRedisClusterKeepsNodeHostnames(t *testing.T) {
+	nodes := func(addr string) string {
+		line := strings.Repeat("a", 40) + " " + addr +
+			"@16379,node-1 myself,master - 0 0 1 connected 0-16383\n"
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(line), line)
+	}
+	answer := func(upstream, _ string) string { return nodes(upstream) }
+	WithRedisNode(t, answer, func(upstream string) {
+		_, proxy := NewRedisClusterProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		reply := redisRoundTrip(t, proxy.Listen, "CLUSTER NODES")
+
+		expected := nodes("127.0.0.1:" + listenPort(t, proxy.Listen))
+		if reply != expected {
+			t.Errorf("Expected %q, got %q", expected, reply)
+		}
+	})
+}
+
+func TestRedisClusterLeavesSubscribedMode(t *testing.T) {
+	node := func(addr string) string {
+		host, port, _ := net.SplitHostPort(addr)
+		return fmt.Sprintf(
+			"*3\r\n$%d\r\n%s\r\n:%s\r\n$40\r\n%s\r\n",
+			len(host), host, port, strings.Repeat("a", 40),
+		)
+	}
+	WithRedisNode(t, func(upstream, command string) string {
+		switch command {
+		case "SUBSCRIBE news":
+			return "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n"
+		case "UNSUBSCRIBE news":
+			return "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:0\r\n"
+		}
+		return node(upstream)
+	}, func(upstream string) {
+		_, proxy := NewRedisClusterProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		commands := "SUBSCRIBE news\r\nUNSUBSCRIBE news\r\nLRANGE nodes 0 -1"
+		reply := redisRoundTrip(t, proxy.Listen, commands)
+
+		if !strings.HasSuffix(reply, ":0\r\n"+node(upstream)) {
+			t.Errorf("Expected replies after unsubscribing not to be rewritten, got %q", reply)
+		}
+	})
+}
+
+func TestRedisClusterPassesThroughInvalidLengths(t *testing.T) {
+	value := "*2\r\n$-2\r\n$5\r\nhello\r\n"
+	WithRedisNode(t, func(string, string) string { return value }, func(upstream string) {
+		_, proxy := NewRedisClusterProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		if reply := redisRoundTrip(t, proxy.Listen, "CLUSTER NODES"); reply != value {
+			t.Errorf("Expected %q, got %q", value, reply)
+		}
+	})
+}
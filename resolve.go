@@ -0,0 +1,155 @@
+package toxiproxy
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Shortest time an address is given to connect when the dial timeout is
+// split between the addresses of an upstream, as in net.Dialer.
+const minAddressTimeout = 2 * time.Second
+
+// dial connects to the addresses an upstream resolves to, in turn, within the
+// dial timeout. Like net.Dialer, each address gets its share of the time left,
+// so that one that doesn't answer leaves time for the others.
+func (b *upstreamBalancer) dial(
+	ctx context.Context,
+	upstream string,
+	dial dialFunc,
+) (net.Conn, error) {
+	if b.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.dialTimeout)
+		defer cancel()
+	}
+
+	addresses, err := b.lookup(ctx, upstream)
+	if err != nil {
+		return nil, err
+	}
+	for i, address := range addresses {
+		addressCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			partial := addressDeadline(time.Now(), deadline, len(addresses)-i)
+			addressCtx, cancel = context.WithDeadline(ctx, partial)
+		}
+		var conn net.Conn
+		conn, err = dial(addressCtx, address)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// addressDeadline returns the deadline to dial the next of the remaining
+// addresses by, splitting the time left before deadline between them.
+func addressDeadline(now, deadline time.Time, remaining int) time.Time {
+	left := deadline.Sub(now)
+	timeout := left / time.Duration(remaining)
+	if timeout < minAddressTimeout {
+		timeout = min(left, minAddressTimeout)
+	}
+	return now.Add(timeout)
+}
+
+// lookup returns the addresses to dial for an upstream. They are resolved
+// again on every dial, unless the upstreams are resolved periodically.
+func (b *upstreamBalancer) lookup(ctx context.Context, upstream string) ([]string, error) {
+	if b.resolveInterval > 0 {
+		b.lock.Lock()
+		addresses, ok := b.resolved[upstream]
+		b.lock.Unlock()
+		if ok {
+			return addresses, nil
+		}
+	}
+	return b.resolve(ctx, upstream)
+}
+
+// resolve looks up the host name of an upstream. Upstreams with an IP address
+// or a unix domain socket are dialed as they are.
+func (b *upstreamBalancer) resolve(ctx context.Context, upstream string) ([]string, error) {
+	network, _ := splitAddress(upstream)
+	host, port, err := net.SplitHostPort(upstream)
+	if network != "tcp" || err != nil || net.ParseIP(host) != nil {
+		return []string{upstream}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, len(ips))
+	for i, ip := range ips {
+		addresses[i] = net.JoinHostPort(ip, port)
+	}
+
+	b.lock.Lock()
+	b.resolved[upstream] = addresses
+	b.lock.Unlock()
+	return addresses, nil
+}
+
+// start resolves the upstreams periodically if there is a resolve interval,
+// until the balancer is closed.
+func (b *upstreamBalancer) start() {
+	if b.resolveInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(b.resolveInterval)
+		defer ticker.Stop()
+		for {
+			for _, upstream := range b.addresses {
+				ctx, cancel := context.WithTimeout(context.Background(), b.resolveInterval)
+				_, err := b.resolve(ctx, upstream)
+				cancel()
+				if err != nil {
+					// Keep dialing the addresses the upstream resolved to before
+					b.logger.
+						Warn().
+						Err(err).
+						Str("address", upstream).
+						Msg("Unable to resolve upstream")
+				}
+			}
+
+			select {
+			case <-b.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (b *upstreamBalancer) close() {
+	close(b.done)
+}
+
+// resolvedUpstreams returns the addresses the host names of the upstreams of
+// a running proxy last resolved to.
+func (proxy *Proxy) resolvedUpstreams() map[string][]string {
+	balancer := proxy.upstreams.Load()
+	if balancer == nil {
+		return nil
+	}
+
+	balancer.lock.Lock()
+	defer balancer.lock.Unlock()
+	if len(balancer.resolved) == 0 {
+		return nil
+	}
+	resolved := make(map[string][]string, len(balancer.resolved))
+	for upstream, addresses := range balancer.resolved {
+		resolved[upstream] = addresses
+	}
+	return resolved
+}
@@ -0,0 +1,29 @@
+package toxiproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddressDeadlineSplitsTimeLeft(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		left      time.Duration
+		remaining int
+		expected  time.Duration
+	}{
+		{30 * time.Second, 3, 10 * time.Second},
+		{30 * time.Second, 1, 30 * time.Second},
+		// Addresses get at least 2 seconds, or whatever is left
+		{5 * time.Second, 4, 2 * time.Second},
+		{time.Second, 4, time.Second},
+	} {
+		deadline := addressDeadline(now, now.Add(tc.left), tc.remaining)
+		if got := deadline.Sub(now); got != tc.expected {
+			t.Errorf(
+				"Expected %v of %v for %d addresses, got %v",
+				tc.expected, tc.left, tc.remaining, got,
+			)
+		}
+	}
+}
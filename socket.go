@@ -0,0 +1,146 @@
+package toxiproxy
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ValidSocketOptions reports whether the socket options of a proxy can be
+// set: buffer sizes can't be negative, and the source address is an IP
+// address, with an optional port.
+func ValidSocketOptions(proxy *Proxy) bool {
+	if proxy.ReadBuffer < 0 || proxy.WriteBuffer < 0 {
+		return false
+	}
+	_, _, err := parseSourceAddress(proxy.SourceAddress)
+	return err == nil
+}
+
+// parseSourceAddress returns the IP and port of a source address, which are
+// nil and 0 if there is none.
+func parseSourceAddress(addr string) (net.IP, int, error) {
+	if addr == "" {
+		return nil, 0, nil
+	}
+	host, port := addr, "0"
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		host, port = h, p
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, &net.AddrError{Err: "invalid source address", Addr: addr}
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, 0, &net.AddrError{Err: "invalid source port", Addr: addr}
+	}
+	return ip, int(p), nil
+}
+
+// socketOptionsDiffer reports whether other sets other socket options.
+func (proxy *Proxy) socketOptionsDiffer(other *Proxy) bool {
+	noDelay := func(p *Proxy) int {
+		if p.TCPNoDelay == nil {
+			return -1
+		}
+		if *p.TCPNoDelay {
+			return 1
+		}
+		return 0
+	}
+	return noDelay(proxy) != noDelay(other) ||
+		proxy.KeepAlive != other.KeepAlive ||
+		proxy.ReadBuffer != other.ReadBuffer ||
+		proxy.WriteBuffer != other.WriteBuffer ||
+		proxy.SourceAddress != other.SourceAddress
+}
+
+// listenConfig returns the config of the proxy's listeners, whose clients
+// inherit the buffer sizes of the listening socket.
+func (proxy *Proxy) listenConfig() *net.ListenConfig {
+	return &net.ListenConfig{Control: proxy.setBufferSizes}
+}
+
+// dialer returns the dialer for upstreams on network, from the source address
+// of the proxy.
+func (proxy *Proxy) dialer(network string) *net.Dialer {
+	dialer := &net.Dialer{Control: proxy.setBufferSizes}
+	ip, port, err := parseSourceAddress(proxy.SourceAddress)
+	if err != nil || ip == nil {
+		return dialer
+	}
+	switch network {
+	case "tcp":
+		dialer.LocalAddr = &net.TCPAddr{IP: ip, Port: port}
+	case "udp":
+		dialer.LocalAddr = &net.UDPAddr{IP: ip, Port: port}
+	}
+	return dialer
+}
+
+// setBufferSizes sizes the buffers of a socket before it listens or connects,
+// as TCP picks the window scale of a connection from them when it is
+// established. Sizes that aren't set keep the system's defaults.
+func (proxy *Proxy) setBufferSizes(network, address string, conn syscall.RawConn) error {
+	var err error
+	controlErr := conn.Control(func(fd uintptr) {
+		if proxy.ReadBuffer > 0 {
+			err = setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, proxy.ReadBuffer)
+		}
+		if err == nil && proxy.WriteBuffer > 0 {
+			err = setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, proxy.WriteBuffer)
+		}
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// setSocketOptions applies the socket options of the proxy to a client or
+// upstream connection. Options that aren't set keep Go's defaults, and buffer
+// sizes are set by setBufferSizes.
+func (proxy *Proxy) setSocketOptions(conn net.Conn) error {
+	conn = socketConn(conn)
+
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		if proxy.TCPNoDelay != nil {
+			err := tcp.SetNoDelay(*proxy.TCPNoDelay)
+			if err != nil {
+				return err
+			}
+		}
+		if proxy.KeepAlive != 0 {
+			err := tcp.SetKeepAlive(proxy.KeepAlive > 0)
+			if err != nil {
+				return err
+			}
+		}
+		if proxy.KeepAlive > 0 {
+			err := tcp.SetKeepAlivePeriod(time.Duration(proxy.KeepAlive) * time.Millisecond)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// socketConn returns the socket connection a connection wraps.
+func socketConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *rewriteConn:
+			conn = c.Conn
+		case *replyConn:
+			conn = c.Conn
+		case *proxyProtocolConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package toxiproxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+func getsockopt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal("Unable to get raw connection", err)
+	}
+	var value int
+	raw.Control(func(fd uintptr) {
+		value, err = getsockoptInt(fd, level, opt)
+	})
+	if err != nil {
+		t.Fatal("Unable to get socket option", err)
+	}
+	return value
+}
+
+func TestSetSocketOptions(t *testing.T) {
+	noDelay := false
+	srv := NewServer(NewMetricsContainer(prometheus.NewRegistry()), zerolog.Nop())
+	proxy := NewProxy(srv, "test_socket_options", "localhost:0", "upstream")
+	proxy.TCPNoDelay = &noDelay
+	proxy.KeepAlive = -1
+	proxy.ReadBuffer = 4096
+	proxy.WriteBuffer = 8192
+
+	ln, err := proxy.listenConfig().Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+	conn, err := proxy.dialer("tcp").Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("Unable to dial TCP server", err)
+	}
+	defer conn.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal("Unable to accept TCP client", err)
+	}
+	defer accepted.Close()
+
+	// Wrapped connections get the options of the socket they wrap
+	err = proxy.setSocketOptions(&rewriteConn{Conn: conn})
+	if err != nil {
+		t.Fatal("Unable to set socket options", err)
+	}
+
+	tcp := conn.(*net.TCPConn)
+	if value := getsockopt(t, tcp, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); value != 0 {
+		t.Errorf("Expected TCP_NODELAY to be disabled, got %d", value)
+	}
+	if value := getsockopt(t, tcp, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); value != 0 {
+		t.Errorf("Expected SO_KEEPALIVE to be disabled, got %d", value)
+	}
+	// Buffers are sized before connecting, on dialed and accepted sockets.
+	// Linux doubles the requested sizes for bookkeeping.
+	for _, tcp := range []*net.TCPConn{tcp, accepted.(*net.TCPConn)} {
+		if value := getsockopt(t, tcp, syscall.SOL_SOCKET, syscall.SO_RCVBUF); value > 2*4096 {
+			t.Errorf("Expected SO_RCVBUF of at most %d, got %d", 2*4096, value)
+		}
+		if value := getsockopt(t, tcp, syscall.SOL_SOCKET, syscall.SO_SNDBUF); value > 2*8192 {
+			t.Errorf("Expected SO_SNDBUF of at most %d, got %d", 2*8192, value)
+		}
+	}
+}
+
+func TestProxyDialsFromSourceAddress(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+	sources := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sources <- conn.RemoteAddr().String()
+	}()
+
+	// A port nothing else uses
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	source := free.Addr().String()
+	free.Close()
+
+	srv := NewServer(NewMetricsContainer(prometheus.NewRegistry()), zerolog.Nop())
+	proxy := NewProxy(srv, "test_source_address", "localhost:0", ln.Addr().String())
+	proxy.SourceAddress = source
+	err = proxy.Start()
+	if err != nil {
+		t.Fatal("Failed to start proxy", err)
+	}
+	defer proxy.Stop()
+
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	defer conn.Close()
+
+	select {
+	case addr := <-sources:
+		if addr != source {
+			t.Errorf("Expected the upstream to be dialed from %s, got %s", source, addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Upstream was not dialed")
+	}
+}
+
+func TestValidSocketOptions(t *testing.T) {
+	for _, tc := range []struct {
+		proxy *Proxy
+		valid bool
+	}{
+		{&Proxy{}, true},
+		{&Proxy{ReadBuffer: 1024, WriteBuffer: 2048, KeepAlive: -1}, true},
+		{&Proxy{SourceAddress: "10.0.0.1"}, true},
+		{&Proxy{SourceAddress: "[::1]:4000"}, true},
+		{&Proxy{ReadBuffer: -1}, false},
+		{&Proxy{WriteBuffer: -1}, false},
+		{&Proxy{SourceAddress: "localhost"}, false},
+		{&Proxy{SourceAddress: "10.0.0.1:http"}, false},
+	} {
+		if valid := ValidSocketOptions(tc.proxy); valid != tc.valid {
+			t.Errorf(
+				"Expected %v for buffers %d/%d and source address %q, got %v", tc.valid,
+				tc.proxy.ReadBuffer, tc.proxy.WriteBuffer, tc.proxy.SourceAddress, valid,
+			)
+		}
+	}
+}
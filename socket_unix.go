@@ -0,0 +1,9 @@
+//go:build unix
+
+package toxiproxy
+
+import "syscall"
+
+func setsockoptInt(fd uintptr, level, opt, value int) error {
+	return syscall.SetsockoptInt(int(fd), level, opt, value)
+}
@@ -0,0 +1,9 @@
+//go:build unix
+
+package toxiproxy
+
+import "syscall"
+
+func getsockoptInt(fd uintptr, level, opt int) (int, error) {
+	return syscall.GetsockoptInt(int(fd), level, opt)
+}
@@ -0,0 +1,175 @@
+package toxiproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS5, as described in RFC 1928. Clients can only connect to TCP
+// destinations, without authentication.
+const (
+	socks5Version = 5
+
+	socks5NoAuthentication    = 0x00
+	socks5NoAcceptableMethods = 0xff
+
+	socks5Connect = 1
+
+	socks5AddressIPv4   = 1
+	socks5AddressDomain = 3
+	socks5AddressIPv6   = 4
+
+	socks5Succeeded           = 0
+	socks5GeneralFailure      = 1
+	socks5HostUnreachable     = 4
+	socks5ConnectionRefused   = 5
+	socks5CommandNotSupported = 7
+	socks5AddressNotSupported = 8
+)
+
+var errInvalidSocks5Request = errors.New("invalid SOCKS5 request")
+
+// dialSocks5 reads the SOCKS5 request of a client and connects to the
+// destination it asks for, until ctx is done. It returns the destination as
+// host:port, with domain names as the client sent them.
+func (proxy *Proxy) dialSocks5(ctx context.Context, client net.Conn) (net.Conn, string, error) {
+	err := client.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return nil, "", err
+	}
+	destination, code, err := readSocks5Request(client)
+	if err != nil {
+		if code != socks5Succeeded {
+			client.Write(socks5Reply(code, nil))
+		}
+		return nil, "", err
+	}
+	err = client.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	upstream, err := proxy.dialDestination(ctx, destination)
+	if err != nil {
+		client.Write(socks5Reply(socks5ErrorCode(err), nil))
+		return nil, destination, err
+	}
+	_, err = client.Write(socks5Reply(socks5Succeeded, upstream.LocalAddr()))
+	if err != nil {
+		upstream.Close()
+		return nil, destination, err
+	}
+	return upstream, destination, nil
+}
+
+// readSocks5Request negotiates the authentication method with a client and
+// reads its request. It returns the reply code to fail the request with, if
+// the client should get a reply.
+func readSocks5Request(client io.ReadWriter) (string, byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(client, header)
+	if err != nil {
+		return "", socks5Succeeded, err
+	}
+	if header[0] != socks5Version {
+		return "", socks5Succeeded, errInvalidSocks5Request
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(client, methods)
+	if err != nil {
+		return "", socks5Succeeded, err
+	}
+	if !bytes.Contains(methods, []byte{socks5NoAuthentication}) {
+		client.Write([]byte{socks5Version, socks5NoAcceptableMethods})
+		return "", socks5Succeeded, errors.New("SOCKS5 client requires authentication")
+	}
+	_, err = client.Write([]byte{socks5Version, socks5NoAuthentication})
+	if err != nil {
+		return "", socks5Succeeded, err
+	}
+
+	request := make([]byte, 4)
+	_, err = io.ReadFull(client, request)
+	if err != nil {
+		return "", socks5Succeeded, err
+	}
+	if request[0] != socks5Version {
+		return "", socks5Succeeded, errInvalidSocks5Request
+	}
+	if request[1] != socks5Connect {
+		return "", socks5CommandNotSupported,
+			fmt.Errorf("unsupported SOCKS5 command %d", request[1])
+	}
+
+	var host []byte
+	switch request[3] {
+	case socks5AddressIPv4:
+		host = make([]byte, net.IPv4len)
+	case socks5AddressIPv6:
+		host = make([]byte, net.IPv6len)
+	case socks5AddressDomain:
+		size := make([]byte, 1)
+		_, err = io.ReadFull(client, size)
+		if err != nil {
+			return "", socks5Succeeded, err
+		}
+		host = make([]byte, size[0])
+	default:
+		return "", socks5AddressNotSupported, errInvalidSocks5Request
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(client, host)
+	if err == nil {
+		_, err = io.ReadFull(client, port)
+	}
+	if err != nil {
+		return "", socks5Succeeded, err
+	}
+
+	name := string(host)
+	if request[3] != socks5AddressDomain {
+		name = net.IP(host).String()
+	}
+	return net.JoinHostPort(name, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), 0, nil
+}
+
+// socks5Reply returns the reply to a request, with the address toxiproxy
+// connects to the destination from if it succeeded.
+func socks5Reply(code byte, addr net.Addr) []byte {
+	ip, port := net.IPv4zero, 0
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip, port = tcp.IP, tcp.Port
+	}
+
+	reply := []byte{socks5Version, code, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		reply = append(reply, socks5AddressIPv4)
+		reply = append(reply, ip4...)
+	} else {
+		reply = append(reply, socks5AddressIPv6)
+		reply = append(reply, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(reply, uint16(port))
+}
+
+// socks5ErrorCode returns the reply code for an error dialing a destination.
+func socks5ErrorCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5ConnectionRefused
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return socks5HostUnreachable
+	}
+	return socks5GeneralFailure
+}
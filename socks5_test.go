@@ -0,0 +1,153 @@
+package toxiproxy_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/Shopify/toxiproxy/v2"
+)
+
+func NewSocks5Proxy() *toxiproxy.Proxy {
+	srv := toxiproxy.NewServer(
+		toxiproxy.NewMetricsContainer(prometheus.NewRegistry()),
+		zerolog.Nop(),
+	)
+	proxy := toxiproxy.NewProxy(srv, "socks", "localhost:0", "")
+	proxy.Protocol = toxiproxy.ProtocolSOCKS5
+	return proxy
+}
+
+// socks5Connect asks a socks5 proxy to connect to a domain name and port, and
+// returns the connection along with the reply code.
+func socks5Connect(t *testing.T, addr, host string, port int, command byte) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	conn.Write([]byte{5, 1, 0})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil || !bytes.Equal(method, []byte{5, 0}) {
+		t.Fatalf("Expected no authentication to be selected, got %v %v", method, err)
+	}
+
+	request := []byte{5, command, 0, 3, byte(len(host))}
+	request = append(request, host...)
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	conn.Write(request)
+
+	// Replies of the proxy have IPv4 addresses
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal("Failed to read SOCKS5 reply", err)
+	}
+	return conn, reply[1]
+}
+
+func socks5Port(t *testing.T, addr string) int {
+	port, err := strconv.Atoi(listenPort(t, addr))
+	if err != nil {
+		t.Fatal("Invalid port", err)
+	}
+	return port
+}
+
+func TestSocks5ConnectsToDestination(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxy := NewSocks5Proxy()
+		proxy.Start()
+		defer proxy.Stop()
+
+		for i, expected := range []string{"a", "b"} {
+			conn, code := socks5Connect(t, proxy.Listen, "localhost", socks5Port(t, addrs[i]), 1)
+			if code != 0 {
+				t.Fatalf("Expected the request to succeed, got %d", code)
+			}
+			name := make([]byte, 1)
+			io.ReadFull(conn, name)
+			conn.Close()
+			if string(name) != expected {
+				t.Errorf("Expected to reach %s, got %q", expected, name)
+			}
+		}
+	})
+}
+
+func TestSocks5IdleClientDoesNotBlockOthers(t *testing.T) {
+	WithNamedServers(t, []string{"a"}, func(addrs []string) {
+		proxy := NewSocks5Proxy()
+		proxy.Start()
+		defer proxy.Stop()
+
+		idle, err := net.Dial("tcp", proxy.Listen)
+		if err != nil {
+			t.Fatal("Unable to dial proxy", err)
+		}
+		defer idle.Close()
+
+		conn, code := socks5Connect(t, proxy.Listen, "localhost", socks5Port(t, addrs[0]), 1)
+		defer conn.Close()
+		name := make([]byte, 1)
+		if _, err := io.ReadFull(conn, name); code != 0 || err != nil || string(name) != "a" {
+			t.Errorf("Expected to reach a past the idle client, got %d %q %v", code, name, err)
+		}
+	})
+}
+
+func TestSocks5ToxicsPerDestination(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxy := NewSocks5Proxy()
+		proxy.Start()
+		defer proxy.Stop()
+
+		destination := "localhost:" + listenPort(t, addrs[1])
+		_, err := proxy.Toxics.AddToxicJson(strings.NewReader(
+			`{"type": "reset_peer", "destination": "` + destination + `"}`,
+		))
+		if err != nil {
+			t.Fatal("Failed to add toxic", err)
+		}
+
+		conn, code := socks5Connect(t, proxy.Listen, "localhost", socks5Port(t, addrs[0]), 1)
+		defer conn.Close()
+		name := make([]byte, 1)
+		if _, err := io.ReadFull(conn, name); code != 0 || err != nil || string(name) != "a" {
+			t.Errorf("Expected to reach a without the toxic, got %d %q %v", code, name, err)
+		}
+
+		conn, _ = socks5Connect(t, proxy.Listen, "localhost", socks5Port(t, addrs[1]), 1)
+		defer conn.Close()
+		if _, err := io.ReadFull(conn, name); err == nil {
+			t.Error("Expected the toxic to reset the connection to b")
+		}
+	})
+}
+
+func TestSocks5RepliesWithErrors(t *testing.T) {
+	proxy := NewSocks5Proxy()
+	proxy.Start()
+	defer proxy.Stop()
+
+	conn, code := socks5Connect(t, proxy.Listen, "127.0.0.1", socks5Port(t, closedAddress(t)), 1)
+	conn.Close()
+	if code != 5 {
+		t.Errorf("Expected connection refused, got %d", code)
+	}
+
+	// BIND requests aren't supported
+	conn, code = socks5Connect(t, proxy.Listen, "127.0.0.1", 80, 2)
+	conn.Close()
+	if code != 7 {
+		t.Errorf("Expected command not supported, got %d", code)
+	}
+}
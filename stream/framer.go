@@ -0,0 +1,136 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// MaxMessageSize is the size of the largest message a Framer accepts.
+const MaxMessageSize = 64 * 1024 * 1024
+
+var (
+	ErrInvalidFraming  = errors.New("stream: invalid framing")
+	ErrMessageTooLarge = errors.New("stream: message too large")
+)
+
+// A Framer splits a stream into the messages of a protocol.
+type Framer interface {
+	// Frame returns the size of the message at the start of data, including
+	// its delimiter or length prefix, or 0 if data doesn't hold a whole
+	// message yet.
+	Frame(data []byte) (int, error)
+}
+
+// A ResumableFramer frames a message that arrives in many pieces without
+// scanning it from its start each time.
+type ResumableFramer interface {
+	Framer
+	// Resume is like Frame, for data whose first scanned bytes were given to
+	// an earlier call that returned 0.
+	Resume(data []byte, scanned int) (int, error)
+}
+
+// LineFramer frames messages ending with a newline.
+type LineFramer struct{}
+
+func (f LineFramer) Frame(data []byte) (int, error) {
+	return f.Resume(data, 0)
+}
+
+func (LineFramer) Resume(data []byte, scanned int) (int, error) {
+	i := bytes.IndexByte(data[scanned:], '\n')
+	if i < 0 {
+		if len(data) > MaxMessageSize {
+			return 0, ErrMessageTooLarge
+		}
+		return 0, nil
+	}
+	return scanned + i + 1, nil
+}
+
+// LengthPrefixFramer frames messages prefixed with the length of the rest of
+// the message, as an unsigned integer of 1, 2, 4 or 8 bytes.
+type LengthPrefixFramer struct {
+	Size  int
+	Order binary.ByteOrder
+}
+
+func (f LengthPrefixFramer) Frame(data []byte) (int, error) {
+	if len(data) < f.Size {
+		return 0, nil
+	}
+	var length uint64
+	switch f.Size {
+	case 1:
+		length = uint64(data[0])
+	case 2:
+		length = uint64(f.Order.Uint16(data))
+	case 4:
+		length = uint64(f.Order.Uint32(data))
+	case 8:
+		length = f.Order.Uint64(data)
+	default:
+		return 0, ErrInvalidFraming
+	}
+	return messageSize(data, f.Size, length)
+}
+
+// VarintFramer frames messages prefixed with the length of the rest of the
+// message as an unsigned varint, like length-delimited protocol buffers.
+type VarintFramer struct{}
+
+func (VarintFramer) Frame(data []byte) (int, error) {
+	length, n := binary.Uvarint(data)
+	if n == 0 {
+		return 0, nil
+	}
+	if n < 0 {
+		return 0, ErrMessageTooLarge
+	}
+	return messageSize(data, n, length)
+}
+
+func messageSize(data []byte, prefix int, length uint64) (int, error) {
+	if length > MaxMessageSize {
+		return 0, ErrMessageTooLarge
+	}
+	size := prefix + int(length)
+	if len(data) < size {
+		return 0, nil
+	}
+	return size, nil
+}
+
+// ParseFraming returns the Framer for a framing name: line, varint, or uint8,
+// uint16, uint32 and uint64 for length prefixes in big-endian byte order,
+// with an le suffix for little-endian.
+func ParseFraming(value string) (Framer, error) {
+	value = strings.ToLower(value)
+	switch value {
+	case "line":
+		return LineFramer{}, nil
+	case "varint":
+		return VarintFramer{}, nil
+	}
+
+	var order binary.ByteOrder = binary.BigEndian
+	if name, ok := strings.CutSuffix(value, "le"); ok {
+		value = name
+		order = binary.LittleEndian
+	} else {
+		value = strings.TrimSuffix(value, "be")
+	}
+	switch value {
+	case "uint8":
+		return LengthPrefixFramer{1, order}, nil
+	case "uint16":
+		return LengthPrefixFramer{2, order}, nil
+	case "uint32":
+		return LengthPrefixFramer{4, order}, nil
+	case "uint64":
+		return LengthPrefixFramer{8, order}, nil
+	}
+	return nil, ErrInvalidFraming
+}
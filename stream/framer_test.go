@@ -0,0 +1,100 @@
+package stream_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+func TestParseFraming(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected stream.Framer
+		err      error
+	}{
+		{"line", stream.LineFramer{}, nil},
+		{"varint", stream.VarintFramer{}, nil},
+		{"uint8", stream.LengthPrefixFramer{1, binary.BigEndian}, nil},
+		{"uint16", stream.LengthPrefixFramer{2, binary.BigEndian}, nil},
+		{"uint32be", stream.LengthPrefixFramer{4, binary.BigEndian}, nil},
+		{"UINT64LE", stream.LengthPrefixFramer{8, binary.LittleEndian}, nil},
+		{"", nil, stream.ErrInvalidFraming},
+		{"uint24", nil, stream.ErrInvalidFraming},
+		{"le", nil, stream.ErrInvalidFraming},
+	}
+
+	for _, tc := range testCases {
+		tc := tc // capture range variable
+		t.Run(tc.input, func(t *testing.T) {
+			t.Parallel()
+
+			actual, err := stream.ParseFraming(tc.input)
+			if err != tc.err {
+				t.Errorf("got error %v; expected %v", err, tc.err)
+			}
+			if actual != tc.expected {
+				t.Errorf("got %#v; expected %#v", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestFramers(t *testing.T) {
+	testCases := []struct {
+		name     string
+		framing  string
+		input    string
+		expected int
+		err      error
+	}{
+		{"whole line", "line", "PING\r\nPONG\n", 6, nil},
+		{"partial line", "line", "PING", 0, nil},
+		{"empty line", "line", "\n", 1, nil},
+		{"uint8 message", "uint8", "\x03abcdef", 4, nil},
+		{"empty uint8 message", "uint8", "\x00", 1, nil},
+		{"partial uint16 prefix", "uint16", "\x00", 0, nil},
+		{"uint16 message", "uint16", "\x00\x02ab", 4, nil},
+		{"uint16le message", "uint16le", "\x02\x00ab", 4, nil},
+		{"partial uint32 message", "uint32", "\x00\x00\x00\x05abc", 0, nil},
+		{"uint64le message", "uint64le", "\x01\x00\x00\x00\x00\x00\x00\x00a", 9, nil},
+		{"uint32 too large", "uint32", "\xff\xff\xff\xff", 0, stream.ErrMessageTooLarge},
+		{"varint message", "varint", "\x80\x01" + string(make([]byte, 128)), 130, nil},
+		{"partial varint", "varint", "\x80", 0, nil},
+		{
+			"varint overflow", "varint", "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01", 0,
+			stream.ErrMessageTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			framer, err := stream.ParseFraming(tc.framing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual, err := framer.Frame([]byte(tc.input))
+			if err != tc.err {
+				t.Errorf("got error %v; expected %v", err, tc.err)
+			}
+			if actual != tc.expected {
+				t.Errorf("got %d; expected %d", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLineFramerResumes(t *testing.T) {
+	var framer stream.ResumableFramer = stream.LineFramer{}
+	data := []byte("PI")
+	if size, _ := framer.Resume(data, 0); size != 0 {
+		t.Fatalf("got %d; expected 0", size)
+	}
+	data = append(data, "NG\nPONG\n"...)
+	if size, _ := framer.Resume(data, 2); size != 5 {
+		t.Errorf("got %d; expected 5", size)
+	}
+}
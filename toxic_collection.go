@@ -81,6 +81,10 @@ func (c *ToxicCollection) GetToxicArray() []toxics.Toxic {
 }
 
 func (c *ToxicCollection) AddToxicJson(data io.Reader) (*toxics.ToxicWrapper, error) {
+	// Held before the collection, as in Proxy.Update, so the protocol can't
+	// change while datagram toxics are added.
+	c.proxy.Lock()
+	defer c.proxy.Unlock()
 	c.Lock()
 	defer c.Unlock()
 
@@ -110,6 +114,9 @@ func (c *ToxicCollection) AddToxicJson(data io.Reader) (*toxics.ToxicWrapper, er
 	if toxics.New(wrapper) == nil {
 		return nil, ErrInvalidToxicType
 	}
+	if _, ok := wrapper.Toxic.(toxics.DatagramToxic); ok && !DatagramProtocol(c.proxy.Protocol) {
+		return nil, ErrDatagramToxic
+	}
 
 	found := c.findToxicByName(wrapper.Name)
 	if found != nil {
@@ -126,6 +133,11 @@ func (c *ToxicCollection) AddToxicJson(data io.Reader) (*toxics.ToxicWrapper, er
 	if err != nil {
 		return nil, joinError(err, ErrBadRequestBody)
 	}
+	if validated, ok := wrapper.Toxic.(toxics.ValidatedToxic); ok {
+		if err := validated.Validate(); err != nil {
+			return nil, joinError(err, ErrInvalidToxicAttrs)
+		}
+	}
 
 	c.chainAddToxic(wrapper)
 	return wrapper, nil
@@ -140,18 +152,29 @@ func (c *ToxicCollection) UpdateToxicJson(
 
 	toxic := c.findToxicByName(name)
 	if toxic != nil {
+		body, err := io.ReadAll(data)
+		if err != nil {
+			return nil, joinError(err, ErrBadRequestBody)
+		}
+		if err := validateUpdate(toxic, body); err != nil {
+			return nil, err
+		}
+
 		attrs := &struct {
-			Attributes interface{} `json:"attributes"`
-			Toxicity   float32     `json:"toxicity"`
+			Attributes  interface{} `json:"attributes"`
+			Toxicity    float32     `json:"toxicity"`
+			Destination string      `json:"destination"`
 		}{
 			toxic.Toxic,
 			toxic.Toxicity,
+			toxic.Destination,
 		}
-		err := json.NewDecoder(data).Decode(attrs)
+		err = json.Unmarshal(body, attrs)
 		if err != nil {
 			return nil, joinError(err, ErrBadRequestBody)
 		}
 		toxic.Toxicity = attrs.Toxicity
+		toxic.Destination = attrs.Destination
 
 		c.chainUpdateToxic(toxic)
 		return toxic, nil
@@ -159,6 +182,34 @@ func (c *ToxicCollection) UpdateToxicJson(
 	return nil, ErrToxicNotFound
 }
 
+// validateUpdate checks the attributes a toxic would have once updated with
+// body, on a copy so that the running toxic is left as is if they are invalid.
+func validateUpdate(toxic *toxics.ToxicWrapper, body []byte) error {
+	if _, ok := toxic.Toxic.(toxics.ValidatedToxic); !ok {
+		return nil
+	}
+	current, err := json.Marshal(toxic.Toxic)
+	if err != nil {
+		return err
+	}
+	updated := toxics.New(&toxics.ToxicWrapper{Type: toxic.Type})
+	if err := json.Unmarshal(current, updated); err != nil {
+		return err
+	}
+	attrs := &struct {
+		Attributes interface{} `json:"attributes"`
+	}{
+		updated,
+	}
+	if err := json.Unmarshal(body, attrs); err != nil {
+		return joinError(err, ErrBadRequestBody)
+	}
+	if err := updated.(toxics.ValidatedToxic).Validate(); err != nil {
+		return joinError(err, ErrInvalidToxicAttrs)
+	}
+	return nil
+}
+
 func (c *ToxicCollection) RemoveToxic(ctx context.Context, name string) error {
 	log := zerolog.Ctx(ctx).
 		With().
@@ -183,9 +234,11 @@ func (c *ToxicCollection) RemoveToxic(ctx context.Context, name string) error {
 	return nil
 }
 
+// StartLink starts a link for a connection dialed to destination.
 func (c *ToxicCollection) StartLink(
 	server *ApiServer,
 	name string,
+	destination string,
 	input io.Reader,
 	output io.WriteCloser,
 	direction stream.Direction,
@@ -201,6 +254,7 @@ func (c *ToxicCollection) StartLink(
 	}
 
 	link := NewToxicLink(c.proxy, c, direction, logger)
+	link.destination = destination
 	link.Start(server, name, input, output)
 	c.links[name] = link
 }
@@ -211,6 +265,22 @@ func (c *ToxicCollection) RemoveLink(name string) {
 	delete(c.links, name)
 }
 
+// hasDatagramToxics reports whether toxics that need a udp or dns proxy were
+// added.
+func (c *ToxicCollection) hasDatagramToxics() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for dir := range c.chain {
+		for _, toxic := range c.chain[dir] {
+			if _, ok := toxic.Toxic.(toxics.DatagramToxic); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // All following functions assume the lock is already grabbed.
 func (c *ToxicCollection) findToxicByName(name string) *toxics.ToxicWrapper {
 	for dir := range c.chain {
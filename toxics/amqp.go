@@ -0,0 +1,491 @@
+package toxics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const (
+	amqpFrameMethod = 1
+	amqpFrameEnd    = 0xCE
+	amqpMaxFrame    = 64 * 1024 * 1024
+
+	amqpReplySuccess     = 200
+	amqpConnectionForced = 320
+	amqpNotFound         = 404
+)
+
+var errAMQPReplyCode = errors.New("reply_code must be between 200 and 599")
+
+var amqpProtocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// AMQP methods as class and method id.
+const (
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelClose      = 20<<16 | 40
+	amqpChannelCloseOk    = 20<<16 | 41
+	amqpQueueDeclare      = 50<<16 | 10
+	amqpQueueBind         = 50<<16 | 20
+	amqpQueuePurge        = 50<<16 | 30
+	amqpQueueDelete       = 50<<16 | 40
+	amqpQueueUnbind       = 50<<16 | 50
+	amqpBasicConsume      = 60<<16 | 20
+	amqpBasicConsumeOk    = 60<<16 | 21
+	amqpBasicCancelOk     = 60<<16 | 31
+	amqpBasicDeliver      = 60<<16 | 60
+	amqpBasicGet          = 60<<16 | 70
+	amqpBasicAck          = 60<<16 | 80
+	amqpBasicNack         = 60<<16 | 120
+)
+
+var amqpReplyNames = map[int]string{
+	200: "REPLY_SUCCESS",
+	311: "CONTENT_TOO_LARGE",
+	313: "NO_CONSUMERS",
+	320: "CONNECTION_FORCED",
+	402: "INVALID_PATH",
+	403: "ACCESS_REFUSED",
+	404: "NOT_FOUND",
+	405: "RESOURCE_LOCKED",
+	406: "PRECONDITION_FAILED",
+	501: "FRAME_ERROR",
+	502: "SYNTAX_ERROR",
+	503: "COMMAND_INVALID",
+	504: "CHANNEL_ERROR",
+	505: "UNEXPECTED_FRAME",
+	506: "RESOURCE_ERROR",
+	530: "NOT_ALLOWED",
+	540: "NOT_IMPLEMENTED",
+	541: "INTERNAL_ERROR",
+}
+
+// The AMQPToxic acts on AMQP 0-9-1 methods. Added upstream, it closes the
+// connection or a channel when the client uses a matching queue. Added
+// downstream, it follows the consumers the client starts to know which queue
+// deliveries come from, can close the connection on matching deliveries, and
+// turns publisher confirms into nacks or drops them. Either way matching
+// methods can be slowed down. TLS connections are left alone.
+type AMQPToxic struct {
+	// Regular expression matched against the queue of client methods naming
+	// one, such as queue.declare, basic.consume and basic.get, and against the
+	// queue deliveries are consumed from
+	Queue string `json:"queue"`
+	// Regular expression deliveries must also have a matching routing key for
+	RoutingKey string `json:"routing_key"`
+	// What to do with matching methods: connection_close or channel_close to
+	// close the connection or channel with a reply code, nack to turn
+	// publisher confirms into nacks, drop_ack to drop them. If empty, matching
+	// methods are only delayed.
+	Action    string `json:"action"`
+	ReplyCode int    `json:"reply_code"`
+	ReplyText string `json:"reply_text"`
+	// Milliseconds to wait before a matching method is handled
+	Latency int64 `json:"latency"`
+}
+
+type AMQPToxicState struct {
+	buffer      messageBuffer
+	started     bool
+	passthrough bool
+	// Whether this is the client side of the connection
+	client bool
+	// Waiting for the client to acknowledge a close sent by the toxic
+	closing         bool
+	closingChannels map[uint16]bool
+	consumers       amqpConsumers
+}
+
+// amqpConsumers follows the consumers a client starts, to know which queue
+// the deliveries to a consumer tag come from.
+type amqpConsumers struct {
+	lock sync.Mutex
+	// Queues of the basic.consume waiting for a consume-ok on each channel
+	pending map[uint16][]string
+	queues  map[amqpConsumer]string
+}
+
+type amqpConsumer struct {
+	channel uint16
+	tag     string
+}
+
+// watch is called with the frames the client sends to the server.
+func (c *amqpConsumers) watch(frame []byte) {
+	if frame[0] != amqpFrameMethod || len(frame) < 14 ||
+		binary.BigEndian.Uint32(frame[7:]) != amqpBasicConsume {
+		return
+	}
+	channel := binary.BigEndian.Uint16(frame[1:])
+	// reserved-1, queue, consumer-tag, no-local, no-ack, exclusive, no-wait
+	queue, args, err := amqpShortString(frame[13:])
+	if err != nil {
+		return
+	}
+	tag, args, err := amqpShortString(args)
+	if err != nil || len(args) < 1 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if args[0]&8 != 0 {
+		c.started(amqpConsumer{channel, tag}, queue)
+		return
+	}
+	if c.pending == nil {
+		c.pending = make(map[uint16][]string)
+	}
+	c.pending[channel] = append(c.pending[channel], queue)
+}
+
+// consumeOk matches the consumer tag the server confirms to the oldest
+// basic.consume of its channel.
+func (c *amqpConsumers) consumeOk(channel uint16, tag string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pending := c.pending[channel]
+	if len(pending) == 0 {
+		return
+	}
+	c.started(amqpConsumer{channel, tag}, pending[0])
+	c.pending[channel] = pending[1:]
+}
+
+func (c *amqpConsumers) started(consumer amqpConsumer, queue string) {
+	if c.queues == nil {
+		c.queues = make(map[amqpConsumer]string)
+	}
+	c.queues[consumer] = queue
+}
+
+func (c *amqpConsumers) cancelOk(channel uint16, tag string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.queues, amqpConsumer{channel, tag})
+}
+
+// queue returns the queue a consumer consumes from, or an empty string if the
+// consumer was started before the toxic was added.
+func (c *amqpConsumers) queue(channel uint16, tag string) string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.queues[amqpConsumer{channel, tag}]
+}
+
+// amqpFramer frames AMQP frames, and the protocol header clients start with.
+type amqpFramer struct{}
+
+func (amqpFramer) Frame(data []byte) (int, error) {
+	if bytes.HasPrefix(data, amqpProtocolHeader[:4]) {
+		if len(data) < len(amqpProtocolHeader) {
+			return 0, nil
+		}
+		return len(amqpProtocolHeader), nil
+	}
+	if len(data) < 7 {
+		return 0, nil
+	}
+	size := int(binary.BigEndian.Uint32(data[3:]))
+	if size > amqpMaxFrame {
+		return 0, stream.ErrMessageTooLarge
+	}
+	size += 8
+	if len(data) < size {
+		return 0, nil
+	}
+	if data[size-1] != amqpFrameEnd {
+		return 0, stream.ErrInvalidFraming
+	}
+	return size, nil
+}
+
+func (t *AMQPToxic) Validate() error {
+	if err := validatePatterns(t.Queue, t.RoutingKey); err != nil {
+		return err
+	}
+	actions := []string{"", "connection_close", "channel_close", "nack", "drop_ack"}
+	if err := validateChoice("action", t.Action, actions...); err != nil {
+		return err
+	}
+	if t.ReplyCode != 0 && (t.ReplyCode < 200 || t.ReplyCode > 599) {
+		return errAMQPReplyCode
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+func (t *AMQPToxic) closeMethod(method uint32, defaultCode int, channel uint16) []byte {
+	code := t.ReplyCode
+	if code == 0 {
+		code = defaultCode
+	}
+	text := t.ReplyText
+	if text == "" {
+		text = amqpReplyNames[code] + " - closed by toxiproxy"
+	}
+	text = text[:min(len(text), 255)]
+
+	args := binary.BigEndian.AppendUint16(nil, uint16(code))
+	args = append(args, byte(len(text)))
+	args = append(args, text...)
+	args = binary.BigEndian.AppendUint32(args, 0) // class and method id
+	return amqpMethodFrame(channel, method, args)
+}
+
+func amqpMethodFrame(channel uint16, method uint32, args []byte) []byte {
+	frame := []byte{amqpFrameMethod}
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(4+len(args)))
+	frame = binary.BigEndian.AppendUint32(frame, method)
+	frame = append(frame, args...)
+	return append(frame, amqpFrameEnd)
+}
+
+// amqpShortString reads a short string from the start of data, returning it
+// and the remaining data.
+func amqpShortString(data []byte) (string, []byte, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", nil, fmt.Errorf("short string out of bounds")
+	}
+	return string(data[1 : 1+data[0]]), data[1+data[0]:], nil
+}
+
+// amqpQueue returns the queue a client method operates on.
+func amqpQueue(method uint32, args []byte) (string, bool) {
+	switch method {
+	case amqpQueueDeclare, amqpQueueBind, amqpQueuePurge, amqpQueueDelete,
+		amqpQueueUnbind, amqpBasicConsume, amqpBasicGet:
+		if len(args) < 2 {
+			return "", false
+		}
+		// reserved-1, queue
+		queue, _, err := amqpShortString(args[2:])
+		return queue, err == nil
+	}
+	return "", false
+}
+
+// amqpDelivery returns the consumer tag and routing key of a basic.deliver.
+func amqpDelivery(args []byte) (string, string, bool) {
+	// consumer-tag, delivery-tag, redelivered, exchange, routing-key
+	tag, args, err := amqpShortString(args)
+	if err != nil || len(args) < 9 {
+		return "", "", false
+	}
+	_, args, err = amqpShortString(args[9:])
+	if err != nil {
+		return "", "", false
+	}
+	key, _, err := amqpShortString(args)
+	return tag, key, err == nil
+}
+
+func (t *AMQPToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*AMQPToxicState)
+	buf := &state.buffer
+
+	var routingKey *regexp.Regexp
+	queue, err := regexp.Compile(t.Queue)
+	if err == nil {
+		routingKey, err = regexp.Compile(t.RoutingKey)
+	}
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !state.started {
+			// Clients start with the protocol header, servers with a frame
+			if !buf.fill(stub, len(amqpProtocolHeader)) {
+				return
+			}
+			state.started = true
+			state.client = bytes.HasPrefix(buf.data, amqpProtocolHeader)
+			switch {
+			case state.client:
+				// The server waits for the header before it speaks
+				stub.Reply.SetFraming(amqpFramer{}, nil)
+				buf.pass(len(amqpProtocolHeader))
+			case buf.data[0] != amqpFrameMethod:
+				state.passthrough = true
+			default:
+				// The client waits for connection.start after its header, so
+				// the frames it sends next are watched from their start.
+				stub.Reply.SetFraming(amqpFramer{}, nil)
+				stub.Reply.Watch(state.consumers.watch)
+			}
+			continue
+		}
+
+		if !buf.fill(stub, 7) {
+			return
+		}
+		kind := buf.data[0]
+		channel := binary.BigEndian.Uint16(buf.data[1:])
+		size := int(binary.BigEndian.Uint32(buf.data[3:]))
+		if size > amqpMaxFrame {
+			state.passthrough = true
+			continue
+		}
+		size += 8
+
+		if state.closing || state.closingChannels[channel] {
+			// Everything but the close handshake is ignored after a close
+			if !buf.fill(stub, size) {
+				return
+			}
+			frame := buf.next(size)
+			if t.closeHandshake(stub, channel, frame) {
+				buf.discard(len(buf.data))
+				return
+			}
+			continue
+		}
+
+		if kind != amqpFrameMethod {
+			buf.pass(size)
+			continue
+		}
+		if !buf.fill(stub, size) {
+			return
+		}
+		if buf.data[size-1] != amqpFrameEnd || size < 12 {
+			state.passthrough = true
+			continue
+		}
+		method := binary.BigEndian.Uint32(buf.data[7:])
+		args := buf.data[11 : size-1]
+
+		var matched bool
+		if state.client {
+			name, ok := amqpQueue(method, args)
+			matched = ok && queue.MatchString(name)
+		} else {
+			switch method {
+			case amqpBasicConsumeOk:
+				if tag, _, err := amqpShortString(args); err == nil {
+					state.consumers.consumeOk(channel, tag)
+				}
+			case amqpBasicCancelOk:
+				if tag, _, err := amqpShortString(args); err == nil {
+					state.consumers.cancelOk(channel, tag)
+				}
+			case amqpBasicDeliver:
+				tag, key, ok := amqpDelivery(args)
+				matched = ok && queue.MatchString(state.consumers.queue(channel, tag)) &&
+					routingKey.MatchString(key)
+			case amqpBasicAck:
+				matched = t.Action == "nack" || t.Action == "drop_ack"
+			}
+		}
+		if !matched {
+			buf.forward(stub, size)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		switch {
+		case t.Action == "connection_close" && state.client:
+			buf.discard(size)
+			stub.Reply.Send(t.closeMethod(amqpConnectionClose, amqpConnectionForced, 0))
+			state.closing = true
+		case t.Action == "connection_close":
+			buf.discard(size)
+			stub.Output <- &stream.StreamChunk{
+				Data:      t.closeMethod(amqpConnectionClose, amqpConnectionForced, 0),
+				Timestamp: buf.timestamp,
+			}
+			buf.discard(len(buf.data))
+			stub.Close()
+			return
+		case t.Action == "channel_close" && state.client:
+			buf.discard(size)
+			stub.Reply.Send(t.closeMethod(amqpChannelClose, amqpNotFound, channel))
+			// Close the channel on the server as if the client did it, its
+			// close-ok is ignored by the client as the channel is closed.
+			args := binary.BigEndian.AppendUint16(nil, amqpReplySuccess)
+			args = append(args, 0)
+			args = binary.BigEndian.AppendUint32(args, 0)
+			stub.Output <- &stream.StreamChunk{
+				Data:      amqpMethodFrame(channel, amqpChannelClose, args),
+				Timestamp: buf.timestamp,
+			}
+			if state.closingChannels == nil {
+				state.closingChannels = make(map[uint16]bool)
+			}
+			state.closingChannels[channel] = true
+		case t.Action == "drop_ack" && method == amqpBasicAck:
+			buf.discard(size)
+		case t.Action == "nack" && method == amqpBasicAck && len(args) >= 9:
+			frame := buf.next(size)
+			// delivery-tag, multiple with requeue unset
+			nack := amqpMethodFrame(channel, amqpBasicNack, frame[11:20])
+			stub.Output <- &stream.StreamChunk{
+				Data:      nack,
+				Timestamp: buf.timestamp,
+			}
+		default:
+			buf.forward(stub, size)
+		}
+	}
+}
+
+// closeHandshake handles a client frame received after the toxic closed the
+// connection or one of its channels. It returns true once the connection is
+// closed.
+func (t *AMQPToxic) closeHandshake(stub *ToxicStub, channel uint16, frame []byte) bool {
+	state := stub.State.(*AMQPToxicState)
+	if frame[0] != amqpFrameMethod || len(frame) < 12 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(frame[7:]) {
+	case amqpConnectionClose:
+		// Both sides closed the connection at the same time
+		stub.Reply.Send(amqpMethodFrame(0, amqpConnectionCloseOk, nil))
+		stub.Close()
+		return true
+	case amqpConnectionCloseOk:
+		if state.closing {
+			stub.Close()
+			return true
+		}
+	case amqpChannelClose:
+		// Both sides closed the channel at the same time
+		stub.Reply.Send(amqpMethodFrame(channel, amqpChannelCloseOk, nil))
+		delete(state.closingChannels, channel)
+	case amqpChannelCloseOk:
+		delete(state.closingChannels, channel)
+	}
+	return false
+}
+
+func (t *AMQPToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*AMQPToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *AMQPToxic) NewState() interface{} {
+	return new(AMQPToxicState)
+}
+
+func init() {
+	Register("amqp", new(AMQPToxic))
+}
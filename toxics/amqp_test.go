@@ -0,0 +1,146 @@
+package toxics_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func amqpFrame(channel uint16, class, method uint16, args []byte) []byte {
+	frame := []byte{1}
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(4+len(args)))
+	frame = binary.BigEndian.AppendUint16(frame, class)
+	frame = binary.BigEndian.AppendUint16(frame, method)
+	frame = append(frame, args...)
+	return append(frame, 0xCE)
+}
+
+func amqpShortString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func amqpConsume(channel uint16, queue string) []byte {
+	args := append([]byte{0, 0}, amqpShortString(queue)...)
+	args = append(args, amqpShortString("")...)
+	return amqpFrame(channel, 60, 20, append(args, 0, 0, 0, 0, 0))
+}
+
+func TestAMQPToxicClosesChannel(t *testing.T) {
+	toxic := &toxics.AMQPToxic{Queue: "^orders$", Action: "channel_close", ReplyCode: 406}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	header := []byte("AMQP\x00\x00\x09\x01")
+	other := amqpConsume(1, "users")
+	input <- &stream.StreamChunk{Data: append(append(header, other...), amqpConsume(2, "orders")...)}
+
+	replyText := amqpShortString("PRECONDITION_FAILED - closed by toxiproxy")
+	closeArgs := append([]byte{1, 150}, replyText...)
+	expected := amqpFrame(2, 20, 40, append(closeArgs, 0, 0, 0, 0))
+	if got := readChunks(replies); !bytes.Equal(got, expected) {
+		t.Errorf("Expected channel.close, got %q", got)
+	}
+	serverClose := amqpFrame(2, 20, 40, []byte{0, 200, 0, 0, 0, 0, 0})
+	expected = append(append(header, other...), serverClose...)
+	if got := readChunks(output); !bytes.Equal(got, expected) {
+		t.Errorf("Expected the server channel to be closed, got %q", got)
+	}
+
+	// Frames are ignored until the client acknowledges the close
+	input <- &stream.StreamChunk{Data: append(amqpConsume(2, "other"), amqpFrame(2, 20, 41, nil)...)}
+	input <- &stream.StreamChunk{Data: amqpFrame(2, 20, 10, []byte{0})}
+	if got := readChunks(output); !bytes.Equal(got, amqpFrame(2, 20, 10, []byte{0})) {
+		t.Errorf("Expected only channel.open after close-ok, got %q", got)
+	}
+	close(input)
+}
+
+func TestAMQPToxicClosesConnection(t *testing.T) {
+	toxic := &toxics.AMQPToxic{Action: "connection_close"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	header := []byte("AMQP\x00\x00\x09\x01")
+	input <- &stream.StreamChunk{Data: append(header, amqpConsume(1, "orders")...)}
+
+	closeArgs := append([]byte{1, 64}, amqpShortString("CONNECTION_FORCED - closed by toxiproxy")...)
+	expected := amqpFrame(0, 10, 50, append(closeArgs, 0, 0, 0, 0))
+	if got := readChunks(replies); !bytes.Equal(got, expected) {
+		t.Errorf("Expected connection.close, got %q", got)
+	}
+
+	input <- &stream.StreamChunk{Data: amqpFrame(0, 10, 51, nil)}
+	if got := readChunks(output); !bytes.Equal(got, header) {
+		t.Errorf("Expected nothing but the protocol header, got %q", got)
+	}
+	if !stub.Closed() {
+		t.Error("Expected the connection to be closed after close-ok")
+	}
+}
+
+func TestAMQPToxicNacksConfirms(t *testing.T) {
+	toxic := &toxics.AMQPToxic{Action: "nack"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := amqpFrame(0, 10, 10, []byte{0, 9})
+	ack := amqpFrame(1, 60, 80, []byte{0, 0, 0, 0, 0, 0, 0, 7, 1})
+	input <- &stream.StreamChunk{Data: append(start, ack...)}
+
+	nack := amqpFrame(1, 60, 120, []byte{0, 0, 0, 0, 0, 0, 0, 7, 1})
+	if got := readChunks(output); !bytes.Equal(got, append(start, nack...)) {
+		t.Errorf("Expected ack to be turned into a nack, got %q", got)
+	}
+	close(input)
+}
+
+func TestAMQPToxicDropsConfirms(t *testing.T) {
+	toxic := &toxics.AMQPToxic{Action: "drop_ack"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := amqpFrame(0, 10, 10, []byte{0, 9})
+	ack := amqpFrame(1, 60, 80, []byte{0, 0, 0, 0, 0, 0, 0, 7, 0})
+	input <- &stream.StreamChunk{Data: append(start, ack...)}
+
+	if got := readChunks(output); !bytes.Equal(got, start) {
+		t.Errorf("Expected ack to be dropped, got %q", got)
+	}
+	close(input)
+}
+
+func amqpDeliver(channel uint16, tag, routingKey string) []byte {
+	args := append(amqpShortString(tag), 0, 0, 0, 0, 0, 0, 0, 1, 0)
+	args = append(args, amqpShortString("")...)
+	return amqpFrame(channel, 60, 60, append(args, amqpShortString(routingKey)...))
+}
+
+func TestAMQPToxicMatchesDeliveriesOnTheirQueue(t *testing.T) {
+	toxic := &toxics.AMQPToxic{Queue: "^orders$", Action: "connection_close"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := amqpFrame(0, 10, 10, []byte{0, 9})
+	input <- &stream.StreamChunk{Data: start}
+	readChunks(output)
+
+	// The client starts consumers on both queues, the server names them
+	stub.Reply.Write(append(amqpConsume(1, "users"), amqpConsume(1, "orders")...))
+	consumeOk := append(amqpFrame(1, 60, 21, amqpShortString("ctag-1")),
+		amqpFrame(1, 60, 21, amqpShortString("ctag-2"))...)
+	unmatched := append(consumeOk, amqpDeliver(1, "ctag-1", "orders")...)
+	input <- &stream.StreamChunk{Data: append(unmatched, amqpDeliver(1, "ctag-2", "new")...)}
+
+	closeArgs := append([]byte{1, 64}, amqpShortString("CONNECTION_FORCED - closed by toxiproxy")...)
+	expected := append(unmatched, amqpFrame(0, 10, 50, append(closeArgs, 0, 0, 0, 0))...)
+	if got := readChunks(output); !bytes.Equal(got, expected) {
+		t.Errorf("Expected the connection to be closed on the delivery from orders, got %q", got)
+	}
+	if !stub.Closed() {
+		t.Error("Expected the connection to be closed")
+	}
+}
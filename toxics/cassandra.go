@@ -0,0 +1,334 @@
+package toxics
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const (
+	cqlHeaderSize   = 9
+	cqlCompression  = 0x01
+	cqlMaxFrameSize = 256 * 1024 * 1024
+
+	cqlOpError   = 0x00
+	cqlOpQuery   = 0x07
+	cqlOpPrepare = 0x09
+	cqlOpExecute = 0x0A
+)
+
+var errCassandraError = errors.New("error must be one of Unavailable, ReadTimeout, " +
+	"WriteTimeout, Overloaded, IsBootstrapping, ServerError")
+
+var cqlErrors = map[string]int32{
+	"servererror":     0x0000,
+	"unavailable":     0x1000,
+	"overloaded":      0x1001,
+	"isbootstrapping": 0x1002,
+	"writetimeout":    0x1100,
+	"readtimeout":     0x1200,
+}
+
+// Replicas required by each consistency level, assuming a replication factor
+// of 3.
+var cqlBlockFor = map[uint16]int32{
+	0x0000: 1, // ANY
+	0x0001: 1, // ONE
+	0x0002: 2, // TWO
+	0x0003: 3, // THREE
+	0x0004: 2, // QUORUM
+	0x0005: 3, // ALL
+	0x0006: 2, // LOCAL_QUORUM
+	0x0007: 2, // EACH_QUORUM
+	0x0008: 2, // SERIAL
+	0x0009: 2, // LOCAL_SERIAL
+	0x000A: 1, // LOCAL_ONE
+}
+
+var (
+	cqlUse   = regexp.MustCompile(`(?is)^\s*use\s+("[^"]+"|\w+)`)
+	cqlTable = regexp.MustCompile(
+		`(?is)^\s*(?:select\b.*?\bfrom|insert\s+into|update|delete\b.*?\bfrom|truncate(?:\s+table)?)` +
+			`\s+("[^"]+"|\w+)(?:\s*\.\s*("[^"]+"|\w+))?`,
+	)
+)
+
+// The CassandraToxic fails or slows down the QUERY and EXECUTE requests on a
+// matching keyspace and table, for versions 3 and 4 of the CQL native
+// protocol. It reads the requests drivers send, so it goes on the upstream
+// stream, and can't see into compressed frames.
+type CassandraToxic struct {
+	// Regular expression matched against the keyspace of statements
+	Keyspace string `json:"keyspace"`
+	// Regular expression matched against the table of statements
+	Table string `json:"table"`
+	// Error to reply with: Unavailable, ReadTimeout, WriteTimeout, Overloaded,
+	// IsBootstrapping or ServerError. If empty, matching requests are only
+	// delayed.
+	Error        string `json:"error"`
+	ErrorMessage string `json:"error_message"`
+	// Milliseconds a matching request is held back before it is sent on or
+	// failed
+	Latency int64 `json:"latency"`
+
+	// Statements prepared through the toxic by id, shared by all connections
+	// as drivers may execute a statement on another connection.
+	prepared sync.Map
+}
+
+type CassandraToxicState struct {
+	buffer      messageBuffer
+	started     bool
+	passthrough bool
+	// Keyspace set with USE
+	keyspace string
+}
+
+// cqlFramer frames CQL frames of versions 3 and 4, whose length is in their
+// header even when they are compressed.
+type cqlFramer struct{}
+
+func (cqlFramer) Frame(data []byte) (int, error) {
+	if len(data) < cqlHeaderSize {
+		return 0, nil
+	}
+	size := cqlHeaderSize + int(binary.BigEndian.Uint32(data[5:]))
+	if size > stream.MaxMessageSize {
+		return 0, stream.ErrMessageTooLarge
+	}
+	if len(data) < size {
+		return 0, nil
+	}
+	return size, nil
+}
+
+// cqlStatement is the keyspace and table a statement operates on.
+type cqlStatement struct {
+	keyspace string
+	table    string
+}
+
+func cqlIdentifier(name string) string {
+	if strings.HasPrefix(name, `"`) {
+		return strings.Trim(name, `"`)
+	}
+	return strings.ToLower(name)
+}
+
+func parseCQLStatement(query, keyspace string) cqlStatement {
+	statement := cqlStatement{keyspace: keyspace}
+	match := cqlTable.FindStringSubmatch(query)
+	if match == nil {
+		return statement
+	}
+	if match[2] != "" {
+		statement.keyspace = cqlIdentifier(match[1])
+		statement.table = cqlIdentifier(match[2])
+	} else {
+		statement.table = cqlIdentifier(match[1])
+	}
+	return statement
+}
+
+// cqlLongString reads a [long string] from the start of data.
+func cqlLongString(data []byte) (string, bool) {
+	if len(data) < 4 {
+		return "", false
+	}
+	length := int(int32(binary.BigEndian.Uint32(data)))
+	if length < 0 || len(data) < 4+length {
+		return "", false
+	}
+	return string(data[4 : 4+length]), true
+}
+
+func (t *CassandraToxic) Validate() error {
+	if err := validatePatterns(t.Keyspace, t.Table); err != nil {
+		return err
+	}
+	if _, ok := cqlErrors[strings.ToLower(t.Error)]; t.Error != "" && !ok {
+		return errCassandraError
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+func (t *CassandraToxic) errorFrame(header []byte, consistency uint16) []byte {
+	name := strings.ToLower(t.Error)
+	code := cqlErrors[name]
+	message := t.ErrorMessage
+	if message == "" {
+		message = "request failed by toxiproxy"
+	}
+
+	body := binary.BigEndian.AppendUint32(nil, uint32(code))
+	body = binary.BigEndian.AppendUint16(body, uint16(len(message)))
+	body = append(body, message...)
+
+	blockFor := cqlBlockFor[consistency]
+	switch name {
+	case "unavailable":
+		// consistency, required, alive
+		body = binary.BigEndian.AppendUint16(body, consistency)
+		body = binary.BigEndian.AppendUint32(body, uint32(blockFor))
+		body = binary.BigEndian.AppendUint32(body, uint32(blockFor-1))
+	case "writetimeout":
+		// consistency, received, block_for, write_type
+		writeType := "SIMPLE"
+		body = binary.BigEndian.AppendUint16(body, consistency)
+		body = binary.BigEndian.AppendUint32(body, uint32(blockFor-1))
+		body = binary.BigEndian.AppendUint32(body, uint32(blockFor))
+		body = binary.BigEndian.AppendUint16(body, uint16(len(writeType)))
+		body = append(body, writeType...)
+	case "readtimeout":
+		// consistency, received, block_for, data_present
+		body = binary.BigEndian.AppendUint16(body, consistency)
+		body = binary.BigEndian.AppendUint32(body, uint32(blockFor-1))
+		body = binary.BigEndian.AppendUint32(body, uint32(blockFor))
+		body = append(body, 0)
+	}
+
+	// Same version as a response, stream id of the request
+	frame := []byte{header[0] | 0x80, 0, header[2], header[3], cqlOpError}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	return append(frame, body...)
+}
+
+func (t *CassandraToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*CassandraToxicState)
+	buf := &state.buffer
+
+	var table *regexp.Regexp
+	keyspace, err := regexp.Compile(t.Keyspace)
+	if err == nil {
+		table, err = regexp.Compile(t.Table)
+	}
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !buf.fill(stub, cqlHeaderSize) {
+			return
+		}
+		version := buf.data[0]
+		length := int(binary.BigEndian.Uint32(buf.data[5:]))
+		if version != 3 && version != 4 || length > cqlMaxFrameSize {
+			// Other versions, including the framing of version 5
+			state.passthrough = true
+			continue
+		}
+		size := cqlHeaderSize + length
+		if !state.started {
+			// Responses carry the stream id of their request, errors only wait
+			// for whole frames. The server doesn't speak first.
+			state.started = true
+			stub.Reply.SetFraming(cqlFramer{}, nil)
+		}
+		opcode := buf.data[4]
+		if buf.data[1]&cqlCompression != 0 ||
+			opcode != cqlOpQuery && opcode != cqlOpPrepare && opcode != cqlOpExecute {
+			buf.pass(size)
+			continue
+		}
+
+		if !buf.fill(stub, size) {
+			return
+		}
+		body := buf.data[cqlHeaderSize:size]
+
+		var query string
+		var params []byte
+		switch opcode {
+		case cqlOpQuery, cqlOpPrepare:
+			var ok bool
+			query, ok = cqlLongString(body)
+			if !ok {
+				buf.forward(stub, size)
+				continue
+			}
+			params = body[4+len(query):]
+			if opcode == cqlOpPrepare {
+				t.prepare(query, state.keyspace)
+				buf.forward(stub, size)
+				continue
+			}
+			if match := cqlUse.FindStringSubmatch(query); match != nil {
+				state.keyspace = cqlIdentifier(match[1])
+			}
+		case cqlOpExecute:
+			if len(body) < 2 || len(body) < 2+int(binary.BigEndian.Uint16(body)) {
+				buf.forward(stub, size)
+				continue
+			}
+			id := string(body[2 : 2+int(binary.BigEndian.Uint16(body))])
+			prepared, ok := t.prepared.Load(id)
+			if !ok {
+				buf.forward(stub, size)
+				continue
+			}
+			query = prepared.(string)
+			params = body[2+len(id):]
+		}
+
+		statement := parseCQLStatement(query, state.keyspace)
+		if statement.table == "" ||
+			!keyspace.MatchString(statement.keyspace) || !table.MatchString(statement.table) {
+			buf.forward(stub, size)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		if t.Error == "" {
+			buf.forward(stub, size)
+			continue
+		}
+		var consistency uint16
+		if len(params) >= 2 {
+			consistency = binary.BigEndian.Uint16(params)
+		}
+		frame := t.errorFrame(buf.data[:cqlHeaderSize], consistency)
+		buf.discard(size)
+		stub.Reply.Send(frame)
+	}
+}
+
+// prepare remembers the query of a prepared statement by the ids the server
+// may give it: the MD5 of the query, prefixed with the keyspace in use.
+func (t *CassandraToxic) prepare(query, keyspace string) {
+	id := md5.Sum([]byte(query))
+	t.prepared.Store(string(id[:]), query)
+	if keyspace != "" {
+		id = md5.Sum([]byte(keyspace + query))
+		t.prepared.Store(string(id[:]), query)
+	}
+}
+
+func (t *CassandraToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*CassandraToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *CassandraToxic) NewState() interface{} {
+	return new(CassandraToxicState)
+}
+
+func init() {
+	Register("cassandra", new(CassandraToxic))
+}
@@ -0,0 +1,114 @@
+package toxics_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func cqlFrame(stream uint16, opcode byte, body []byte) []byte {
+	frame := []byte{4, 0}
+	frame = binary.BigEndian.AppendUint16(frame, stream)
+	frame = append(frame, opcode)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(body)))
+	return append(frame, body...)
+}
+
+func cqlQuery(stream uint16, query string, consistency uint16) []byte {
+	body := binary.BigEndian.AppendUint32(nil, uint32(len(query)))
+	body = append(body, query...)
+	body = binary.BigEndian.AppendUint16(body, consistency)
+	return cqlFrame(stream, 0x07, append(body, 0))
+}
+
+func TestCassandraToxicRepliesWithUnavailable(t *testing.T) {
+	toxic := &toxics.CassandraToxic{Keyspace: "^shop$", Table: "^orders$", Error: "Unavailable"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	other := cqlQuery(1, "SELECT * FROM shop.users", 4)
+	input <- &stream.StreamChunk{Data: other}
+	if got := readChunks(output); !bytes.Equal(got, other) {
+		t.Errorf("Expected the unmatched query, got %q", got)
+	}
+	// The server is in the middle of answering it
+	answer := cqlFrame(1, 0x08, []byte{0, 0, 0, 1})
+	answer[0] = 0x84
+	stub.Reply.Write(answer[:5])
+
+	matched := cqlQuery(2, "SELECT * FROM shop.orders WHERE id = 1", 4)
+	input <- &stream.StreamChunk{Data: matched[:5]}
+	input <- &stream.StreamChunk{Data: matched[5:]}
+	if got := readChunks(output); len(got) != 0 {
+		t.Errorf("Expected the matched query to be dropped, got %q", got)
+	}
+	if got := readChunks(replies); !bytes.Equal(got, answer[:5]) {
+		t.Errorf("Expected the error to wait for the end of the frame, got %x", got)
+	}
+
+	message := "request failed by toxiproxy"
+	body := binary.BigEndian.AppendUint32(nil, 0x1000)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(message)))
+	body = append(body, message...)
+	body = append(body, 0, 4, 0, 0, 0, 2, 0, 0, 0, 1)
+	expected := cqlFrame(2, 0x00, body)
+	expected[0] = 0x84
+	stub.Reply.Write(answer[5:])
+	if got := readChunks(replies); !bytes.Equal(got, append(answer[5:], expected...)) {
+		t.Errorf("Expected Unavailable error\n%x, got\n%x", expected, got)
+	}
+	close(input)
+}
+
+func TestCassandraToxicMatchesPreparedStatements(t *testing.T) {
+	toxic := &toxics.CassandraToxic{Table: "^orders$", Error: "WriteTimeout"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	query := "INSERT INTO orders (id) VALUES (?)"
+	use := cqlQuery(1, "USE shop", 1)
+	statement := append(binary.BigEndian.AppendUint32(nil, uint32(len(query))), query...)
+	prepare := cqlFrame(2, 0x09, statement)
+	input <- &stream.StreamChunk{Data: append(use, prepare...)}
+	if got := readChunks(output); !bytes.Equal(got, append(use, prepare...)) {
+		t.Errorf("Expected USE and PREPARE to pass through, got %q", got)
+	}
+
+	id := md5.Sum([]byte("shop" + query))
+	body := append(binary.BigEndian.AppendUint16(nil, uint16(len(id))), id[:]...)
+	input <- &stream.StreamChunk{Data: cqlFrame(3, 0x0A, append(body, 0, 6, 0))}
+
+	reply := readChunks(replies)
+	if len(reply) < 13 || binary.BigEndian.Uint32(reply[9:]) != 0x1100 {
+		t.Fatalf("Expected WriteTimeout error, got %x", reply)
+	}
+	if !bytes.HasSuffix(reply, []byte("\x00\x06SIMPLE")) {
+		t.Errorf("Expected SIMPLE write type, got %x", reply)
+	}
+	if got := readChunks(output); len(got) != 0 {
+		t.Errorf("Expected EXECUTE to be dropped, got %q", got)
+	}
+	close(input)
+}
+
+func TestCassandraToxicPassesThroughOtherVersions(t *testing.T) {
+	toxic := &toxics.CassandraToxic{Error: "Overloaded"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	data := cqlQuery(1, "SELECT * FROM shop.orders", 1)
+	data[0] = 5
+	input <- &stream.StreamChunk{Data: data}
+
+	if got := readChunks(output); !bytes.Equal(got, data) {
+		t.Errorf("Expected data to be passed through, got %q", got)
+	}
+	if got := readChunks(replies); len(got) != 0 {
+		t.Errorf("Expected no reply, got %q", got)
+	}
+	close(input)
+}
@@ -0,0 +1,262 @@
+package toxics
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const (
+	dnsHeaderSize = 12
+
+	dnsResponse  = 0x80
+	dnsTruncated = 0x02
+
+	dnsServFail = 2
+	dnsNXDomain = 3
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+var (
+	errDNSAddress = errors.New("address must be an IPv4 or IPv6 address")
+	errDNSTTL     = errors.New("ttl must be between 0 and 2147483647")
+)
+
+// The DNSToxic parses DNS messages, framed with a length prefix as over TCP,
+// and for queries with a name matching a pattern answers with NXDOMAIN,
+// SERVFAIL or a truncated response, rewrites the address or TTL of the
+// records in the answer, or delays them. Queries are answered on the upstream
+// stream, in place of the resolver and never inside one of its responses.
+// Answers are rewritten on the downstream stream. It is meant for proxies with
+// the dns protocol, which frame UDP datagrams the same way.
+type DNSToxic struct {
+	// Regular expression matched against the lower-cased query name, without
+	// the trailing dot. An empty pattern matches every name.
+	Name string `json:"name"`
+	// What to do with matching queries: nxdomain, servfail or truncate to
+	// answer them on the upstream stream, address or ttl to rewrite their
+	// answers on the downstream stream. If empty, matching messages are only
+	// delayed.
+	Action string `json:"action"`
+	// IPv4 or IPv6 address to put in the A or AAAA records of answers
+	Address string `json:"address"`
+	// TTL in seconds to put in the records of answers
+	TTL int64 `json:"ttl"`
+	// Milliseconds to hold a matching query or answer before acting on it
+	Latency int64 `json:"latency"`
+}
+
+type DNSToxicState struct {
+	buffer      messageBuffer
+	started     bool
+	passthrough bool
+}
+
+// dnsSkipName returns the offset following the domain name at off in msg, or
+// -1 if it is invalid.
+func dnsSkipName(msg []byte, off int) int {
+	for off < len(msg) {
+		switch length := int(msg[off]); {
+		case length == 0:
+			return off + 1
+		case length&0xC0 == 0xC0:
+			// Compression pointer
+			if off+2 > len(msg) {
+				return -1
+			}
+			return off + 2
+		default:
+			off += 1 + length
+		}
+	}
+	return -1
+}
+
+// dnsName reads the domain name at off in msg, following compression
+// pointers.
+func dnsName(msg []byte, off int) (string, bool) {
+	var labels []string
+	for jumps := 0; off < len(msg) && jumps < 16; {
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return strings.ToLower(strings.Join(labels, ".")), true
+		case length&0xC0 == 0xC0:
+			if off+2 > len(msg) {
+				return "", false
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case length&0xC0 != 0 || off+1+length > len(msg):
+			return "", false
+		default:
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+	return "", false
+}
+
+// dnsQuestion returns the name of the only question of msg and the offset
+// following it.
+func dnsQuestion(msg []byte) (string, int, bool) {
+	if len(msg) < dnsHeaderSize || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return "", 0, false
+	}
+	end := dnsSkipName(msg, dnsHeaderSize)
+	if end < 0 || end+4 > len(msg) {
+		return "", 0, false
+	}
+	name, ok := dnsName(msg, dnsHeaderSize)
+	return name, end + 4, ok
+}
+
+func dnsFrame(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+}
+
+func (t *DNSToxic) Validate() error {
+	if err := validatePatterns(t.Name); err != nil {
+		return err
+	}
+	actions := []string{"", "nxdomain", "servfail", "truncate", "address", "ttl"}
+	if err := validateChoice("action", t.Action, actions...); err != nil {
+		return err
+	}
+	if t.Action == "address" && net.ParseIP(t.Address) == nil {
+		return errDNSAddress
+	}
+	if t.TTL < 0 || t.TTL > math.MaxInt32 {
+		return errDNSTTL
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+// reply answers a query with the question only, and the rcode and truncation
+// flag of the action.
+func (t *DNSToxic) reply(query []byte, questionEnd int) []byte {
+	msg := append([]byte{}, query[:questionEnd]...)
+	// Keep the opcode and recursion desired flag
+	msg[2] = dnsResponse | query[2]&0x79
+	msg[3] = 0x80 // Recursion available
+	switch t.Action {
+	case "nxdomain":
+		msg[3] |= dnsNXDomain
+	case "servfail":
+		msg[3] |= dnsServFail
+	case "truncate":
+		msg[2] |= dnsTruncated
+	}
+	// Answer, authority and additional counts
+	clear(msg[6:dnsHeaderSize])
+	return dnsFrame(msg)
+}
+
+// rewrite changes the address or TTL of the records in the answer section of
+// a response, up to the first record that can't be parsed.
+func (t *DNSToxic) rewrite(msg []byte, questionEnd int) {
+	ip := net.ParseIP(t.Address)
+	off := questionEnd
+	for i := binary.BigEndian.Uint16(msg[6:]); i > 0; i-- {
+		off = dnsSkipName(msg, off)
+		if off < 0 || off+10 > len(msg) {
+			return
+		}
+		kind := binary.BigEndian.Uint16(msg[off:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		data := off + 10
+		if data+length > len(msg) {
+			return
+		}
+
+		switch t.Action {
+		case "ttl":
+			binary.BigEndian.PutUint32(msg[off+4:], uint32(max(t.TTL, 0)))
+		case "address":
+			if kind == dnsTypeA && length == net.IPv4len && ip.To4() != nil {
+				copy(msg[data:], ip.To4())
+			} else if kind == dnsTypeAAAA && length == net.IPv6len && ip != nil && ip.To4() == nil {
+				copy(msg[data:], ip)
+			}
+		}
+		off = data + length
+	}
+}
+
+func (t *DNSToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*DNSToxicState)
+	buf := &state.buffer
+
+	name, err := regexp.Compile(t.Name)
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !buf.fill(stub, 2) {
+			return
+		}
+		size := 2 + int(binary.BigEndian.Uint16(buf.data))
+		if !buf.fill(stub, size) {
+			return
+		}
+		if !state.started {
+			// Clients speak first, so the resolver is between responses
+			state.started = true
+			stub.Reply.SetFraming(datagramFramer, nil)
+		}
+		msg := buf.data[2:size]
+		question, questionEnd, ok := dnsQuestion(msg)
+		if !ok || !name.MatchString(question) {
+			buf.forward(stub, size)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		response := msg[2]&dnsResponse != 0
+		switch {
+		case !response && (t.Action == "nxdomain" || t.Action == "servfail" || t.Action == "truncate"):
+			reply := t.reply(msg, questionEnd)
+			buf.discard(size)
+			stub.Reply.Send(reply)
+		case response && (t.Action == "address" || t.Action == "ttl"):
+			frame := buf.next(size)
+			t.rewrite(frame[2:], questionEnd)
+			stub.Output <- &stream.StreamChunk{Data: frame, Timestamp: buf.timestamp}
+		default:
+			buf.forward(stub, size)
+		}
+	}
+}
+
+func (t *DNSToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*DNSToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *DNSToxic) NewState() interface{} {
+	return new(DNSToxicState)
+}
+
+func init() {
+	Register("dns", new(DNSToxic))
+}
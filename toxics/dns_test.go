@@ -0,0 +1,126 @@
+package toxics_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func dnsQuestion(name string) []byte {
+	var question []byte
+	for _, label := range bytes.Split([]byte(name), []byte{'.'}) {
+		question = append(question, byte(len(label)))
+		question = append(question, label...)
+	}
+	// Type A, class IN
+	return append(question, 0, 0, 1, 0, 1)
+}
+
+// dnsMessage builds a length-prefixed DNS message with a single question and
+// the given A records, pointing back to the question name.
+func dnsMessage(id uint16, flags uint16, name string, addresses ...[4]byte) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(addresses)))
+	msg = append(msg, 0, 0, 0, 0)
+	msg = append(msg, dnsQuestion(name)...)
+	for _, address := range addresses {
+		msg = append(msg, 0xC0, 12, 0, 1, 0, 1)
+		msg = binary.BigEndian.AppendUint32(msg, 300)
+		msg = append(msg, 0, 4)
+		msg = append(msg, address[:]...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+}
+
+func TestDNSToxicRepliesNXDomain(t *testing.T) {
+	toxic := &toxics.DNSToxic{Name: `(^|\.)internal\.example$`, Action: "nxdomain"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	other := dnsMessage(1, 0x0100, "www.example")
+	query := dnsMessage(2, 0x0100, "db.Internal.example")
+	data := append(append([]byte{}, other...), query...)
+	input <- &stream.StreamChunk{Data: data[:5]}
+	input <- &stream.StreamChunk{Data: data[5:]}
+
+	if got := readChunks(output); !bytes.Equal(got, other) {
+		t.Errorf("Expected only the other query to be forwarded, got %x", got)
+	}
+	expected := dnsMessage(2, 0x8183, "db.Internal.example")
+	if got := readChunks(replies); !bytes.Equal(got, expected) {
+		t.Errorf("Expected NXDOMAIN %x, got %x", expected, got)
+	}
+	close(input)
+}
+
+func TestDNSToxicRepliesBetweenResponses(t *testing.T) {
+	toxic := &toxics.DNSToxic{Name: `^db\.`, Action: "servfail"}
+	stub, input, _, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	response := dnsMessage(1, 0x8180, "www.example", [4]byte{10, 0, 0, 1})
+	input <- &stream.StreamChunk{Data: dnsMessage(1, 0x0100, "www.example")}
+	stub.Reply.Write(response[:7])
+	input <- &stream.StreamChunk{Data: dnsMessage(2, 0x0100, "db.example")}
+	if got := readChunks(replies); !bytes.Equal(got, response[:7]) {
+		t.Errorf("Expected the reply to wait for the end of the response, got %x", got)
+	}
+	stub.Reply.Write(response[7:])
+	expected := append(response[7:], dnsMessage(2, 0x8182, "db.example")...)
+	if got := readChunks(replies); !bytes.Equal(got, expected) {
+		t.Errorf("Expected SERVFAIL %x after the response, got %x", expected, got)
+	}
+	close(input)
+}
+
+func TestDNSToxicTruncates(t *testing.T) {
+	toxic := &toxics.DNSToxic{Action: "truncate"}
+	stub, input, _, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: dnsMessage(7, 0x0100, "example.com")}
+
+	expected := dnsMessage(7, 0x8380, "example.com")
+	if got := readChunks(replies); !bytes.Equal(got, expected) {
+		t.Errorf("Expected truncated response %x, got %x", expected, got)
+	}
+	close(input)
+}
+
+func TestDNSToxicRewritesAnswers(t *testing.T) {
+	toxic := &toxics.DNSToxic{Name: "^api\\.", Action: "address", Address: "192.0.2.1"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	answer := dnsMessage(3, 0x8180, "api.example.com", [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2})
+	input <- &stream.StreamChunk{Data: answer}
+	input <- &stream.StreamChunk{Data: dnsMessage(4, 0x8180, "www.example.com", [4]byte{10, 0, 0, 3})}
+
+	expected := append(
+		dnsMessage(3, 0x8180, "api.example.com", [4]byte{192, 0, 2, 1}, [4]byte{192, 0, 2, 1}),
+		dnsMessage(4, 0x8180, "www.example.com", [4]byte{10, 0, 0, 3})...,
+	)
+	if got := readChunks(output); !bytes.Equal(got, expected) {
+		t.Errorf("Expected %x, got %x", expected, got)
+	}
+	close(input)
+}
+
+func TestDNSToxicRewritesTTL(t *testing.T) {
+	toxic := &toxics.DNSToxic{Action: "ttl", TTL: 5}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: dnsMessage(5, 0x8180, "example.com", [4]byte{10, 0, 0, 1})}
+
+	got := readChunks(output)
+	if len(got) < 4 || binary.BigEndian.Uint32(got[len(got)-10:]) != 5 {
+		t.Errorf("Expected a TTL of 5, got %x", got)
+	}
+	close(input)
+}
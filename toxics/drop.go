@@ -0,0 +1,71 @@
+package toxics
+
+import "github.com/Shopify/toxiproxy/v2/stream"
+
+// The DropToxic splits the stream into messages with a framing and drops every
+// Nth message. Once the stream can't be framed anymore, the rest of it flows
+// through.
+type DropToxic struct {
+	// Framing of messages, see stream.ParseFraming
+	Framing string `json:"framing"`
+	// Drop every Nth message
+	Every int64 `json:"every,omitempty"`
+}
+
+type DropToxicState struct {
+	buffer messageBuffer
+	// Messages read so far
+	messages int64
+	// The stream couldn't be framed
+	unframed bool
+}
+
+func (t *DropToxic) Validate() error {
+	if t.Framing == "" {
+		// Only whole messages are dropped
+		return stream.ErrInvalidFraming
+	}
+	return validateFraming(t.Framing, t.Every)
+}
+
+func (t *DropToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*DropToxicState)
+	buf := &state.buffer
+
+	framer, err := stream.ParseFraming(t.Framing)
+	for {
+		if state.unframed || err != nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		size, ok := buf.message(stub, framer)
+		if !ok {
+			return
+		}
+		if size < 0 {
+			state.unframed = true
+			continue
+		}
+		state.messages++
+		if nth(state.messages, t.Every) {
+			buf.discard(size)
+		} else {
+			buf.forward(stub, size)
+		}
+	}
+}
+
+func (t *DropToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*DropToxicState)
+	state.buffer.flush(stub)
+}
+
+func (t *DropToxic) NewState() interface{} {
+	return new(DropToxicState)
+}
+
+func init() {
+	Register("drop", &DropToxic{Every: 1})
+}
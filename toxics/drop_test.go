@@ -0,0 +1,47 @@
+package toxics_test
+
+import (
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func NewFramedStub(toxic toxics.StatefulToxic) (
+	*toxics.ToxicStub, chan *stream.StreamChunk, chan *stream.StreamChunk,
+) {
+	input := make(chan *stream.StreamChunk)
+	output := make(chan *stream.StreamChunk, 100)
+	stub := toxics.NewToxicStub(input, output)
+	stub.State = toxic.NewState()
+	return stub, input, output
+}
+
+func TestDropToxicDropsEveryNthMessage(t *testing.T) {
+	toxic := &toxics.DropToxic{Framing: "uint16", Every: 2}
+	stub, input, output := NewFramedStub(toxic)
+	go toxic.Pipe(stub)
+
+	data := "\x00\x01a\x00\x02bb\x00\x03ccc\x00\x00\x00\x01e"
+	input <- &stream.StreamChunk{Data: []byte(data[:4])}
+	input <- &stream.StreamChunk{Data: []byte(data[4:])}
+
+	if got := readChunks(output); string(got) != "\x00\x01a\x00\x03ccc\x00\x01e" {
+		t.Errorf("Expected every second message to be dropped, got %q", got)
+	}
+	close(input)
+}
+
+func TestDropToxicPassesThroughUnframedStreams(t *testing.T) {
+	toxic := &toxics.DropToxic{Framing: "uint32"}
+	stub, input, output := NewFramedStub(toxic)
+	go toxic.Pipe(stub)
+
+	data := "GET / HTTP/1.1\r\n\r\n"
+	input <- &stream.StreamChunk{Data: []byte(data)}
+
+	if got := readChunks(output); string(got) != data {
+		t.Errorf("Expected %q, got %q", data, got)
+	}
+	close(input)
+}
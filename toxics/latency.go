@@ -3,13 +3,29 @@ package toxics
 import (
 	"math/rand"
 	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
 )
 
 // The LatencyToxic passes data through with the a delay of latency +/- jitter added.
+// With a framing, only every Nth whole message is delayed.
 type LatencyToxic struct {
 	// Times in milliseconds
 	Latency int64 `json:"latency"`
 	Jitter  int64 `json:"jitter"`
+	// Framing of messages, see stream.ParseFraming. If empty, every chunk of
+	// data is delayed.
+	Framing string `json:"framing"`
+	// Delay every Nth message
+	Every int64 `json:"every,omitempty"`
+}
+
+type LatencyToxicState struct {
+	buffer messageBuffer
+	// Messages forwarded so far
+	messages int64
+	// The stream couldn't be framed
+	unframed bool
 }
 
 func (t *LatencyToxic) GetBufferSize() int {
@@ -27,7 +43,17 @@ func (t *LatencyToxic) delay() time.Duration {
 	return time.Duration(delay) * time.Millisecond
 }
 
+func (t *LatencyToxic) Validate() error {
+	return validateFraming(t.Framing, t.Every)
+}
+
 func (t *LatencyToxic) Pipe(stub *ToxicStub) {
+	if framer, err := stream.ParseFraming(t.Framing); err == nil {
+		if !t.pipeMessages(stub, framer) {
+			return
+		}
+	}
+
 	for {
 		select {
 		case <-stub.Interrupt:
@@ -51,6 +77,44 @@ func (t *LatencyToxic) Pipe(stub *ToxicStub) {
 	}
 }
 
+// pipeMessages delays every Nth message framed by framer. It returns true if
+// the stream can't be framed and chunks should be delayed instead.
+func (t *LatencyToxic) pipeMessages(stub *ToxicStub, framer stream.Framer) bool {
+	state := stub.State.(*LatencyToxicState)
+	buf := &state.buffer
+	for !state.unframed {
+		size, ok := buf.message(stub, framer)
+		if !ok {
+			return false
+		}
+		if size < 0 {
+			state.unframed = true
+			break
+		}
+		if nth(state.messages+1, t.Every) {
+			delay := t.delay() - time.Since(buf.timestamp)
+			if !sleep(stub, delay) {
+				return false
+			}
+			buf.timestamp = buf.timestamp.Add(max(delay, 0))
+		}
+		buf.forward(stub, size)
+		state.messages++
+	}
+	buf.flush(stub)
+	return true
+}
+
+func (t *LatencyToxic) Cleanup(stub *ToxicStub) {
+	if state, ok := stub.State.(*LatencyToxicState); ok {
+		state.buffer.flush(stub)
+	}
+}
+
+func (t *LatencyToxic) NewState() interface{} {
+	return new(LatencyToxicState)
+}
+
 func init() {
-	Register("latency", new(LatencyToxic))
+	Register("latency", &LatencyToxic{Every: 1})
 }
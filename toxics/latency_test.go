@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/Shopify/toxiproxy/v2"
+	"github.com/Shopify/toxiproxy/v2/stream"
 	"github.com/Shopify/toxiproxy/v2/testhelper"
 	"github.com/Shopify/toxiproxy/v2/toxics"
 )
@@ -270,3 +271,27 @@ func TestLatencyToxicBandwidth(t *testing.T) {
 		t.Error("Failed to close TCP connection", err)
 	}
 }
+
+func TestLatencyToxicFraming(t *testing.T) {
+	toxic := &toxics.LatencyToxic{Latency: 100, Framing: "line", Every: 2}
+	stub, input, output := NewFramedStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := time.Now()
+	input <- &stream.StreamChunk{Data: []byte("first\nsec"), Timestamp: start}
+	if c := <-output; string(c.Data) != "first\n" {
+		t.Errorf("Expected the first message, got %q", c.Data)
+	}
+	AssertDeltaTime(t, "First message", time.Since(start), 0, 20*time.Millisecond)
+
+	input <- &stream.StreamChunk{Data: []byte("ond\nthird\n"), Timestamp: time.Now()}
+	if c := <-output; string(c.Data) != "second\n" {
+		t.Errorf("Expected the second message, got %q", c.Data)
+	}
+	AssertDeltaTime(t, "Second message", time.Since(start), 100*time.Millisecond, 20*time.Millisecond)
+	if c := <-output; string(c.Data) != "third\n" {
+		t.Errorf("Expected the third message, got %q", c.Data)
+	}
+	AssertDeltaTime(t, "Third message", time.Since(start), 100*time.Millisecond, 20*time.Millisecond)
+	close(input)
+}
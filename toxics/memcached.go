@@ -0,0 +1,311 @@
+package toxics
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const (
+	memcachedMaxLineSize = 8192
+
+	// Magic byte of binary protocol requests
+	memcachedBinaryRequest = 0x80
+)
+
+var errMemcachedErrorMessage = errors.New("error_message can't contain line breaks")
+
+// The MemcachedToxic acts on the text and meta protocol commands with a key
+// matching a pattern: retrievals can be made to miss, commands can be failed
+// with a SERVER_ERROR, or slowed down. It reads the commands clients send, so
+// it is added upstream, and it ignores binary protocol connections. Its
+// replies come after the server's replies to the commands pipelined before.
+type MemcachedToxic struct {
+	// Regular expression matched against the keys of each command. An empty
+	// pattern matches every command.
+	Key string `json:"key"`
+	// What to do with matching commands: "miss" to make retrievals miss,
+	// "error" to reply with a SERVER_ERROR. If empty, matching commands are
+	// only delayed.
+	Action       string `json:"action"`
+	ErrorMessage string `json:"error_message"`
+	// Milliseconds to wait before a matching command is handled
+	Latency int64 `json:"latency"`
+}
+
+type MemcachedToxicState struct {
+	buffer      messageBuffer
+	passthrough bool
+}
+
+// memcachedCommand is a parsed memcached command.
+type memcachedCommand struct {
+	name string
+	args [][]byte
+	keys [][]byte
+	size int
+	// The client expects no reply at all
+	noreply bool
+	// The client only expects a reply to a meta command that fails
+	quiet bool
+}
+
+// parseMemcachedCommand parses a command from the start of data, returning
+// false if it is incomplete. Its size is -1 if data isn't a valid command.
+func parseMemcachedCommand(data []byte) (*memcachedCommand, bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		if len(data) > memcachedMaxLineSize {
+			return &memcachedCommand{size: -1}, true
+		}
+		return nil, false
+	}
+	fields := bytes.Fields(data[:i])
+	cmd := &memcachedCommand{size: i + 1}
+	if len(fields) == 0 {
+		return cmd, true
+	}
+	cmd.name = string(bytes.ToLower(fields[0]))
+	cmd.args = fields[1:]
+
+	dataLength := -1
+	switch cmd.name {
+	case "get", "gets":
+		cmd.keys = cmd.args
+	case "gat", "gats":
+		if len(cmd.args) > 0 {
+			cmd.keys = cmd.args[1:]
+		}
+	case "set", "add", "replace", "append", "prepend", "cas":
+		if len(cmd.args) < 4 {
+			return cmd, true
+		}
+		cmd.keys = cmd.args[:1]
+		dataLength, _ = strconv.Atoi(string(cmd.args[3]))
+	case "ms":
+		if len(cmd.args) < 2 {
+			return cmd, true
+		}
+		cmd.keys = cmd.args[:1]
+		dataLength, _ = strconv.Atoi(string(cmd.args[1]))
+		cmd.quiet = memcachedQuiet(cmd.args[2:])
+	case "delete", "incr", "decr", "touch":
+		if len(cmd.args) > 0 {
+			cmd.keys = cmd.args[:1]
+		}
+	case "mg", "md", "ma":
+		if len(cmd.args) > 0 {
+			cmd.keys = cmd.args[:1]
+			cmd.quiet = memcachedQuiet(cmd.args[1:])
+		}
+	}
+	if cmd.name[0] != 'g' && len(cmd.args) > 0 {
+		cmd.noreply = string(cmd.args[len(cmd.args)-1]) == "noreply"
+	}
+
+	if dataLength >= 0 {
+		cmd.size += dataLength + 2
+		if len(data) < cmd.size {
+			return nil, false
+		}
+	}
+	return cmd, true
+}
+
+func memcachedQuiet(flags [][]byte) bool {
+	for _, flag := range flags {
+		if string(flag) == "q" {
+			return true
+		}
+	}
+	return false
+}
+
+// answered reports whether the server answers the command when it succeeds.
+func (cmd *memcachedCommand) answered() bool {
+	switch cmd.name {
+	case "", "quit", "shutdown", "watch":
+		return false
+	}
+	return !cmd.noreply && !cmd.quiet
+}
+
+// memcachedFramer frames the replies of the text and meta protocols: lines,
+// followed by a data block for VALUE and VA.
+type memcachedFramer struct{}
+
+func (memcachedFramer) Frame(data []byte) (int, error) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		if len(data) > memcachedMaxLineSize {
+			return 0, stream.ErrMessageTooLarge
+		}
+		return 0, nil
+	}
+	size := i + 1
+	fields := bytes.Fields(data[:i])
+	var length []byte
+	switch {
+	case len(fields) >= 4 && string(fields[0]) == "VALUE":
+		length = fields[3]
+	case len(fields) >= 2 && string(fields[0]) == "VA":
+		length = fields[1]
+	default:
+		return size, nil
+	}
+	n, err := strconv.Atoi(string(length))
+	if err != nil || n < 0 || n > stream.MaxMessageSize {
+		return 0, stream.ErrInvalidFraming
+	}
+	size += n + 2
+	if len(data) < size {
+		return 0, nil
+	}
+	return size, nil
+}
+
+// memcachedAnswer reports whether a reply ends the answer to a command,
+// unlike the values and statistics listed before END.
+func memcachedAnswer(reply []byte) bool {
+	return !bytes.HasPrefix(reply, []byte("VALUE ")) && !bytes.HasPrefix(reply, []byte("STAT "))
+}
+
+func (t *MemcachedToxic) Validate() error {
+	if err := validatePatterns(t.Key); err != nil {
+		return err
+	}
+	if err := validateChoice("action", t.Action, "", "miss", "error"); err != nil {
+		return err
+	}
+	if strings.ContainsAny(t.ErrorMessage, "\r\n") {
+		return errMemcachedErrorMessage
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+func (t *MemcachedToxic) errorReply() []byte {
+	message := t.ErrorMessage
+	if message == "" {
+		message = "out of memory"
+	}
+	return []byte("SERVER_ERROR " + message + "\r\n")
+}
+
+func (t *MemcachedToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*MemcachedToxicState)
+	buf := &state.buffer
+
+	key, err := regexp.Compile(t.Key)
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !buf.fill(stub, 1) {
+			return
+		}
+		if buf.data[0] == memcachedBinaryRequest {
+			state.passthrough = true
+			continue
+		}
+		cmd, ok := parseMemcachedCommand(buf.data)
+		if !ok {
+			if !buf.fill(stub, len(buf.data)+1) {
+				return
+			}
+			continue
+		}
+		if cmd.size < 0 {
+			state.passthrough = true
+			continue
+		}
+		// The server doesn't speak first, so it is between replies
+		stub.Reply.SetFraming(memcachedFramer{}, memcachedAnswer)
+
+		var matched, kept [][]byte
+		for _, k := range cmd.keys {
+			if key.Match(k) {
+				matched = append(matched, k)
+			} else {
+				kept = append(kept, k)
+			}
+		}
+		if len(matched) == 0 {
+			t.forward(stub, cmd)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		switch {
+		case t.Action == "error":
+			buf.discard(cmd.size)
+			if !cmd.noreply {
+				stub.Reply.Send(t.errorReply())
+			}
+		case t.Action == "miss" && cmd.name == "mg":
+			buf.discard(cmd.size)
+			if !cmd.quiet {
+				stub.Reply.Send([]byte("EN\r\n"))
+			}
+		case t.Action == "miss" && cmd.name[0] == 'g':
+			buf.discard(cmd.size)
+			if len(kept) == 0 {
+				stub.Reply.Send([]byte("END\r\n"))
+				continue
+			}
+			// Only ask the server for the keys that didn't match
+			line := []byte(cmd.name)
+			if cmd.name == "gat" || cmd.name == "gats" {
+				line = append(append(line, ' '), cmd.args[0]...)
+			}
+			for _, k := range kept {
+				line = append(append(line, ' '), k...)
+			}
+			stub.Reply.Forwarded()
+			stub.Output <- &stream.StreamChunk{
+				Data:      append(line, "\r\n"...),
+				Timestamp: buf.timestamp,
+			}
+		default:
+			t.forward(stub, cmd)
+		}
+	}
+}
+
+// forward sends a command on to the server, counting it if the server will
+// answer it.
+func (t *MemcachedToxic) forward(stub *ToxicStub, cmd *memcachedCommand) {
+	if cmd.answered() {
+		stub.Reply.Forwarded()
+	}
+	stub.State.(*MemcachedToxicState).buffer.forward(stub, cmd.size)
+}
+
+func (t *MemcachedToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*MemcachedToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *MemcachedToxic) NewState() interface{} {
+	return new(MemcachedToxicState)
+}
+
+func init() {
+	Register("memcached", new(MemcachedToxic))
+}
@@ -0,0 +1,109 @@
+package toxics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func TestMemcachedToxicMissesMatchingKeys(t *testing.T) {
+	toxic := &toxics.MemcachedToxic{Key: "^session:", Action: "miss"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	commands := "get session:1 user:1\r\nget session:2\r\nmg session:3 v\r\n"
+	input <- &stream.StreamChunk{Data: []byte(commands)}
+
+	if got := readChunks(output); string(got) != "get user:1\r\n" {
+		t.Errorf("Expected only the unmatched key to be requested, got %q", got)
+	}
+	stub.Reply.Write([]byte("END\r\n"))
+	if got := readChunks(replies); string(got) != "END\r\nEND\r\nEN\r\n" {
+		t.Errorf("Expected misses after the answer, got %q", got)
+	}
+	close(input)
+}
+
+func TestMemcachedToxicMissesWaitForPipelinedValues(t *testing.T) {
+	toxic := &toxics.MemcachedToxic{Key: "^session:", Action: "miss"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	unmatched := "set user:1 0 0 1 noreply\r\nx\r\nget user:1\r\n"
+	input <- &stream.StreamChunk{Data: []byte(unmatched + "get session:1\r\n")}
+	if got := readChunks(output); string(got) != unmatched {
+		t.Errorf("Expected the unmatched commands, got %q", got)
+	}
+	// A value holding what looks like the end of an answer, in two writes
+	stub.Reply.Write([]byte("VALUE user:1 0 5\r\nEN"))
+	stub.Reply.Write([]byte("D\r\n\r\n"))
+	if got := readChunks(replies); string(got) != "VALUE user:1 0 5\r\nEND\r\n\r\n" {
+		t.Errorf("Expected the miss to wait for the end of the answer, got %q", got)
+	}
+	stub.Reply.Write([]byte("END\r\n"))
+	if got := readChunks(replies); string(got) != "END\r\nEND\r\n" {
+		t.Errorf("Expected the miss after the answer, got %q", got)
+	}
+	close(input)
+}
+
+func TestMemcachedToxicRepliesWithServerError(t *testing.T) {
+	toxic := &toxics.MemcachedToxic{Key: "^cache:", Action: "error"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	data := "set cache:1 0 0 5\r\nhe"
+	input <- &stream.StreamChunk{Data: []byte(data)}
+	data = "llo\r\nset cache:2 0 0 1 noreply\r\nx\r\nset other 0 0 1\r\ny\r\n"
+	input <- &stream.StreamChunk{Data: []byte(data)}
+
+	if got := readChunks(output); string(got) != "set other 0 0 1\r\ny\r\n" {
+		t.Errorf("Expected only the unmatched command, got %q", got)
+	}
+	if got := readChunks(replies); string(got) != "SERVER_ERROR out of memory\r\n" {
+		t.Errorf("Expected a single SERVER_ERROR, got %q", got)
+	}
+	close(input)
+}
+
+func TestMemcachedToxicDelaysMatchingKeys(t *testing.T) {
+	toxic := &toxics.MemcachedToxic{Key: "^slow$", Latency: 100}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := time.Now()
+	input <- &stream.StreamChunk{Data: []byte("get fast\r\n")}
+	<-output
+	AssertDeltaTime(t, "Unmatched command", time.Since(start), 0, 20*time.Millisecond)
+
+	start = time.Now()
+	input <- &stream.StreamChunk{Data: []byte("get slow\r\n")}
+	<-output
+	AssertDeltaTime(
+		t,
+		"Matched command",
+		time.Since(start),
+		100*time.Millisecond,
+		20*time.Millisecond,
+	)
+	close(input)
+}
+
+func TestMemcachedToxicPassesThroughBinaryProtocol(t *testing.T) {
+	toxic := &toxics.MemcachedToxic{Action: "error"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	data := []byte{0x80, 0x00, 0x00, 0x03, 'f', 'o', 'o', '\n'}
+	input <- &stream.StreamChunk{Data: data}
+
+	if got := readChunks(output); string(got) != string(data) {
+		t.Errorf("Expected data to be passed through, got %q", got)
+	}
+	if got := readChunks(replies); len(got) != 0 {
+		t.Errorf("Expected no reply, got %q", got)
+	}
+	close(input)
+}
@@ -0,0 +1,213 @@
+package toxics
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+var (
+	errEvery   = errors.New("every must be at least 1")
+	errLatency = errors.New("latency can't be negative")
+)
+
+// messageBuffer collects StreamChunks from a ToxicStub until a whole protocol
+// message can be inspected. Protocol-aware toxics keep it in their state so a
+// partially read message survives the toxic being interrupted.
+type messageBuffer struct {
+	data      []byte
+	timestamp time.Time
+	// Number of upcoming bytes to pass through without buffering them.
+	skip int
+	// Number of buffered bytes a ResumableFramer found no message in
+	scanned int
+}
+
+// fill reads from stub.Input until at least n bytes are buffered, passing
+// through any skipped bytes on the way. It returns false if the toxic was
+// interrupted or the input was closed, in which case the remaining data is
+// flushed and the stub is closed.
+func (b *messageBuffer) fill(stub *ToxicStub, n int) bool {
+	ok, _ := b.fillBefore(stub, n, nil)
+	return ok
+}
+
+// fillBefore is like fill, but also returns once timeout fires, with
+// timedOut set.
+func (b *messageBuffer) fillBefore(
+	stub *ToxicStub,
+	n int,
+	timeout <-chan time.Time,
+) (ok, timedOut bool) {
+	for {
+		if b.skip > 0 && len(b.data) > 0 {
+			k := min(b.skip, len(b.data))
+			b.forward(stub, k)
+			b.skip -= k
+		}
+		if b.skip == 0 && len(b.data) >= n {
+			return true, false
+		}
+
+		select {
+		case <-stub.Interrupt:
+			return false, false
+		case <-timeout:
+			return true, true
+		case c := <-stub.Input:
+			if c == nil {
+				b.flush(stub)
+				stub.Close()
+				return false, false
+			}
+			if len(b.data) == 0 {
+				b.timestamp = c.Timestamp
+			}
+			b.data = append(b.data, c.Data...)
+		}
+	}
+}
+
+// pass lets the next n bytes of the stream through, without waiting for all
+// of them to arrive.
+func (b *messageBuffer) pass(n int) {
+	b.skip += n
+}
+
+// forward writes the first n buffered bytes to stub.Output.
+func (b *messageBuffer) forward(stub *ToxicStub, n int) {
+	if n == 0 {
+		return
+	}
+	stub.Output <- &stream.StreamChunk{
+		Data:      b.next(n),
+		Timestamp: b.timestamp,
+	}
+}
+
+// discard drops the first n buffered bytes.
+func (b *messageBuffer) discard(n int) {
+	b.next(n)
+}
+
+// next removes the first n bytes from the buffer and returns them.
+func (b *messageBuffer) next(n int) []byte {
+	data := make([]byte, n)
+	copy(data, b.data)
+	b.data = b.data[n:]
+	b.scanned = 0
+	return data
+}
+
+// message reads from stub.Input until a whole message framed by framer is
+// buffered, returning its size. It returns false if the toxic was interrupted
+// or the input was closed, and a size of -1 if the stream can't be framed.
+func (b *messageBuffer) message(stub *ToxicStub, framer stream.Framer) (int, bool) {
+	resumable, _ := framer.(stream.ResumableFramer)
+	for {
+		var size int
+		var err error
+		if resumable != nil {
+			size, err = resumable.Resume(b.data, b.scanned)
+		} else {
+			size, err = framer.Frame(b.data)
+		}
+		if err != nil {
+			return -1, true
+		}
+		if size > 0 {
+			return size, true
+		}
+		b.scanned = len(b.data)
+		if !b.fill(stub, len(b.data)+1) {
+			return 0, false
+		}
+	}
+}
+
+// datagramFramer frames the UDP datagrams of proxies with the udp and dns
+// protocols, which carry a 2-byte big-endian length prefix.
+var datagramFramer = stream.LengthPrefixFramer{Size: 2, Order: binary.BigEndian}
+
+// datagram reads from stub.Input until a whole datagram is buffered, returning
+// its size including the length prefix, or 0 if timeout fired first. It
+// returns false if the toxic was interrupted or the input was closed.
+func (b *messageBuffer) datagram(stub *ToxicStub, timeout <-chan time.Time) (int, bool) {
+	for {
+		if size, _ := datagramFramer.Frame(b.data); size > 0 {
+			return size, true
+		}
+		ok, timedOut := b.fillBefore(stub, len(b.data)+1, timeout)
+		if !ok {
+			return 0, false
+		}
+		if timedOut {
+			return 0, true
+		}
+	}
+}
+
+// validateFraming checks the framing and every attributes of the toxics that
+// act on every Nth message, where an empty framing acts on chunks of data.
+func validateFraming(framing string, every int64) error {
+	if framing != "" {
+		if _, err := stream.ParseFraming(framing); err != nil {
+			return err
+		}
+	}
+	if every < 1 {
+		return errEvery
+	}
+	return nil
+}
+
+// validatePatterns checks that the regular expressions a protocol toxic
+// matches messages with compile.
+func validatePatterns(patterns ...string) error {
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateChoice checks that the named attribute is one of the documented
+// values.
+func validateChoice(name, value string, choices ...string) error {
+	if !slices.Contains(choices, value) {
+		return fmt.Errorf("%s must be one of %s", name, strings.Join(choices, ", "))
+	}
+	return nil
+}
+
+// nth returns whether the message counted as n is one of every nth message.
+func nth(n, every int64) bool {
+	return every <= 1 || n%every == 0
+}
+
+// flush writes everything that is buffered to stub.Output.
+func (b *messageBuffer) flush(stub *ToxicStub) {
+	b.forward(stub, len(b.data))
+	b.skip = 0
+}
+
+// sleep waits for the given duration unless the toxic is interrupted first,
+// returning false on interrupt.
+func sleep(stub *ToxicStub, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-stub.Interrupt:
+		return false
+	}
+}
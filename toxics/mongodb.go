@@ -0,0 +1,296 @@
+package toxics
+
+import (
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/internal/bson"
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const (
+	mongoOpQuery = 2004
+	mongoOpMsg   = 2013
+
+	mongoChecksumPresent = 1 << 0
+	mongoMoreToCome      = 1 << 1
+
+	mongoMaxMessageSize = 48 * 1000 * 1000
+)
+
+var (
+	errMongoErrorCode = errors.New("error_code must be positive")
+	errMongoError     = errors.New("error_code is required for unknown error names")
+)
+
+var mongoErrors = map[string]int32{
+	"HostUnreachable":                 6,
+	"MaxTimeMSExpired":                50,
+	"NetworkTimeout":                  89,
+	"ShutdownInProgress":              91,
+	"WriteConflict":                   112,
+	"PrimarySteppedDown":              189,
+	"ExceededTimeLimit":               262,
+	"NotWritablePrimary":              10107,
+	"InterruptedAtShutdown":           11600,
+	"InterruptedDueToReplStateChange": 11602,
+	"NotPrimaryNoSecondaryOk":         13435,
+	"NotPrimaryOrSecondary":           13436,
+}
+
+// Error codes that make a write retryable, which the server reports with the
+// RetryableWriteError label.
+var mongoRetryableWriteErrors = map[int32]bool{
+	6: true, 7: true, 89: true, 91: true, 189: true, 262: true, 9001: true,
+	10107: true, 11600: true, 11602: true, 13435: true, 13436: true,
+}
+
+// The MongoDBToxic fails the commands matching a command name and collection
+// pattern with an error document, or makes them slower. It reads the OP_MSG
+// messages drivers send, so it goes on the upstream stream, and lets
+// compressed messages and legacy opcodes through as they are.
+type MongoDBToxic struct {
+	// Regular expression matched against the command name, e.g. "^insert$"
+	Command string `json:"command"`
+	// Regular expression matched against the collection the command runs on
+	Collection string `json:"collection"`
+	// Error code name to reply with, e.g. NotWritablePrimary,
+	// InterruptedAtShutdown or ExceededTimeLimit. If empty, matching commands
+	// are only delayed.
+	Error string `json:"error"`
+	// Numeric error code, required for error names the toxic doesn't know
+	ErrorCode    int32  `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+	// How long, in milliseconds, a matching command waits before it is sent or
+	// failed
+	Latency int64 `json:"latency"`
+}
+
+type MongoDBToxicState struct {
+	buffer      messageBuffer
+	passthrough bool
+}
+
+func (t *MongoDBToxic) Validate() error {
+	if err := validatePatterns(t.Command, t.Collection); err != nil {
+		return err
+	}
+	if t.ErrorCode < 0 {
+		return errMongoErrorCode
+	}
+	if _, ok := mongoErrors[t.Error]; t.Error != "" && !ok && t.ErrorCode == 0 {
+		return errMongoError
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+func (t *MongoDBToxic) errorReply(requestID int32, retryableWrite bool) []byte {
+	code := t.ErrorCode
+	if code == 0 {
+		code = mongoErrors[t.Error]
+	}
+	message := t.ErrorMessage
+	if message == "" {
+		message = "command failed by toxiproxy"
+	}
+
+	var doc []byte
+	doc = bson.AppendDouble(doc, "ok", 0)
+	doc = bson.AppendString(doc, "errmsg", message)
+	doc = bson.AppendInt32(doc, "code", code)
+	doc = bson.AppendString(doc, "codeName", t.Error)
+	if retryableWrite && mongoRetryableWriteErrors[code] {
+		labels := bson.AppendString(nil, "0", "RetryableWriteError")
+		doc = bson.AppendDocument(doc, bson.Array, "errorLabels", labels)
+	}
+	body := bson.NewDocument(doc)
+
+	// messageLength, requestID, responseTo, opCode, flagBits, section kind 0
+	msg := make([]byte, 21, 21+len(body))
+	binary.LittleEndian.PutUint32(msg[0:], uint32(21+len(body)))
+	binary.LittleEndian.PutUint32(msg[8:], uint32(requestID))
+	binary.LittleEndian.PutUint32(msg[12:], mongoOpMsg)
+	return append(msg, body...)
+}
+
+// mongoFramer frames wire protocol messages, which start with their length.
+type mongoFramer struct{}
+
+func (mongoFramer) Frame(data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, nil
+	}
+	size := int(int32(binary.LittleEndian.Uint32(data)))
+	if size < 16 || size > mongoMaxMessageSize {
+		return 0, stream.ErrInvalidFraming
+	}
+	if len(data) < size {
+		return 0, nil
+	}
+	return size, nil
+}
+
+// mongoLastReply reports whether a reply is the last one to a request, unlike
+// the replies of exhaust cursors and streaming hello that more will follow.
+func mongoLastReply(msg []byte) bool {
+	if binary.LittleEndian.Uint32(msg[12:]) != mongoOpMsg || len(msg) < 20 {
+		return true
+	}
+	return binary.LittleEndian.Uint32(msg[16:])&mongoMoreToCome == 0
+}
+
+// mongoCommand returns the body document of an OP_MSG, or nil if there is
+// none.
+func mongoCommand(msg []byte) []byte {
+	flags := binary.LittleEndian.Uint32(msg[16:])
+	sections := msg[20:]
+	if flags&mongoChecksumPresent != 0 {
+		if len(sections) < 4 {
+			return nil
+		}
+		sections = sections[:len(sections)-4]
+	}
+	for len(sections) > 5 {
+		kind := sections[0]
+		size := int(binary.LittleEndian.Uint32(sections[1:]))
+		if size < 5 || size > len(sections)-1 {
+			return nil
+		}
+		if kind == 0 {
+			return sections[1 : 1+size]
+		}
+		// Document sequence
+		sections = sections[1+size:]
+	}
+	return nil
+}
+
+func (t *MongoDBToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*MongoDBToxicState)
+	buf := &state.buffer
+
+	var collection *regexp.Regexp
+	command, err := regexp.Compile(t.Command)
+	if err == nil {
+		collection, err = regexp.Compile(t.Collection)
+	}
+	if stub.Reply != nil {
+		stub.Reply.SetFraming(mongoFramer{}, mongoLastReply)
+	}
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !buf.fill(stub, 16) {
+			return
+		}
+		size := int(int32(binary.LittleEndian.Uint32(buf.data)))
+		if size < 16 || size > mongoMaxMessageSize {
+			state.passthrough = true
+			continue
+		}
+		if opCode := binary.LittleEndian.Uint32(buf.data[12:]); opCode != mongoOpMsg || size < 21 {
+			// Compressed messages may not be answered
+			if opCode == mongoOpQuery {
+				stub.Reply.Forwarded()
+			}
+			buf.pass(size)
+			continue
+		}
+
+		if !buf.fill(stub, size) {
+			return
+		}
+		msg := buf.data[:size]
+		requestID := int32(binary.LittleEndian.Uint32(msg[4:]))
+		answered := binary.LittleEndian.Uint32(msg[16:])&mongoMoreToCome == 0
+		body := mongoCommand(msg)
+		if body == nil {
+			t.forward(stub, size, answered)
+			continue
+		}
+
+		name, target, retryableWrite := mongoCommandTarget(body)
+		if !command.MatchString(name) || !collection.MatchString(target) {
+			t.forward(stub, size, answered)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		if t.Error == "" && t.ErrorCode == 0 {
+			t.forward(stub, size, answered)
+			continue
+		}
+		buf.discard(size)
+		if answered {
+			stub.Reply.Send(t.errorReply(requestID, retryableWrite))
+		}
+	}
+}
+
+// forward sends a message on to the server, counting it if the server will
+// answer it.
+func (t *MongoDBToxic) forward(stub *ToxicStub, size int, answered bool) {
+	if answered {
+		stub.Reply.Forwarded()
+	}
+	stub.State.(*MongoDBToxicState).buffer.forward(stub, size)
+}
+
+// mongoCommandTarget returns the name of a command, the collection it runs
+// on, and whether it is a retryable write. Writes in a transaction aren't
+// retried on their own, the whole transaction is.
+func mongoCommandTarget(body []byte) (name, collection string, retryableWrite bool) {
+	var txnNumber, transaction bool
+	first := true
+	bson.ForEachElement(body, func(key string, kind byte, _, value []byte) {
+		if first {
+			first = false
+			name = key
+			if kind == bson.String {
+				collection = bson.StringValue(value)
+			}
+		}
+		switch key {
+		case "collection":
+			// getMore
+			if kind == bson.String && collection == "" {
+				collection = bson.StringValue(value)
+			}
+		case "txnNumber":
+			txnNumber = true
+		case "startTransaction":
+			transaction = true
+		case "autocommit":
+			transaction = transaction || kind == bson.Boolean && len(value) == 1 && value[0] == 0
+		}
+	})
+	return name, collection, txnNumber && !transaction
+}
+
+func (t *MongoDBToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*MongoDBToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *MongoDBToxic) NewState() interface{} {
+	return new(MongoDBToxicState)
+}
+
+func init() {
+	Register("mongodb", new(MongoDBToxic))
+}
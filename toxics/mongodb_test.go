@@ -0,0 +1,162 @@
+package toxics_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func bsonString(key, value string) []byte {
+	element := append([]byte{0x02}, key...)
+	element = append(element, 0)
+	element = binary.LittleEndian.AppendUint32(element, uint32(len(value)+1))
+	element = append(element, value...)
+	return append(element, 0)
+}
+
+func bsonInt64(key string, value int64) []byte {
+	element := append([]byte{0x12}, key...)
+	element = append(element, 0)
+	return binary.LittleEndian.AppendUint64(element, uint64(value))
+}
+
+func bsonBoolean(key string, value bool) []byte {
+	element := append([]byte{0x08}, key...)
+	if value {
+		return append(element, 0, 1)
+	}
+	return append(element, 0, 0)
+}
+
+func bsonDocument(elements ...[]byte) []byte {
+	body := bytes.Join(elements, nil)
+	doc := binary.LittleEndian.AppendUint32(nil, uint32(len(body)+5))
+	doc = append(doc, body...)
+	return append(doc, 0)
+}
+
+func mongoMessage(requestID int32, flags uint32, body []byte) []byte {
+	msg := binary.LittleEndian.AppendUint32(nil, uint32(21+len(body)))
+	msg = binary.LittleEndian.AppendUint32(msg, uint32(requestID))
+	msg = binary.LittleEndian.AppendUint32(msg, 0)
+	msg = binary.LittleEndian.AppendUint32(msg, 2013)
+	msg = binary.LittleEndian.AppendUint32(msg, flags)
+	msg = append(msg, 0)
+	return append(msg, body...)
+}
+
+func TestMongoDBToxicRepliesWithError(t *testing.T) {
+	toxic := &toxics.MongoDBToxic{
+		Command:    "^insert$",
+		Collection: "^orders$",
+		Error:      "NotWritablePrimary",
+	}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	other := mongoMessage(1, 0, bsonDocument(
+		bsonString("insert", "users"),
+		bsonString("$db", "test"),
+	))
+	matched := mongoMessage(2, 0, bsonDocument(
+		bsonString("insert", "orders"),
+		bsonInt64("txnNumber", 1),
+		bsonString("$db", "test"),
+	))
+	data := append(append([]byte{}, other...), matched...)
+	// Split in the middle of the matched message's header
+	input <- &stream.StreamChunk{Data: data[:len(other)+8]}
+	input <- &stream.StreamChunk{Data: data[len(other)+8:]}
+
+	if got := readChunks(output); !bytes.Equal(got, other) {
+		t.Errorf("Expected only the unmatched command, got %q", got)
+	}
+	if got := readChunks(replies); len(got) != 0 {
+		t.Fatalf("Expected the error to wait for the answer to request 1, got %q", got)
+	}
+	answer := mongoMessage(10, 0, bsonDocument(bsonInt64("n", 1)))
+	stub.Reply.Write(answer)
+	reply := readChunks(replies)
+	if !bytes.HasPrefix(reply, answer) {
+		t.Fatalf("Expected the answer to request 1 first, got %q", reply)
+	}
+	reply = reply[len(answer):]
+	if len(reply) < 21 || binary.LittleEndian.Uint32(reply) != uint32(len(reply)) {
+		t.Fatalf("Expected an OP_MSG reply, got %q", reply)
+	}
+	if responseTo := binary.LittleEndian.Uint32(reply[8:]); responseTo != 2 {
+		t.Errorf("Expected reply to request 2, got %d", responseTo)
+	}
+	code := binary.LittleEndian.AppendUint32([]byte("code\x00"), 10107)
+	fields := [][]byte{code, []byte("NotWritablePrimary"), []byte("RetryableWriteError")}
+	for _, expected := range fields {
+		if !bytes.Contains(reply, expected) {
+			t.Errorf("Expected reply to contain %q, got %q", expected, reply)
+		}
+	}
+	close(input)
+}
+
+func TestMongoDBToxicNoReplyForMoreToCome(t *testing.T) {
+	toxic := &toxics.MongoDBToxic{Error: "InterruptedAtShutdown"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: mongoMessage(1, 2, bsonDocument(bsonString("insert", "logs")))}
+
+	if got := readChunks(output); len(got) != 0 {
+		t.Errorf("Expected the command to be dropped, got %q", got)
+	}
+	if got := readChunks(replies); len(got) != 0 {
+		t.Errorf("Expected no reply, got %q", got)
+	}
+	close(input)
+}
+
+func TestMongoDBToxicPassesThroughOtherOpcodes(t *testing.T) {
+	toxic := &toxics.MongoDBToxic{Error: "NotWritablePrimary"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	// OP_COMPRESSED
+	data := mongoMessage(1, 0, bsonDocument(bsonString("insert", "orders")))
+	binary.LittleEndian.PutUint32(data[12:], 2012)
+	input <- &stream.StreamChunk{Data: data}
+
+	if got := readChunks(output); !bytes.Equal(got, data) {
+		t.Errorf("Expected data to be passed through, got %q", got)
+	}
+	if got := readChunks(replies); len(got) != 0 {
+		t.Errorf("Expected no reply, got %q", got)
+	}
+	close(input)
+}
+
+func TestMongoDBToxicNoRetryableWriteLabelInTransactions(t *testing.T) {
+	toxic := &toxics.MongoDBToxic{Error: "NotWritablePrimary"}
+	for _, transaction := range [][]byte{
+		bsonBoolean("startTransaction", true),
+		bsonBoolean("autocommit", false),
+	} {
+		stub, input, _, replies := NewReplyStub(toxic)
+		go toxic.Pipe(stub)
+
+		input <- &stream.StreamChunk{Data: mongoMessage(1, 0, bsonDocument(
+			bsonString("insert", "orders"),
+			bsonInt64("txnNumber", 1),
+			transaction,
+		))}
+
+		reply := readChunks(replies)
+		if !bytes.Contains(reply, []byte("NotWritablePrimary")) {
+			t.Errorf("Expected an error reply, got %q", reply)
+		}
+		if bytes.Contains(reply, []byte("RetryableWriteError")) {
+			t.Errorf("Expected no RetryableWriteError label in a transaction, got %q", reply)
+		}
+		close(input)
+	}
+}
@@ -0,0 +1,443 @@
+package toxics
+
+import (
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttDisconnect = 14
+
+	mqttRetain = 0x01
+	mqttQoS    = 0x06
+
+	mqttTopicAlias = 0x23
+
+	mqttMaxPacketSize = 16 * 1024 * 1024
+
+	// Server shutting down
+	mqttDefaultReasonCode = 0x8B
+)
+
+var errMQTTReasonCode = errors.New("reason_code must be between 0 and 255")
+
+// Sizes of the MQTT 5 PUBLISH properties, -1 for strings and binary data,
+// -2 for variable byte integers and -3 for string pairs.
+var mqttPropertySizes = map[byte]int{
+	0x01: 1,  // payload format indicator
+	0x02: 4,  // message expiry interval
+	0x03: -1, // content type
+	0x08: -1, // response topic
+	0x09: -1, // correlation data
+	0x0B: -2, // subscription identifier
+	0x23: 2,  // topic alias
+	0x26: -3, // user property
+}
+
+// The MQTTToxic acts on MQTT 3.1.1 and 5 messages with a matching topic: their
+// acknowledgement can be lost, the client disconnected, or the messages slowed
+// down. Added upstream it disconnects or slows down clients as they publish,
+// and loses their acknowledgements of the messages they receive. Added
+// downstream it acts on the messages clients receive, and loses the server's
+// acknowledgements of the messages they publish. Connections that don't start
+// with an MQTT handshake, such as TLS and WebSocket connections, are left
+// alone.
+type MQTTToxic struct {
+	// Regular expression matched against the topic of PUBLISH packets. An
+	// empty pattern matches every topic.
+	Topic string `json:"topic"`
+	// Only match retained messages
+	Retained bool `json:"retained"`
+	// What to do with matching messages: drop_ack to drop the PUBACK or PUBREC
+	// acknowledging them, or disconnect to disconnect the client. If empty,
+	// matching messages are only delayed.
+	Action string `json:"action"`
+	// Reason code of the DISCONNECT sent to MQTT 5 clients
+	ReasonCode int `json:"reason_code"`
+	// Milliseconds to wait before a matching message is handled
+	Latency int64 `json:"latency"`
+}
+
+type MQTTToxicState struct {
+	buffer      messageBuffer
+	started     bool
+	passthrough bool
+	// Whether this is the client side of the connection
+	client bool
+	// MQTT 5 is spoken on the connection
+	v5 bool
+	// Topics by MQTT 5 topic alias
+	aliases map[uint16]string
+	// Matching messages sent to the peer the toxic reads from
+	sent mqttSent
+}
+
+// mqttSent follows the messages sent to a peer, to know which of its
+// acknowledgements are for matching messages.
+type mqttSent struct {
+	lock    sync.Mutex
+	aliases map[uint16]string
+	// Packet identifiers of the matching messages not acknowledged yet
+	matched map[uint16]bool
+}
+
+// mqttFramer frames MQTT packets.
+type mqttFramer struct{}
+
+func (mqttFramer) Frame(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, nil
+	}
+	length, n := mqttVarint(data[1:])
+	if n < 0 {
+		return 0, stream.ErrInvalidFraming
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	size := 1 + n + length
+	if size > stream.MaxMessageSize {
+		return 0, stream.ErrMessageTooLarge
+	}
+	if len(data) < size {
+		return 0, nil
+	}
+	return size, nil
+}
+
+// mqttVarint reads a variable byte integer from the start of data. It returns
+// the value and its size, 0 if it is incomplete or -1 if it is invalid.
+func mqttVarint(data []byte) (int, int) {
+	value := 0
+	for i := 0; i < 4; i++ {
+		if i >= len(data) {
+			return 0, 0
+		}
+		value |= int(data[i]&0x7F) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, -1
+}
+
+// mqttPublishTopic parses the variable header of a PUBLISH packet, returning
+// its topic, the offset of the packet identifier and the MQTT 5 topic alias.
+func mqttPublishTopic(
+	body []byte,
+	qos bool,
+	v5 bool,
+) (topic string, idOffset int, alias uint16, ok bool) {
+	if len(body) < 2 {
+		return "", 0, 0, false
+	}
+	length := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+length {
+		return "", 0, 0, false
+	}
+	topic = string(body[2 : 2+length])
+	idOffset = 2 + length
+	if !v5 {
+		return topic, idOffset, 0, true
+	}
+
+	props := body[idOffset:]
+	if qos {
+		if len(props) < 2 {
+			return "", 0, 0, false
+		}
+		props = props[2:]
+	}
+	size, n := mqttVarint(props)
+	if n <= 0 || len(props) < n+size {
+		return "", 0, 0, false
+	}
+	return topic, idOffset, mqttFindAlias(props[n : n+size]), true
+}
+
+// mqttFindAlias returns the topic alias in MQTT 5 PUBLISH properties, or 0 if
+// there is none.
+func mqttFindAlias(props []byte) uint16 {
+	for len(props) > 0 {
+		id := props[0]
+		size, known := mqttPropertySizes[id]
+		if !known {
+			return 0
+		}
+		props = props[1:]
+
+		switch size {
+		case -1, -3:
+			strings := 1
+			if size == -3 {
+				strings = 2
+			}
+			for i := 0; i < strings; i++ {
+				if len(props) < 2 || len(props) < 2+int(binary.BigEndian.Uint16(props)) {
+					return 0
+				}
+				props = props[2+int(binary.BigEndian.Uint16(props)):]
+			}
+		case -2:
+			_, n := mqttVarint(props)
+			if n <= 0 {
+				return 0
+			}
+			props = props[n:]
+		default:
+			if len(props) < size {
+				return 0
+			}
+			if id == mqttTopicAlias {
+				return binary.BigEndian.Uint16(props)
+			}
+			props = props[size:]
+		}
+	}
+	return 0
+}
+
+// matches reports whether a PUBLISH packet the toxic acts on has a matching
+// topic, once the MQTT 5 topic alias it may use is resolved.
+func (t *MQTTToxic) matches(
+	topic *regexp.Regexp,
+	aliases map[uint16]string,
+	name string,
+	alias uint16,
+	flags byte,
+) bool {
+	if alias != 0 {
+		if name == "" {
+			name = aliases[alias]
+		} else {
+			aliases[alias] = name
+		}
+	}
+	return topic.MatchString(name) && (!t.Retained || flags&mqttRetain != 0)
+}
+
+// watch is called with the packets sent to the peer the toxic reads from, and
+// remembers the packet identifiers of the matching messages.
+func (t *MQTTToxic) watch(state *MQTTToxicState, topic *regexp.Regexp, packet []byte) {
+	flags := packet[0]
+	if flags>>4 == mqttDisconnect {
+		state.sent.clear()
+		return
+	}
+	if flags>>4 != mqttPublish || flags&mqttQoS == 0 {
+		return
+	}
+	_, n := mqttVarint(packet[1:])
+	body := packet[1+n:]
+	name, idOffset, alias, ok := mqttPublishTopic(body, true, state.v5)
+	if !ok || len(body) < idOffset+2 {
+		return
+	}
+
+	sent := &state.sent
+	sent.lock.Lock()
+	defer sent.lock.Unlock()
+	if t.matches(topic, sent.aliases, name, alias, flags) {
+		sent.matched[binary.BigEndian.Uint16(body[idOffset:])] = true
+	}
+}
+
+// acknowledges reports whether a PUBACK or PUBREC acknowledges a matching
+// message.
+func (s *mqttSent) acknowledges(id uint16) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	matched := s.matched[id]
+	delete(s.matched, id)
+	return matched
+}
+
+func (t *MQTTToxic) Validate() error {
+	if err := validatePatterns(t.Topic); err != nil {
+		return err
+	}
+	if err := validateChoice("action", t.Action, "", "drop_ack", "disconnect"); err != nil {
+		return err
+	}
+	if t.ReasonCode < 0 || t.ReasonCode > 0xff {
+		return errMQTTReasonCode
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+// clear forgets the matching messages once the connection is disconnected,
+// as they won't be acknowledged on it anymore.
+func (s *mqttSent) clear() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	clear(s.matched)
+}
+
+func (t *MQTTToxic) disconnect(v5 bool) []byte {
+	if !v5 {
+		return nil
+	}
+	code := t.ReasonCode
+	if code == 0 {
+		code = mqttDefaultReasonCode
+	}
+	return []byte{mqttDisconnect << 4, 1, byte(code)}
+}
+
+func (t *MQTTToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*MQTTToxicState)
+	buf := &state.buffer
+
+	topic, err := regexp.Compile(t.Topic)
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !buf.fill(stub, 2) {
+			return
+		}
+		kind := buf.data[0] >> 4
+		length, n := mqttVarint(buf.data[1:])
+		if n == 0 {
+			if !buf.fill(stub, len(buf.data)+1) {
+				return
+			}
+			continue
+		}
+		if n < 0 {
+			state.passthrough = true
+			continue
+		}
+		header := 1 + n
+		size := header + length
+
+		if !state.started {
+			// Clients start with CONNECT, servers with CONNACK
+			state.started = true
+			switch buf.data[0] {
+			case mqttConnect << 4:
+				state.client = true
+				// Protocol name and level
+				if !buf.fill(stub, min(size, header+2)) {
+					return
+				}
+				if size >= header+2 {
+					level := header + 2 + int(binary.BigEndian.Uint16(buf.data[header:]))
+					if !buf.fill(stub, min(size, level+1)) {
+						return
+					}
+					state.v5 = size > level && buf.data[level] == 5
+				}
+			case mqttConnack << 4:
+				// MQTT 5 adds properties to the CONNACK
+				state.v5 = length > 2
+			default:
+				state.passthrough = true
+				continue
+			}
+			// Replies wait for whole packets. Packets a client sent before the
+			// CONNACK aren't watched, as framing starts with its next write.
+			stub.Reply.SetFraming(mqttFramer{}, nil)
+			if t.Action == "drop_ack" {
+				stub.Reply.Watch(func(packet []byte) {
+					t.watch(state, topic, packet)
+				})
+			}
+			buf.pass(size)
+			continue
+		}
+
+		if (kind == mqttPuback || kind == mqttPubrec) && t.Action == "drop_ack" &&
+			length <= mqttMaxPacketSize {
+			if !buf.fill(stub, size) {
+				return
+			}
+			if length >= 2 && state.sent.acknowledges(binary.BigEndian.Uint16(buf.data[header:])) {
+				buf.discard(size)
+			} else {
+				buf.forward(stub, size)
+			}
+			continue
+		}
+
+		if kind == mqttDisconnect {
+			state.sent.clear()
+		}
+		if kind != mqttPublish || length > mqttMaxPacketSize {
+			buf.pass(size)
+			continue
+		}
+		if !buf.fill(stub, size) {
+			return
+		}
+
+		flags := buf.data[0]
+		name, _, alias, ok := mqttPublishTopic(buf.data[header:size], flags&mqttQoS != 0, state.v5)
+		if !ok {
+			state.passthrough = true
+			continue
+		}
+		if !t.matches(topic, state.aliases, name, alias, flags) {
+			buf.forward(stub, size)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		switch {
+		case t.Action == "disconnect":
+			buf.discard(len(buf.data))
+			if disconnect := t.disconnect(state.v5); disconnect != nil {
+				if state.client {
+					stub.Reply.Send(disconnect)
+				} else {
+					stub.Output <- &stream.StreamChunk{Data: disconnect, Timestamp: buf.timestamp}
+				}
+			}
+			stub.Close()
+			return
+		default:
+			buf.forward(stub, size)
+		}
+	}
+}
+
+func (t *MQTTToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*MQTTToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *MQTTToxic) NewState() interface{} {
+	return &MQTTToxicState{
+		aliases: make(map[uint16]string),
+		sent: mqttSent{
+			aliases: make(map[uint16]string),
+			matched: make(map[uint16]bool),
+		},
+	}
+}
+
+func init() {
+	Register("mqtt", new(MQTTToxic))
+}
@@ -0,0 +1,129 @@
+package toxics_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func mqttPacket(header byte, body []byte) []byte {
+	return append([]byte{header, byte(len(body))}, body...)
+}
+
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func mqttConnect(level byte) []byte {
+	body := append(mqttString("MQTT"), level, 0x02, 0, 60)
+	if level == 5 {
+		body = append(body, 0)
+	}
+	return mqttPacket(0x10, append(body, mqttString("client")...))
+}
+
+func TestMQTTToxicDropsAcknowledgement(t *testing.T) {
+	toxic := &toxics.MQTTToxic{Topic: "^sensors/", Action: "drop_ack"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	// The server accepts an MQTT 5 connection, the client publishes with QoS 1
+	connack := mqttPacket(0x20, []byte{0, 0, 0})
+	input <- &stream.StreamChunk{Data: connack}
+	readChunks(output)
+	matched := mqttPacket(0x32, append(append(mqttString("sensors/1"), 0, 7, 0), "on"...))
+	other := mqttPacket(0x32, append(append(mqttString("alerts/1"), 0, 8, 0), "off"...))
+	stub.Reply.Write(append(matched, other...))
+
+	otherAck := mqttPacket(0x40, []byte{0, 8})
+	input <- &stream.StreamChunk{Data: append(mqttPacket(0x40, []byte{0, 7}), otherAck...)}
+	if got := readChunks(output); !bytes.Equal(got, otherAck) {
+		t.Errorf("Expected the acknowledgement of the matching message to be dropped, got %q", got)
+	}
+	close(input)
+}
+
+func TestMQTTToxicForgetsMessagesOnDisconnect(t *testing.T) {
+	toxic := &toxics.MQTTToxic{Topic: "^sensors/", Action: "drop_ack"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	connack := mqttPacket(0x20, []byte{0, 0, 0})
+	input <- &stream.StreamChunk{Data: connack}
+	readChunks(output)
+	matched := mqttPacket(0x32, append(append(mqttString("sensors/1"), 0, 7, 0), "on"...))
+	stub.Reply.Write(append(matched, mqttPacket(0xe0, []byte{0})...))
+
+	ack := mqttPacket(0x40, []byte{0, 7})
+	input <- &stream.StreamChunk{Data: ack}
+	if got := readChunks(output); !bytes.Equal(got, ack) {
+		t.Errorf("Expected the acknowledgement after a disconnect to pass through, got %q", got)
+	}
+	close(input)
+}
+
+func TestMQTTToxicDisconnects(t *testing.T) {
+	toxic := &toxics.MQTTToxic{Action: "disconnect", ReasonCode: 0x89}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	connect := mqttConnect(5)
+	publish := mqttPacket(0x30, append(mqttString("a"), 0, 'x'))
+	input <- &stream.StreamChunk{Data: append(connect, publish...)}
+
+	if got := readChunks(replies); !bytes.Equal(got, []byte{0xE0, 1, 0x89}) {
+		t.Errorf("Expected DISCONNECT, got %q", got)
+	}
+	if got := readChunks(output); !bytes.Equal(got, connect) {
+		t.Errorf("Expected only CONNECT to be forwarded, got %q", got)
+	}
+	if !stub.Closed() {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestMQTTToxicDisconnectsV3WithoutPacket(t *testing.T) {
+	toxic := &toxics.MQTTToxic{Action: "disconnect"}
+	stub, input, _, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	publish := mqttPacket(0x30, append(mqttString("a"), 'x'))
+	input <- &stream.StreamChunk{Data: append(mqttConnect(4), publish...)}
+
+	if got := readChunks(replies); len(got) != 0 {
+		t.Errorf("Expected no DISCONNECT for MQTT 3.1.1, got %q", got)
+	}
+	if !stub.Closed() {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestMQTTToxicDelaysRetainedMessages(t *testing.T) {
+	toxic := &toxics.MQTTToxic{Retained: true, Latency: 100}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: mqttPacket(0x20, []byte{0, 0})}
+	<-output
+
+	start := time.Now()
+	input <- &stream.StreamChunk{Data: mqttPacket(0x30, append(mqttString("a"), 'x'))}
+	<-output
+	AssertDeltaTime(t, "Live message", time.Since(start), 0, 20*time.Millisecond)
+
+	start = time.Now()
+	input <- &stream.StreamChunk{Data: mqttPacket(0x31, append(mqttString("a"), 'x'))}
+	<-output
+	AssertDeltaTime(
+		t,
+		"Retained message",
+		time.Since(start),
+		100*time.Millisecond,
+		20*time.Millisecond,
+	)
+	close(input)
+}
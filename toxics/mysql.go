@@ -0,0 +1,249 @@
+package toxics
+
+import (
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"time"
+)
+
+const (
+	mysqlComQuery       = 0x03
+	mysqlComStmtPrepare = 0x16
+
+	mysqlClientSSL             = 0x00000800
+	mysqlClientCompress        = 0x00000020
+	mysqlClientZstdCompression = 0x04000000
+	mysqlClientProtocol41      = 0x00000200
+	mysqlClientQueryAttributes = 0x08000000
+
+	// Client side error for a connection that dropped while waiting for a
+	// query result.
+	mysqlLostConnection = 2013
+)
+
+var (
+	errMySQLErrorCode = errors.New("error_code must be between 0 and 65535")
+	errMySQLSQLState  = errors.New("sql_state must be a 5 character SQLSTATE")
+)
+
+var mysqlErrors = map[int]struct {
+	state   string
+	message string
+}{
+	1205: {"HY000", "Lock wait timeout exceeded; try restarting transaction"},
+	1213: {"40001", "Deadlock found when trying to get lock; try restarting transaction"},
+	1290: {
+		"HY000",
+		"The MySQL server is running with the --read-only option so it cannot execute this statement",
+	},
+}
+
+// The MySQLToxic answers COM_QUERY and COM_STMT_PREPARE commands matching a
+// pattern with an ERR packet, or slows them down. It reads the commands
+// clients send, so it acts on the upstream stream only, and stops looking at
+// connections once they switch to TLS or compression. Clients wait for the result of a
+// command before sending the next one, so the ERR packet never has to wait
+// for other results.
+type MySQLToxic struct {
+	// Regular expression matched against COM_QUERY and COM_STMT_PREPARE
+	// statements. An empty pattern matches every statement.
+	Match string `json:"match"`
+	// Error code to fail matching statements with, e.g. 1213. If set to 2013
+	// the connection is closed after the statement is read, as if it was lost
+	// during the query. If 0, statements are only delayed.
+	ErrorCode    int    `json:"error_code"`
+	SQLState     string `json:"sql_state"`
+	ErrorMessage string `json:"error_message"`
+	// Delay in milliseconds before a matching command goes on to the server,
+	// or is answered with the error
+	Latency int64 `json:"latency"`
+}
+
+type MySQLToxicState struct {
+	buffer       messageBuffer
+	handshake    bool
+	passthrough  bool
+	capabilities uint32
+}
+
+func (t *MySQLToxic) Validate() error {
+	if err := validatePatterns(t.Match); err != nil {
+		return err
+	}
+	if t.ErrorCode < 0 || t.ErrorCode > 0xffff {
+		return errMySQLErrorCode
+	}
+	if t.SQLState != "" && len(t.SQLState) != 5 {
+		return errMySQLSQLState
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+func (t *MySQLToxic) errPacket(capabilities uint32) []byte {
+	known := mysqlErrors[t.ErrorCode]
+	state := t.SQLState
+	if state == "" {
+		state = known.state
+	}
+	if state == "" {
+		state = "HY000"
+	}
+	message := t.ErrorMessage
+	if message == "" {
+		message = known.message
+	}
+	if message == "" {
+		message = "query rejected by toxiproxy"
+	}
+
+	payload := []byte{0xff, 0, 0}
+	binary.LittleEndian.PutUint16(payload[1:], uint16(t.ErrorCode))
+	if capabilities&mysqlClientProtocol41 != 0 {
+		payload = append(payload, '#')
+		payload = append(payload, state...)
+	}
+	payload = append(payload, message...)
+
+	// The reply to a command always has sequence id 1
+	packet := []byte{0, 0, 0, 1}
+	putUint24(packet, len(payload))
+	return append(packet, payload...)
+}
+
+// mysqlStatement returns the SQL text of a command packet payload.
+func mysqlStatement(payload []byte, capabilities uint32) string {
+	statement := payload[1:]
+	if payload[0] == mysqlComQuery && capabilities&mysqlClientQueryAttributes != 0 {
+		// parameter_count and parameter_set_count, both 1 byte when there are
+		// no query attributes. With attributes the whole payload is matched.
+		if len(statement) >= 2 && statement[0] == 0 {
+			statement = statement[2:]
+		}
+	}
+	return string(statement)
+}
+
+// mysqlFramer frames packets: a 3-byte little-endian payload length and a
+// sequence id, then the payload.
+type mysqlFramer struct{}
+
+func (mysqlFramer) Frame(data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, nil
+	}
+	size := 4 + (int(data[0]) | int(data[1])<<8 | int(data[2])<<16)
+	if len(data) < size {
+		return 0, nil
+	}
+	return size, nil
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+func (t *MySQLToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*MySQLToxicState)
+	buf := &state.buffer
+
+	match, err := regexp.Compile(t.Match)
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !buf.fill(stub, 4) {
+			return
+		}
+		length := int(buf.data[0]) | int(buf.data[1])<<8 | int(buf.data[2])<<16
+		sequence := buf.data[3]
+		size := 4 + length
+
+		if !state.handshake {
+			// The first packet from the client is either the handshake
+			// response or an SSL request, both start with capability flags.
+			if !buf.fill(stub, min(size, 8)) {
+				return
+			}
+			if length < 4 {
+				state.passthrough = true
+				continue
+			}
+			state.handshake = true
+			state.capabilities = binary.LittleEndian.Uint32(buf.data[4:])
+			// Compressed packets can't be read either
+			flags := uint32(mysqlClientSSL | mysqlClientCompress | mysqlClientZstdCompression)
+			if state.capabilities&flags != 0 {
+				state.passthrough = true
+			} else {
+				// The server greeting was answered, the server sends nothing
+				// but whole packets from now on
+				stub.Reply.SetFraming(mysqlFramer{}, nil)
+			}
+			buf.pass(size)
+			continue
+		}
+
+		// Commands always start a new sequence, anything else is part of the
+		// authentication exchange or a multi-packet command.
+		if sequence != 0 || length == 0 {
+			buf.pass(size)
+			continue
+		}
+		if !buf.fill(stub, 5) {
+			return
+		}
+		if command := buf.data[4]; command != mysqlComQuery && command != mysqlComStmtPrepare {
+			buf.pass(size)
+			continue
+		}
+
+		if !buf.fill(stub, size) {
+			return
+		}
+		if !match.MatchString(mysqlStatement(buf.data[4:size], state.capabilities)) {
+			buf.forward(stub, size)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		switch t.ErrorCode {
+		case 0:
+			buf.forward(stub, size)
+		case mysqlLostConnection:
+			buf.discard(size)
+			stub.Close()
+			return
+		default:
+			buf.discard(size)
+			stub.Reply.Send(t.errPacket(state.capabilities))
+		}
+	}
+}
+
+func (t *MySQLToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*MySQLToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *MySQLToxic) NewState() interface{} {
+	return new(MySQLToxicState)
+}
+
+func init() {
+	Register("mysql", new(MySQLToxic))
+}
@@ -0,0 +1,140 @@
+package toxics_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func mysqlPacket(sequence byte, payload string) []byte {
+	packet := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), sequence}
+	return append(packet, payload...)
+}
+
+func mysqlHandshakeResponse(capabilities uint32) []byte {
+	payload := make([]byte, 32)
+	binary.LittleEndian.PutUint32(payload, capabilities)
+	return mysqlPacket(1, string(payload)+"root\x00\x00")
+}
+
+func TestMySQLToxicInjectsErrPacket(t *testing.T) {
+	toxic := &toxics.MySQLToxic{Match: "(?i)^update", ErrorCode: 1213}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	handshake := mysqlHandshakeResponse(0x00000200)
+	selectQuery := mysqlPacket(0, "\x03SELECT 1")
+	updateQuery := mysqlPacket(0, "\x03UPDATE t SET x = 1")
+	input <- &stream.StreamChunk{Data: handshake}
+	input <- &stream.StreamChunk{Data: append(selectQuery, updateQuery...)}
+
+	expected := append(handshake, selectQuery...)
+	if got := readChunks(output); !bytes.Equal(got, expected) {
+		t.Errorf("Expected matching query to be dropped, got %q", got)
+	}
+
+	reply := readChunks(replies)
+	expectedReply := mysqlPacket(1, "\xff\xbd\x04#40001"+
+		"Deadlock found when trying to get lock; try restarting transaction")
+	if !bytes.Equal(reply, expectedReply) {
+		t.Errorf("Expected deadlock ERR packet, got %q", reply)
+	}
+	close(input)
+}
+
+func TestMySQLToxicIgnoresAuthenticationPackets(t *testing.T) {
+	toxic := &toxics.MySQLToxic{ErrorCode: 1290}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	data := append(mysqlHandshakeResponse(0x00000200), mysqlPacket(3, "\x03password")...)
+	input <- &stream.StreamChunk{Data: data}
+
+	if got := readChunks(output); !bytes.Equal(got, data) {
+		t.Errorf("Expected authentication to pass through, got %q", got)
+	}
+	if got := readChunks(replies); len(got) != 0 {
+		t.Errorf("Expected no reply, got %q", got)
+	}
+	close(input)
+}
+
+func TestMySQLToxicPassesThroughTLS(t *testing.T) {
+	toxic := &toxics.MySQLToxic{ErrorCode: 1290}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	data := append(mysqlHandshakeResponse(0x00000a00), mysqlPacket(0, "\x03SELECT 1")...)
+	input <- &stream.StreamChunk{Data: data}
+
+	if got := readChunks(output); !bytes.Equal(got, data) {
+		t.Errorf("Expected TLS connection to pass through, got %q", got)
+	}
+	close(input)
+}
+
+func TestMySQLToxicPassesThroughCompression(t *testing.T) {
+	for _, capabilities := range []uint32{0x00000220, 0x04000200} {
+		toxic := &toxics.MySQLToxic{ErrorCode: 1290}
+		stub, input, output, replies := NewReplyStub(toxic)
+		go toxic.Pipe(stub)
+
+		data := append(mysqlHandshakeResponse(capabilities), mysqlPacket(0, "\x03SELECT 1")...)
+		input <- &stream.StreamChunk{Data: data}
+
+		if got := readChunks(output); !bytes.Equal(got, data) {
+			t.Errorf("Expected compressed connection to pass through, got %q", got)
+		}
+		if got := readChunks(replies); len(got) != 0 {
+			t.Errorf("Expected no reply, got %q", got)
+		}
+		close(input)
+	}
+}
+
+func TestMySQLToxicLostConnection(t *testing.T) {
+	toxic := &toxics.MySQLToxic{Match: "SLEEP", ErrorCode: 2013}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	handshake := mysqlHandshakeResponse(0x00000200)
+	input <- &stream.StreamChunk{Data: handshake}
+	input <- &stream.StreamChunk{Data: mysqlPacket(0, "\x03SELECT SLEEP(10)")}
+
+	if got := readChunks(output); !bytes.Equal(got, handshake) {
+		t.Errorf("Expected query to be dropped, got %q", got)
+	}
+	if !stub.Closed() {
+		t.Error("Expected the connection to be closed")
+	}
+	if got := readChunks(replies); len(got) != 0 {
+		t.Errorf("Expected no reply, got %q", got)
+	}
+}
+
+func TestMySQLToxicRepliesBetweenPackets(t *testing.T) {
+	toxic := &toxics.MySQLToxic{ErrorCode: 1205}
+	stub, input, _, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: mysqlHandshakeResponse(0x00000200)}
+	readChunks(replies)
+
+	// An OK packet the server is still writing
+	ok := mysqlPacket(2, "\x00\x00\x00\x02\x00\x00\x00")
+	stub.Reply.Write(ok[:6])
+	input <- &stream.StreamChunk{Data: mysqlPacket(0, "\x03SELECT 1")}
+	if got := readChunks(replies); !bytes.Equal(got, ok[:6]) {
+		t.Fatalf("Expected the ERR packet to wait for the OK packet, got %q", got)
+	}
+
+	stub.Reply.Write(ok[6:])
+	reply := readChunks(replies)
+	if !bytes.HasPrefix(reply, ok[6:]) || !bytes.Contains(reply, []byte("\xff\xb5\x04")) {
+		t.Errorf("Expected the ERR packet after the OK packet, got %q", reply)
+	}
+	close(input)
+}
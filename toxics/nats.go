@@ -0,0 +1,234 @@
+package toxics
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const natsMaxControlLine = 64 * 1024
+
+var errNATSError = errors.New("error can't contain line breaks")
+
+// Errors after which the NATS server closes the connection.
+var natsFatalErrors = map[string]bool{
+	"Slow Consumer":                    true,
+	"Stale Connection":                 true,
+	"Authorization Violation":          true,
+	"Authentication Timeout":           true,
+	"User Authentication Expired":      true,
+	"Maximum Connections Exceeded":     true,
+	"Maximum Payload Violation":        true,
+	"Parser Error":                     true,
+	"Unknown Protocol Operation":       true,
+	"Secure Connection - TLS Required": true,
+}
+
+// The NATSToxic answers NATS messages with a matching subject with a -ERR, or
+// slows them down, and can drop PONGs for the other side to see a stale
+// connection. Added upstream it acts on what clients publish with PUB and
+// HPUB, added downstream on the MSG and HMSG they receive. Once a connection
+// switches to TLS it is left alone.
+type NATSToxic struct {
+	// Regular expression matched against the subject of messages. An empty
+	// pattern matches every message.
+	Subject string `json:"subject"`
+	// What to do with matching messages: error to reply with a -ERR, or
+	// drop_pong to drop every PONG. If empty, matching messages are only
+	// delayed.
+	Action string `json:"action"`
+	// Error message of the -ERR, e.g. "Slow Consumer" or "Authorization
+	// Violation". The connection is closed after errors the server treats as
+	// fatal.
+	Error string `json:"error"`
+	// Milliseconds to wait before a matching message is handled
+	Latency int64 `json:"latency"`
+}
+
+type NATSToxicState struct {
+	buffer      messageBuffer
+	started     bool
+	passthrough bool
+}
+
+// natsFramer frames NATS protocol messages.
+type natsFramer struct{}
+
+func (natsFramer) Frame(data []byte) (int, error) {
+	_, _, size := natsMessage(data)
+	if size < 0 {
+		return 0, stream.ErrInvalidFraming
+	}
+	return size, nil
+}
+
+// natsMessage parses a protocol message from the start of data, returning its
+// operation, the subject if it carries a message, and its size including the
+// payload. The size is 0 if the message is incomplete, -1 if it is invalid.
+func natsMessage(data []byte) (string, string, int) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		if len(data) > natsMaxControlLine {
+			return "", "", -1
+		}
+		return "", "", 0
+	}
+	fields := bytes.Fields(data[:i])
+	if len(fields) == 0 {
+		return "", "", i + 1
+	}
+	op := string(bytes.ToUpper(fields[0]))
+	size := i + 1
+
+	var args int
+	switch op {
+	case "MSG":
+		// subject sid [reply-to] #bytes
+		args = 3
+	case "HMSG":
+		// subject sid [reply-to] #header-bytes #total-bytes
+		args = 4
+	case "PUB":
+		// subject [reply-to] #bytes
+		args = 2
+	case "HPUB":
+		// subject [reply-to] #header-bytes #total-bytes
+		args = 3
+	case "INFO", "CONNECT", "SUB", "UNSUB", "PING", "PONG", "+OK", "-ERR":
+		return op, "", size
+	default:
+		return "", "", -1
+	}
+
+	if len(fields)-1 != args && len(fields)-1 != args+1 {
+		return "", "", -1
+	}
+	length, err := strconv.Atoi(string(fields[len(fields)-1]))
+	if err != nil || length < 0 {
+		return "", "", -1
+	}
+	size += length + 2
+	if len(data) < size {
+		return op, "", 0
+	}
+	return op, string(fields[1]), size
+}
+
+func (t *NATSToxic) Validate() error {
+	if err := validatePatterns(t.Subject); err != nil {
+		return err
+	}
+	if err := validateChoice("action", t.Action, "", "error", "drop_pong"); err != nil {
+		return err
+	}
+	if strings.ContainsAny(t.Error, "\r\n") {
+		return errNATSError
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+func (t *NATSToxic) errorMessage() string {
+	if t.Error == "" {
+		return "Slow Consumer"
+	}
+	return t.Error
+}
+
+func (t *NATSToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*NATSToxicState)
+	buf := &state.buffer
+
+	subject, err := regexp.Compile(t.Subject)
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !buf.fill(stub, 1) {
+			return
+		}
+		op, name, size := natsMessage(buf.data)
+		if size < 0 {
+			state.passthrough = true
+			continue
+		}
+		if size == 0 {
+			if !buf.fill(stub, len(buf.data)+1) {
+				return
+			}
+			continue
+		}
+		if !state.started {
+			// Errors are asynchronous, they only wait for whole messages
+			state.started = true
+			stub.Reply.SetFraming(natsFramer{}, nil)
+		}
+
+		switch op {
+		case "INFO":
+			// The rest of the connection is encrypted
+			if bytes.Contains(buf.data[:size], []byte(`"tls_required":true`)) {
+				buf.forward(stub, size)
+				state.passthrough = true
+				continue
+			}
+		case "PONG":
+			if t.Action == "drop_pong" {
+				buf.discard(size)
+				continue
+			}
+		}
+		if name == "" || !subject.MatchString(name) {
+			buf.forward(stub, size)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		if t.Action != "error" {
+			buf.forward(stub, size)
+			continue
+		}
+		buf.discard(size)
+		message := t.errorMessage()
+		reply := []byte("-ERR '" + message + "'\r\n")
+		if op == "PUB" || op == "HPUB" {
+			stub.Reply.Send(reply)
+		} else {
+			stub.Output <- &stream.StreamChunk{Data: reply, Timestamp: buf.timestamp}
+		}
+		if natsFatalErrors[message] {
+			buf.discard(len(buf.data))
+			stub.Close()
+			return
+		}
+	}
+}
+
+func (t *NATSToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*NATSToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *NATSToxic) NewState() interface{} {
+	return new(NATSToxicState)
+}
+
+func init() {
+	Register("nats", new(NATSToxic))
+}
@@ -0,0 +1,118 @@
+package toxics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func TestNATSToxicRepliesWithError(t *testing.T) {
+	toxic := &toxics.NATSToxic{
+		Subject: `^orders\.`,
+		Action:  "error",
+		Error:   "Permissions Violation for Publish to \"orders.new\"",
+	}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	data := "PUB users.new 5\r\nhello\r\nPUB orders.new inbox.1 3\r\nabc\r\nPING\r\n"
+	input <- &stream.StreamChunk{Data: []byte(data[:30])}
+	input <- &stream.StreamChunk{Data: []byte(data[30:])}
+
+	if got := readChunks(output); string(got) != "PUB users.new 5\r\nhello\r\nPING\r\n" {
+		t.Errorf("Expected matching message to be dropped, got %q", got)
+	}
+	expected := "-ERR 'Permissions Violation for Publish to \"orders.new\"'\r\n"
+	if got := readChunks(replies); string(got) != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	if stub.Closed() {
+		t.Error("Expected the connection to stay open")
+	}
+	close(input)
+}
+
+func TestNATSToxicErrorWaitsForTheEndOfAMessage(t *testing.T) {
+	toxic := &toxics.NATSToxic{Action: "error", Error: "Permissions Violation"}
+	stub, input, _, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: []byte("CONNECT {}\r\n")}
+	stub.Reply.Write([]byte("MSG events 1 5\r\nhe"))
+	input <- &stream.StreamChunk{Data: []byte("PUB orders 2\r\nhi\r\n")}
+	if got := readChunks(replies); string(got) != "MSG events 1 5\r\nhe" {
+		t.Errorf("Expected the error to wait for the end of the message, got %q", got)
+	}
+	stub.Reply.Write([]byte("llo\r\n"))
+	if got := readChunks(replies); string(got) != "llo\r\n-ERR 'Permissions Violation'\r\n" {
+		t.Errorf("Expected the error after the message, got %q", got)
+	}
+	close(input)
+}
+
+func TestNATSToxicSlowConsumerClosesConnection(t *testing.T) {
+	toxic := &toxics.NATSToxic{Action: "error"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: []byte("+OK\r\nMSG events 1 2\r\nhi\r\n")}
+
+	if got := readChunks(output); string(got) != "+OK\r\n-ERR 'Slow Consumer'\r\n" {
+		t.Errorf("Expected Slow Consumer error, got %q", got)
+	}
+	if !stub.Closed() {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestNATSToxicDropsPongs(t *testing.T) {
+	toxic := &toxics.NATSToxic{Action: "drop_pong"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: []byte("PONG\r\nPING\r\nPONG\r\n+OK\r\n")}
+
+	if got := readChunks(output); string(got) != "PING\r\n+OK\r\n" {
+		t.Errorf("Expected PONGs to be dropped, got %q", got)
+	}
+	close(input)
+}
+
+func TestNATSToxicDelaysMessages(t *testing.T) {
+	toxic := &toxics.NATSToxic{Subject: "^slow$", Latency: 100}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := time.Now()
+	input <- &stream.StreamChunk{Data: []byte("HMSG fast 1 12 14\r\nNATS/1.0\r\n\r\nhi\r\n")}
+	<-output
+	AssertDeltaTime(t, "Unmatched message", time.Since(start), 0, 20*time.Millisecond)
+
+	start = time.Now()
+	input <- &stream.StreamChunk{Data: []byte("MSG slow 1 2\r\nhi\r\n")}
+	<-output
+	AssertDeltaTime(
+		t,
+		"Matched message",
+		time.Since(start),
+		100*time.Millisecond,
+		20*time.Millisecond,
+	)
+	close(input)
+}
+
+func TestNATSToxicPassesThroughTLS(t *testing.T) {
+	toxic := &toxics.NATSToxic{Action: "drop_pong"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	data := "INFO {\"tls_required\":true}\r\nPONG\r\n"
+	input <- &stream.StreamChunk{Data: []byte(data)}
+
+	if got := readChunks(output); string(got) != data {
+		t.Errorf("Expected data to be passed through, got %q", got)
+	}
+	close(input)
+}
@@ -0,0 +1,50 @@
+package toxics
+
+import (
+	"math/rand"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+// The PacketDuplicateToxic sends UDP datagrams twice at random. It is meant
+// for proxies with the udp or dns protocol.
+type PacketDuplicateToxic struct {
+	// Probability of a datagram being duplicated, between 0 and 1
+	Probability float64 `json:"probability"`
+}
+
+type PacketDuplicateToxicState struct {
+	buffer messageBuffer
+}
+
+func (t *PacketDuplicateToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*PacketDuplicateToxicState)
+	buf := &state.buffer
+	for {
+		size, ok := buf.datagram(stub, nil)
+		if !ok {
+			return
+		}
+		// #nosec G404 -- no need for cryptographic randomness
+		if rand.Float64() < t.Probability {
+			duplicate := append([]byte{}, buf.data[:size]...)
+			stub.Output <- &stream.StreamChunk{Data: duplicate, Timestamp: buf.timestamp}
+		}
+		buf.forward(stub, size)
+	}
+}
+
+func (t *PacketDuplicateToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*PacketDuplicateToxicState)
+	state.buffer.flush(stub)
+}
+
+func (t *PacketDuplicateToxic) DatagramOnly() {}
+
+func (t *PacketDuplicateToxic) NewState() interface{} {
+	return new(PacketDuplicateToxicState)
+}
+
+func init() {
+	Register("packet_duplicate", new(PacketDuplicateToxic))
+}
@@ -0,0 +1,22 @@
+package toxics_test
+
+import (
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func TestPacketDuplicateToxic(t *testing.T) {
+	toxic := &toxics.PacketDuplicateToxic{Probability: 1}
+	stub, input, output := NewFramedStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: datagrams("one", "two")}
+
+	expected := datagrams("one", "one", "two", "two")
+	if got := readChunks(output); string(got) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	close(input)
+}
@@ -0,0 +1,82 @@
+package toxics
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+// The PacketLatencyToxic delays each UDP datagram by latency +/- jitter on its
+// own, so that jitter reorders datagrams like on a real network. It is meant
+// for proxies with the udp or dns protocol.
+type PacketLatencyToxic struct {
+	// Times in milliseconds
+	Latency int64 `json:"latency"`
+	Jitter  int64 `json:"jitter"`
+}
+
+type PacketLatencyToxicState struct {
+	buffer messageBuffer
+	// Delayed datagrams by release time
+	queue []*stream.StreamChunk
+}
+
+func (t *PacketLatencyToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*PacketLatencyToxicState)
+	buf := &state.buffer
+	latency := &LatencyToxic{Latency: t.Latency, Jitter: t.Jitter}
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if len(state.queue) > 0 {
+			wait := time.Until(state.queue[0].Timestamp)
+			if wait <= 0 {
+				stub.Output <- state.queue[0]
+				state.queue = state.queue[1:]
+				continue
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		size, ok := buf.datagram(stub, timeout)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !ok {
+			return
+		}
+		if size == 0 {
+			continue
+		}
+
+		release := buf.timestamp.Add(latency.delay())
+		datagram := &stream.StreamChunk{Data: buf.next(size), Timestamp: release}
+		i := sort.Search(len(state.queue), func(i int) bool {
+			return state.queue[i].Timestamp.After(release)
+		})
+		state.queue = append(state.queue, nil)
+		copy(state.queue[i+1:], state.queue[i:])
+		state.queue[i] = datagram
+	}
+}
+
+func (t *PacketLatencyToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*PacketLatencyToxicState)
+	for _, datagram := range state.queue {
+		stub.Output <- datagram
+	}
+	state.queue = nil
+	state.buffer.flush(stub)
+}
+
+func (t *PacketLatencyToxic) DatagramOnly() {}
+
+func (t *PacketLatencyToxic) NewState() interface{} {
+	return new(PacketLatencyToxicState)
+}
+
+func init() {
+	Register("packet_latency", new(PacketLatencyToxic))
+}
@@ -0,0 +1,29 @@
+package toxics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func TestPacketLatencyToxicDelaysEachDatagram(t *testing.T) {
+	toxic := &toxics.PacketLatencyToxic{Latency: 100}
+	stub, input, output := NewFramedStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := time.Now()
+	input <- &stream.StreamChunk{Data: datagrams("one"), Timestamp: start}
+	input <- &stream.StreamChunk{Data: datagrams("two"), Timestamp: start.Add(50 * time.Millisecond)}
+
+	for i, expected := range []string{"one", "two"} {
+		c := <-output
+		if string(c.Data) != string(datagrams(expected)) {
+			t.Errorf("Expected %q, got %q", expected, c.Data)
+		}
+		delay := time.Duration(100+50*i) * time.Millisecond
+		AssertDeltaTime(t, "Datagram "+expected, time.Since(start), delay, 20*time.Millisecond)
+	}
+	close(input)
+}
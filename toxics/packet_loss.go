@@ -0,0 +1,46 @@
+package toxics
+
+import "math/rand"
+
+// The PacketLossToxic drops UDP datagrams at random. It is meant for proxies
+// with the udp or dns protocol.
+type PacketLossToxic struct {
+	// Probability of a datagram being dropped, between 0 and 1
+	Probability float64 `json:"probability"`
+}
+
+type PacketLossToxicState struct {
+	buffer messageBuffer
+}
+
+func (t *PacketLossToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*PacketLossToxicState)
+	buf := &state.buffer
+	for {
+		size, ok := buf.datagram(stub, nil)
+		if !ok {
+			return
+		}
+		// #nosec G404 -- no need for cryptographic randomness
+		if rand.Float64() < t.Probability {
+			buf.discard(size)
+		} else {
+			buf.forward(stub, size)
+		}
+	}
+}
+
+func (t *PacketLossToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*PacketLossToxicState)
+	state.buffer.flush(stub)
+}
+
+func (t *PacketLossToxic) DatagramOnly() {}
+
+func (t *PacketLossToxic) NewState() interface{} {
+	return new(PacketLossToxicState)
+}
+
+func init() {
+	Register("packet_loss", new(PacketLossToxic))
+}
@@ -0,0 +1,42 @@
+package toxics_test
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+// datagrams frames UDP datagrams the way udp proxies pass them to toxics.
+func datagrams(payloads ...string) []byte {
+	var data []byte
+	for _, payload := range payloads {
+		data = binary.BigEndian.AppendUint16(data, uint16(len(payload)))
+		data = append(data, payload...)
+	}
+	return data
+}
+
+func TestPacketLossToxic(t *testing.T) {
+	for _, tc := range []struct {
+		probability float64
+		expected    []byte
+	}{
+		{0, datagrams("one", "two")},
+		{1, nil},
+	} {
+		toxic := &toxics.PacketLossToxic{Probability: tc.probability}
+		stub, input, output := NewFramedStub(toxic)
+		go toxic.Pipe(stub)
+
+		data := datagrams("one", "two")
+		input <- &stream.StreamChunk{Data: data[:4]}
+		input <- &stream.StreamChunk{Data: data[4:]}
+
+		if got := readChunks(output); string(got) != string(tc.expected) {
+			t.Errorf("Probability %v: expected %q, got %q", tc.probability, tc.expected, got)
+		}
+		close(input)
+	}
+}
@@ -0,0 +1,64 @@
+package toxics
+
+import "time"
+
+// The PacketRateToxic limits the rate of UDP datagrams with a token bucket,
+// dropping the datagrams over the limit like a policer would. It is meant for
+// proxies with the udp or dns protocol.
+type PacketRateToxic struct {
+	// Datagrams per second
+	Rate float64 `json:"rate"`
+	// Datagrams that can be sent at once above the rate, defaults to 1
+	Burst float64 `json:"burst"`
+}
+
+type PacketRateToxicState struct {
+	buffer messageBuffer
+	tokens float64
+	last   time.Time
+}
+
+func (t *PacketRateToxic) burst() float64 {
+	return max(t.Burst, 1)
+}
+
+func (t *PacketRateToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*PacketRateToxicState)
+	buf := &state.buffer
+	for {
+		size, ok := buf.datagram(stub, nil)
+		if !ok {
+			return
+		}
+
+		now := time.Now()
+		if state.last.IsZero() {
+			state.tokens = t.burst()
+		} else {
+			state.tokens = min(state.tokens+now.Sub(state.last).Seconds()*t.Rate, t.burst())
+		}
+		state.last = now
+
+		if state.tokens < 1 {
+			buf.discard(size)
+			continue
+		}
+		state.tokens--
+		buf.forward(stub, size)
+	}
+}
+
+func (t *PacketRateToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*PacketRateToxicState)
+	state.buffer.flush(stub)
+}
+
+func (t *PacketRateToxic) DatagramOnly() {}
+
+func (t *PacketRateToxic) NewState() interface{} {
+	return new(PacketRateToxicState)
+}
+
+func init() {
+	Register("packet_rate", new(PacketRateToxic))
+}
@@ -0,0 +1,119 @@
+package toxics
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+// The PacketReorderToxic holds UDP datagrams back at random until the
+// following datagrams got through. It is meant for proxies with the udp or dns
+// protocol.
+type PacketReorderToxic struct {
+	// Probability of a datagram being held back, between 0 and 1
+	Probability float64 `json:"probability"`
+	// Number of datagrams to let through before a held back one, defaults
+	// to 1
+	Gap int `json:"gap"`
+	// Longest time in milliseconds to hold a datagram back, defaults to 100
+	Delay int64 `json:"delay"`
+}
+
+type PacketReorderToxicState struct {
+	buffer messageBuffer
+	held   []*heldDatagram
+}
+
+type heldDatagram struct {
+	chunk *stream.StreamChunk
+	// Datagrams let through since it was held back
+	passed   int
+	deadline time.Time
+}
+
+func (t *PacketReorderToxic) gap() int {
+	if t.Gap <= 0 {
+		return 1
+	}
+	return t.Gap
+}
+
+func (t *PacketReorderToxic) delay() time.Duration {
+	if t.Delay <= 0 {
+		return 100 * time.Millisecond
+	}
+	return time.Duration(t.Delay) * time.Millisecond
+}
+
+// release sends the held back datagrams that waited long enough, in the order
+// they arrived.
+func (t *PacketReorderToxic) release(stub *ToxicStub) {
+	state := stub.State.(*PacketReorderToxicState)
+	held := state.held[:0]
+	for _, datagram := range state.held {
+		if datagram.passed >= t.gap() || !time.Now().Before(datagram.deadline) {
+			stub.Output <- datagram.chunk
+		} else {
+			held = append(held, datagram)
+		}
+	}
+	state.held = held
+}
+
+func (t *PacketReorderToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*PacketReorderToxicState)
+	buf := &state.buffer
+	for {
+		t.release(stub)
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if len(state.held) > 0 {
+			timer = time.NewTimer(time.Until(state.held[0].deadline))
+			timeout = timer.C
+		}
+		size, ok := buf.datagram(stub, timeout)
+		if timer != nil {
+			timer.Stop()
+		}
+		if !ok {
+			return
+		}
+		if size == 0 {
+			continue
+		}
+
+		// #nosec G404 -- no need for cryptographic randomness
+		if rand.Float64() < t.Probability {
+			state.held = append(state.held, &heldDatagram{
+				chunk:    &stream.StreamChunk{Data: buf.next(size), Timestamp: buf.timestamp},
+				deadline: time.Now().Add(t.delay()),
+			})
+			continue
+		}
+		buf.forward(stub, size)
+		for _, datagram := range state.held {
+			datagram.passed++
+		}
+	}
+}
+
+func (t *PacketReorderToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*PacketReorderToxicState)
+	state.buffer.flush(stub)
+	for _, datagram := range state.held {
+		stub.Output <- datagram.chunk
+	}
+	state.held = nil
+}
+
+func (t *PacketReorderToxic) DatagramOnly() {}
+
+func (t *PacketReorderToxic) NewState() interface{} {
+	return new(PacketReorderToxicState)
+}
+
+func init() {
+	Register("packet_reorder", new(PacketReorderToxic))
+}
@@ -0,0 +1,45 @@
+package toxics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func TestPacketReorderToxicReleasesAfterGap(t *testing.T) {
+	toxic := &toxics.PacketReorderToxic{Probability: 1, Gap: 2, Delay: 1000}
+	stub, input, output := NewFramedStub(toxic)
+	wrapper := &toxics.ToxicWrapper{Toxic: toxic, Toxicity: 1}
+	go stub.Run(wrapper)
+
+	input <- &stream.StreamChunk{Data: datagrams("one")}
+	// Let the remaining datagrams through, like an update would
+	stub.InterruptToxic()
+	toxic.Probability = 0
+	go stub.Run(wrapper)
+	input <- &stream.StreamChunk{Data: datagrams("two", "three", "four")}
+
+	expected := datagrams("two", "three", "one", "four")
+	if got := readChunks(output); string(got) != string(expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	close(input)
+}
+
+func TestPacketReorderToxicReleasesAfterDelay(t *testing.T) {
+	toxic := &toxics.PacketReorderToxic{Probability: 1, Delay: 50}
+	stub, input, output := NewFramedStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := time.Now()
+	input <- &stream.StreamChunk{Data: datagrams("one")}
+
+	c := <-output
+	AssertDeltaTime(t, "Held datagram", time.Since(start), 50*time.Millisecond, 20*time.Millisecond)
+	if string(c.Data) != string(datagrams("one")) {
+		t.Errorf("Expected the held datagram, got %q", c.Data)
+	}
+	close(input)
+}
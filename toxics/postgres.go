@@ -0,0 +1,291 @@
+package toxics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const (
+	postgresProtocolVersion = 3 << 16
+	postgresSSLRequest      = 80877103
+	postgresGSSENCRequest   = 80877104
+	postgresMaxStartupSize  = 10000
+)
+
+var errPostgresErrorCode = errors.New("error_code must be a 5 character SQLSTATE")
+
+var (
+	postgresBegin = regexp.MustCompile(`(?i)^\s*(BEGIN|START\s+TRANSACTION)\b`)
+	postgresEnd   = regexp.MustCompile(
+		`(?i)^\s*(COMMIT|END|ABORT|ROLLBACK)\b(\s*;?\s*$|\s+(WORK|TRANSACTION|AND)\b)`,
+	)
+)
+
+// The PostgresToxic fails SQL statements matching a pattern with an
+// ErrorResponse, as if the server had raised it, or holds them back before the
+// server sees them. It reads the messages clients send, so it only acts on the
+// upstream stream, and leaves SSL and GSSAPI encrypted sessions alone.
+type PostgresToxic struct {
+	// Regular expression matched against the SQL of Query and Parse messages.
+	// An empty pattern matches every statement.
+	Match string `json:"match"`
+	// SQLSTATE to fail matching statements with, e.g. 40001. If empty, no
+	// error is returned and the statements are only delayed.
+	ErrorCode    string `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+	// Severity of the error. Defaults to FATAL for 57P0x codes and ERROR
+	// otherwise. FATAL and PANIC errors close the connection.
+	Severity string `json:"severity"`
+	// Milliseconds a matching statement is held back before it is sent on or
+	// failed
+	Latency int64 `json:"latency"`
+}
+
+type PostgresToxicState struct {
+	buffer      messageBuffer
+	started     bool
+	passthrough bool
+	// Discarding extended query messages until the next Sync.
+	discarding bool
+	// Transaction status as reported in ReadyForQuery.
+	transaction byte
+}
+
+func (t *PostgresToxic) severity() string {
+	if t.Severity != "" {
+		return strings.ToUpper(t.Severity)
+	}
+	if strings.HasPrefix(t.ErrorCode, "57P0") {
+		return "FATAL"
+	}
+	return "ERROR"
+}
+
+func (t *PostgresToxic) Validate() error {
+	if err := validatePatterns(t.Match); err != nil {
+		return err
+	}
+	if t.ErrorCode != "" && len(t.ErrorCode) != 5 {
+		return errPostgresErrorCode
+	}
+	if t.Severity != "" {
+		err := validateChoice("severity", strings.ToUpper(t.Severity), "ERROR", "FATAL", "PANIC")
+		if err != nil {
+			return err
+		}
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+func (t *PostgresToxic) errorResponse() []byte {
+	message := t.ErrorMessage
+	if message == "" {
+		message = "statement failed by toxiproxy"
+	}
+	severity := t.severity()
+
+	var body bytes.Buffer
+	for _, field := range []struct {
+		kind  byte
+		value string
+	}{
+		{'S', severity},
+		{'V', severity},
+		{'C', t.ErrorCode},
+		{'M', message},
+	} {
+		body.WriteByte(field.kind)
+		body.WriteString(field.value)
+		body.WriteByte(0)
+	}
+	body.WriteByte(0)
+	return postgresMessage('E', body.Bytes())
+}
+
+// postgresFramer frames the messages exchanged after startup: a type byte,
+// then the length of the message without it.
+type postgresFramer struct{}
+
+func (postgresFramer) Frame(data []byte) (int, error) {
+	if len(data) < 5 {
+		return 0, nil
+	}
+	length := binary.BigEndian.Uint32(data[1:])
+	if length < 4 || length > stream.MaxMessageSize {
+		return 0, stream.ErrInvalidFraming
+	}
+	if len(data) < 1+int(length) {
+		return 0, nil
+	}
+	return 1 + int(length), nil
+}
+
+// postgresReadyForQuery reports whether a server message ends the answer to a
+// simple query or a Sync.
+func postgresReadyForQuery(message []byte) bool {
+	return message[0] == 'Z'
+}
+
+func postgresMessage(kind byte, body []byte) []byte {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = kind
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// postgresQuery returns the SQL text of a Query or Parse message.
+func postgresQuery(kind byte, body []byte) string {
+	if kind == 'P' {
+		// Skip the prepared statement name
+		i := bytes.IndexByte(body, 0)
+		if i < 0 {
+			return ""
+		}
+		body = body[i+1:]
+	}
+	if i := bytes.IndexByte(body, 0); i >= 0 {
+		body = body[:i]
+	}
+	return string(body)
+}
+
+func (state *PostgresToxicState) track(query string) {
+	if postgresBegin.MatchString(query) {
+		state.transaction = 'T'
+	} else if postgresEnd.MatchString(query) {
+		state.transaction = 'I'
+	}
+}
+
+func (t *PostgresToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*PostgresToxicState)
+	buf := &state.buffer
+
+	match, err := regexp.Compile(t.Match)
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !state.started {
+			if !buf.fill(stub, 8) {
+				return
+			}
+			length := int(binary.BigEndian.Uint32(buf.data))
+			code := binary.BigEndian.Uint32(buf.data[4:])
+			switch {
+			case code == postgresSSLRequest || code == postgresGSSENCRequest:
+				// The server answers with a single byte, the client then
+				// either starts encryption or sends a StartupMessage.
+				buf.forward(stub, 8)
+			case code == postgresProtocolVersion && length >= 8 && length <= postgresMaxStartupSize:
+				buf.pass(length)
+				state.started = true
+				stub.Reply.SetFraming(postgresFramer{}, postgresReadyForQuery)
+			default:
+				// Encrypted, cancel request or not PostgreSQL at all
+				state.passthrough = true
+			}
+			continue
+		}
+
+		if !buf.fill(stub, 5) {
+			return
+		}
+		kind := buf.data[0]
+		size := 1 + int(binary.BigEndian.Uint32(buf.data[1:]))
+		if size < 5 {
+			state.passthrough = true
+			continue
+		}
+
+		if state.discarding {
+			if !buf.fill(stub, size) {
+				return
+			}
+			buf.discard(size)
+			if kind == 'S' {
+				state.discarding = false
+				stub.Reply.Send(postgresMessage('Z', []byte{state.transaction}))
+			}
+			continue
+		}
+
+		if kind != 'Q' && kind != 'P' {
+			if kind == 'S' {
+				stub.Reply.Forwarded()
+			}
+			buf.pass(size)
+			continue
+		}
+
+		if !buf.fill(stub, size) {
+			return
+		}
+		query := postgresQuery(kind, buf.data[5:size])
+		if !match.MatchString(query) {
+			state.track(query)
+			if kind == 'Q' {
+				stub.Reply.Forwarded()
+			}
+			buf.forward(stub, size)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		if t.ErrorCode == "" {
+			state.track(query)
+			if kind == 'Q' {
+				stub.Reply.Forwarded()
+			}
+			buf.forward(stub, size)
+			continue
+		}
+
+		buf.discard(size)
+		stub.Reply.Send(t.errorResponse())
+		if severity := t.severity(); severity == "FATAL" || severity == "PANIC" {
+			stub.Close()
+			return
+		}
+		if state.transaction != 'I' {
+			state.transaction = 'E'
+		}
+		if kind == 'Q' {
+			stub.Reply.Send(postgresMessage('Z', []byte{state.transaction}))
+		} else {
+			// The server would ignore the rest of the pipeline until Sync.
+			state.discarding = true
+		}
+	}
+}
+
+func (t *PostgresToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*PostgresToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *PostgresToxic) NewState() interface{} {
+	return &PostgresToxicState{transaction: 'I'}
+}
+
+func init() {
+	Register("postgres", new(PostgresToxic))
+}
@@ -0,0 +1,251 @@
+package toxics_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func postgresMessage(kind byte, body string) []byte {
+	msg := []byte{kind, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+func postgresStartup() []byte {
+	body := "user\x00test\x00\x00"
+	msg := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(msg, uint32(8+len(body)))
+	binary.BigEndian.PutUint32(msg[4:], 3<<16)
+	return append(msg, body...)
+}
+
+func TestPostgresToxicPassesUnmatchedQueries(t *testing.T) {
+	toxic := &toxics.PostgresToxic{Match: "^UPDATE", ErrorCode: "40001"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	startup := postgresStartup()
+	query := postgresMessage('Q', "SELECT 1\x00")
+	// Split the messages across chunks to exercise buffering
+	data := append(startup, query...)
+	input <- &stream.StreamChunk{Data: data[:3]}
+	input <- &stream.StreamChunk{Data: data[3 : len(startup)+2]}
+	input <- &stream.StreamChunk{Data: data[len(startup)+2:]}
+
+	if got := readChunks(output); !bytes.Equal(got, data) {
+		t.Errorf("Expected data to be passed through, got %q", got)
+	}
+	if got := readChunks(replies); len(got) != 0 {
+		t.Errorf("Expected no reply, got %q", got)
+	}
+	close(input)
+}
+
+func TestPostgresToxicInjectsErrorResponse(t *testing.T) {
+	toxic := &toxics.PostgresToxic{Match: "(?i)^update accounts", ErrorCode: "40001"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: postgresStartup()}
+	input <- &stream.StreamChunk{Data: postgresMessage('Q', "BEGIN\x00")}
+	input <- &stream.StreamChunk{Data: postgresMessage('Q', "UPDATE accounts SET x = 1\x00")}
+
+	expected := append(postgresStartup(), postgresMessage('Q', "BEGIN\x00")...)
+	if got := readChunks(output); !bytes.Equal(got, expected) {
+		t.Errorf("Expected matching query to be dropped, got %q", got)
+	}
+
+	if got := readChunks(replies); len(got) != 0 {
+		t.Fatalf("Expected the error to wait for the answer to BEGIN, got %q", got)
+	}
+	// The server answers BEGIN in two writes
+	answer := append(postgresMessage('C', "BEGIN\x00"), postgresMessage('Z', "T")...)
+	stub.Reply.Write(answer[:8])
+	stub.Reply.Write(answer[8:])
+
+	reply := readChunks(replies)
+	if !bytes.HasPrefix(reply, answer) {
+		t.Fatalf("Expected the answer to BEGIN first, got %q", reply)
+	}
+	reply = reply[len(answer):]
+	if len(reply) == 0 || reply[0] != 'E' {
+		t.Fatalf("Expected an ErrorResponse, got %q", reply)
+	}
+	if !bytes.Contains(reply, []byte("C40001\x00")) {
+		t.Errorf("ErrorResponse is missing the SQLSTATE: %q", reply)
+	}
+	ready := postgresMessage('Z', "E")
+	if !bytes.HasSuffix(reply, ready) {
+		t.Errorf("Expected ReadyForQuery in a failed transaction, got %q", reply)
+	}
+	close(input)
+}
+
+func TestPostgresToxicDiscardsPipelineUntilSync(t *testing.T) {
+	toxic := &toxics.PostgresToxic{Match: "accounts", ErrorCode: "40P01"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: postgresStartup()}
+	var pipeline []byte
+	pipeline = append(pipeline, postgresMessage('P', "\x00SELECT * FROM accounts\x00\x00\x00")...)
+	pipeline = append(pipeline, postgresMessage('B', "\x00\x00\x00\x00\x00\x00\x00\x00")...)
+	pipeline = append(pipeline, postgresMessage('E', "\x00\x00\x00\x00\x00")...)
+	pipeline = append(pipeline, postgresMessage('S', "")...)
+	input <- &stream.StreamChunk{Data: pipeline}
+
+	if got := readChunks(output); !bytes.Equal(got, postgresStartup()) {
+		t.Errorf("Expected the pipeline to be dropped, got %q", got)
+	}
+	reply := readChunks(replies)
+	if !bytes.HasSuffix(reply, postgresMessage('Z', "I")) {
+		t.Errorf("Expected ReadyForQuery after Sync, got %q", reply)
+	}
+	close(input)
+}
+
+func TestPostgresToxicFatalClosesConnection(t *testing.T) {
+	toxic := &toxics.PostgresToxic{ErrorCode: "57P01"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: postgresStartup()}
+	input <- &stream.StreamChunk{Data: postgresMessage('Q', "SELECT 1\x00")}
+
+	if got := readChunks(output); !bytes.Equal(got, postgresStartup()) {
+		t.Errorf("Expected only the startup message, got %q", got)
+	}
+	if !stub.Closed() {
+		t.Error("Expected the stub to be closed after a FATAL error")
+	}
+	if reply := readChunks(replies); !bytes.Contains(reply, []byte("SFATAL\x00")) {
+		t.Errorf("Expected a FATAL ErrorResponse, got %q", reply)
+	}
+}
+
+func TestPostgresToxicDelaysMatchingQueries(t *testing.T) {
+	toxic := &toxics.PostgresToxic{Match: "pg_sleep", Latency: 100}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: postgresStartup()}
+	<-output
+
+	start := time.Now()
+	input <- &stream.StreamChunk{Data: postgresMessage('Q', "SELECT 1\x00")}
+	<-output
+	AssertDeltaTime(t, "Unmatched query", time.Since(start), 0, 20*time.Millisecond)
+
+	start = time.Now()
+	input <- &stream.StreamChunk{Data: postgresMessage('Q', "SELECT pg_sleep(0)\x00")}
+	<-output
+	AssertDeltaTime(t, "Matched query", time.Since(start), 100*time.Millisecond, 20*time.Millisecond)
+	close(input)
+}
+
+func TestPostgresToxicRepliesThroughProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+
+	proxy := NewTestProxy("test", ln.Addr().String())
+	proxy.Start()
+	defer proxy.Stop()
+
+	_, err = proxy.Toxics.AddToxicJson(ToxicToJson(t, "pg", "postgres", "upstream",
+		&toxics.PostgresToxic{Match: "^SELECT", ErrorCode: "40001"}))
+	if err != nil {
+		t.Fatal("AddToxicJson returned error:", err)
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial TCP server", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(append(postgresStartup(), postgresMessage('Q', "SELECT 1\x00")...))
+	if err != nil {
+		t.Fatal("Failed writing to proxy", err)
+	}
+
+	header := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal("Failed reading reply from proxy", err)
+	}
+	if header[0] != 'E' {
+		t.Errorf("Expected an ErrorResponse from the proxy, got %q", header)
+	}
+}
+
+func TestPostgresToxicRepliesAfterPipelinedAnswers(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	defer ln.Close()
+
+	answer := append(postgresMessage('T', "\x00\x00"), postgresMessage('D', "\x00\x00")...)
+	answer = append(answer, postgresMessage('C', "SELECT 1\x00")...)
+	answer = append(answer, postgresMessage('Z', "I")...)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request := make([]byte, len(postgresStartup())+len(postgresMessage('Q', "SELECT 1\x00")))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		// Answer slowly, in the middle of a message
+		conn.Write(answer[:3])
+		time.Sleep(50 * time.Millisecond)
+		conn.Write(answer[3:])
+		time.Sleep(time.Second)
+	}()
+
+	proxy := NewTestProxy("test", ln.Addr().String())
+	proxy.Start()
+	defer proxy.Stop()
+
+	_, err = proxy.Toxics.AddToxicJson(ToxicToJson(t, "pg", "postgres", "upstream",
+		&toxics.PostgresToxic{Match: "^UPDATE", ErrorCode: "40001"}))
+	if err != nil {
+		t.Fatal("AddToxicJson returned error:", err)
+	}
+
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial TCP server", err)
+	}
+	defer conn.Close()
+
+	pipeline := append(postgresStartup(), postgresMessage('Q', "SELECT 1\x00")...)
+	pipeline = append(pipeline, postgresMessage('Q', "UPDATE accounts SET x = 1\x00")...)
+	if _, err := conn.Write(pipeline); err != nil {
+		t.Fatal("Failed writing to proxy", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, len(answer)+1)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("Failed reading from proxy", err)
+	}
+	if !bytes.Equal(got[:len(answer)], answer) {
+		t.Errorf("Expected the answer to the first query, got %q", got)
+	}
+	if got[len(answer)] != 'E' {
+		t.Errorf("Expected an ErrorResponse after the answer, got %q", got[len(answer):])
+	}
+}
@@ -0,0 +1,277 @@
+package toxics
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const redisMaxInlineSize = 64 * 1024
+
+var (
+	errRedisError        = errors.New("error must be a single word")
+	errRedisErrorMessage = errors.New("error_message can't contain line breaks")
+)
+
+var redisErrors = map[string]string{
+	"ERR":      "ERR command failed by toxiproxy",
+	"LOADING":  "LOADING Redis is loading the dataset in memory",
+	"READONLY": "READONLY You can't write against a read only replica.",
+	"BUSY": "BUSY Redis is busy running a script. " +
+		"You can only call SCRIPT KILL or SHUTDOWN NOSCRIPT.",
+	"OOM": "OOM command not allowed when used memory > 'maxmemory'.",
+}
+
+// The RedisToxic fails commands matching a command name and key pattern with
+// an error reply, or adds latency to them. It parses the RESP commands clients
+// send, so it belongs on the upstream stream. The error reply waits for the
+// server to answer the commands pipelined before the failed one.
+type RedisToxic struct {
+	// Regular expression matched against the upper-cased command name
+	Command string `json:"command"`
+	// Regular expression matched against the first argument of the command,
+	// usually the key
+	Key string `json:"key"`
+	// Error to reply with: ERR, LOADING, READONLY, BUSY, OOM or any other
+	// error prefix. If empty, matching commands are only delayed.
+	Error        string `json:"error"`
+	ErrorMessage string `json:"error_message"`
+	// Milliseconds to hold a matching command for before sending or failing
+	// it
+	Latency int64 `json:"latency"`
+}
+
+type RedisToxicState struct {
+	buffer      messageBuffer
+	passthrough bool
+}
+
+func (t *RedisToxic) Validate() error {
+	if err := validatePatterns(t.Command, t.Key); err != nil {
+		return err
+	}
+	if strings.ContainsAny(t.Error, " \t\r\n") {
+		return errRedisError
+	}
+	if strings.ContainsAny(t.ErrorMessage, "\r\n") {
+		return errRedisErrorMessage
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+func (t *RedisToxic) errorReply() []byte {
+	prefix := strings.ToUpper(t.Error)
+	message := redisErrors[prefix]
+	if t.ErrorMessage != "" {
+		message = prefix + " " + t.ErrorMessage
+	} else if message == "" {
+		message = prefix + " command failed by toxiproxy"
+	}
+	return []byte("-" + message + "\r\n")
+}
+
+// redisLine returns the line at the start of data without its CRLF, and the
+// size of the line including it. The size is 0 if the line is incomplete.
+func redisLine(data []byte) ([]byte, int) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, 0
+	}
+	return bytes.TrimSuffix(data[:i], []byte{'\r'}), i + 1
+}
+
+// redisCommand parses a command from the start of data. It returns the command
+// arguments and the size of the command in bytes. The size is 0 if the command
+// is incomplete, or -1 if data isn't a valid command.
+func redisCommand(data []byte) ([][]byte, int) {
+	if len(data) == 0 {
+		return nil, 0
+	}
+
+	if data[0] != '*' {
+		// Inline command
+		line, size := redisLine(data)
+		if size == 0 {
+			if len(data) > redisMaxInlineSize {
+				return nil, -1
+			}
+			return nil, 0
+		}
+		return bytes.Fields(line), size
+	}
+
+	line, size := redisLine(data)
+	if size == 0 {
+		return nil, 0
+	}
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil {
+		return nil, -1
+	}
+
+	args := make([][]byte, 0, min(max(count, 0), 16))
+	for i := 0; i < count; i++ {
+		line, n := redisLine(data[size:])
+		if n == 0 {
+			return nil, 0
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, -1
+		}
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil || length < 0 {
+			return nil, -1
+		}
+		size += n
+		if len(data) < size+length+2 {
+			return nil, 0
+		}
+		args = append(args, data[size:size+length])
+		size += length + 2
+	}
+	return args, size
+}
+
+// redisFramer frames the RESP2 and RESP3 values servers reply with.
+type redisFramer struct{}
+
+func (redisFramer) Frame(data []byte) (int, error) {
+	line, size := redisLine(data)
+	if size == 0 {
+		if len(data) > redisMaxInlineSize {
+			return 0, stream.ErrMessageTooLarge
+		}
+		return 0, nil
+	}
+	if len(line) == 0 {
+		return 0, stream.ErrInvalidFraming
+	}
+
+	switch line[0] {
+	case '+', '-', ':', '_', '#', ',', '(':
+		return size, nil
+	case '$', '!', '=':
+		length, err := strconv.Atoi(string(line[1:]))
+		if err != nil || length > stream.MaxMessageSize {
+			return 0, stream.ErrInvalidFraming
+		}
+		if length < 0 {
+			return size, nil
+		}
+		if len(data) < size+length+2 {
+			return 0, nil
+		}
+		return size + length + 2, nil
+	case '*', '~', '>', '%', '|':
+		count, err := strconv.Atoi(string(line[1:]))
+		if err != nil || count > stream.MaxMessageSize {
+			return 0, stream.ErrInvalidFraming
+		}
+		if line[0] == '%' || line[0] == '|' {
+			// Maps and attributes hold pairs of values
+			count *= 2
+		}
+		for i := 0; i < count; i++ {
+			n, err := redisFramer{}.Frame(data[size:])
+			if n == 0 {
+				return 0, err
+			}
+			size += n
+		}
+		return size, nil
+	}
+	return 0, stream.ErrInvalidFraming
+}
+
+// redisAnswer reports whether a reply answers a command, rather than being a
+// RESP3 push or the attributes of the next reply.
+func redisAnswer(reply []byte) bool {
+	return reply[0] != '>' && reply[0] != '|'
+}
+
+func (t *RedisToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*RedisToxicState)
+	buf := &state.buffer
+	if stub.Reply != nil {
+		stub.Reply.SetFraming(redisFramer{}, redisAnswer)
+	}
+
+	var key *regexp.Regexp
+	command, err := regexp.Compile(t.Command)
+	if err == nil {
+		key, err = regexp.Compile(t.Key)
+	}
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !buf.fill(stub, 1) {
+			return
+		}
+		args, size := redisCommand(buf.data)
+		if size < 0 {
+			state.passthrough = true
+			continue
+		}
+		if size == 0 {
+			if !buf.fill(stub, len(buf.data)+1) {
+				return
+			}
+			continue
+		}
+		if len(args) == 0 {
+			// Empty inline commands aren't answered
+			buf.forward(stub, size)
+			continue
+		}
+
+		var first []byte
+		if len(args) > 1 {
+			first = args[1]
+		}
+		if !command.Match(bytes.ToUpper(args[0])) || !key.Match(first) {
+			stub.Reply.Forwarded()
+			buf.forward(stub, size)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		if t.Error == "" {
+			stub.Reply.Forwarded()
+			buf.forward(stub, size)
+			continue
+		}
+		buf.discard(size)
+		stub.Reply.Send(t.errorReply())
+	}
+}
+
+func (t *RedisToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*RedisToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *RedisToxic) NewState() interface{} {
+	return new(RedisToxicState)
+}
+
+func init() {
+	Register("redis", new(RedisToxic))
+}
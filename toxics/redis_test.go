@@ -0,0 +1,114 @@
+package toxics_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func TestRedisToxicRepliesWithError(t *testing.T) {
+	toxic := &toxics.RedisToxic{Command: "^GET$", Key: "^session:", Error: "loading"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	other := []byte("*2\r\n$3\r\nGET\r\n$6\r\nuser:1\r\n")
+	matched := []byte("*2\r\n$3\r\nget\r\n$9\r\nsession:1\r\n")
+	data := append(append([]byte{}, other...), matched...)
+	// Split in the middle of a bulk string
+	input <- &stream.StreamChunk{Data: data[:30]}
+	input <- &stream.StreamChunk{Data: data[30:]}
+
+	if got := readChunks(output); !bytes.Equal(got, other) {
+		t.Errorf("Expected only the unmatched command, got %q", got)
+	}
+	stub.Reply.Write([]byte("$5\r\nal"))
+	if got := readChunks(replies); string(got) != "$5\r\nal" {
+		t.Errorf("Expected the error to wait for the answer to GET user:1, got %q", got)
+	}
+	stub.Reply.Write([]byte("ice\r\n"))
+	expected := "ice\r\n-LOADING Redis is loading the dataset in memory\r\n"
+	if got := readChunks(replies); string(got) != expected {
+		t.Errorf("Expected LOADING error after the answer, got %q", got)
+	}
+	close(input)
+}
+
+func TestRedisToxicInlineCommands(t *testing.T) {
+	toxic := &toxics.RedisToxic{Command: "^SET$", Error: "READONLY"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: []byte("PING\r\nSET foo bar\r\n")}
+
+	if got := readChunks(output); string(got) != "PING\r\n" {
+		t.Errorf("Expected PING to pass through, got %q", got)
+	}
+	stub.Reply.Write([]byte("+PONG\r\n"))
+	expected := "+PONG\r\n-READONLY You can't write against a read only replica.\r\n"
+	if got := readChunks(replies); string(got) != expected {
+		t.Errorf("Expected READONLY error, got %q", got)
+	}
+	close(input)
+}
+
+func TestRedisToxicCustomError(t *testing.T) {
+	toxic := &toxics.RedisToxic{Error: "MOVED", ErrorMessage: "3999 127.0.0.1:6381"}
+	stub, input, _, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: []byte("*1\r\n$4\r\nPING\r\n")}
+
+	if got := readChunks(replies); string(got) != "-MOVED 3999 127.0.0.1:6381\r\n" {
+		t.Errorf("Expected custom error, got %q", got)
+	}
+	close(input)
+}
+
+func TestRedisToxicDelaysMatchingCommands(t *testing.T) {
+	toxic := &toxics.RedisToxic{Key: "^slow$", Latency: 100}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := time.Now()
+	input <- &stream.StreamChunk{Data: []byte("GET fast\r\n")}
+	<-output
+	AssertDeltaTime(t, "Unmatched command", time.Since(start), 0, 20*time.Millisecond)
+
+	start = time.Now()
+	input <- &stream.StreamChunk{Data: []byte("GET slow\r\n")}
+	<-output
+	AssertDeltaTime(
+		t,
+		"Matched command",
+		time.Since(start),
+		100*time.Millisecond,
+		20*time.Millisecond,
+	)
+	close(input)
+}
+
+func TestRedisToxicErrorWaitsForNestedReplies(t *testing.T) {
+	toxic := &toxics.RedisToxic{Command: "^DEL$", Error: "ERR"}
+	stub, input, _, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: []byte("HGETALL h\r\nDEL h\r\n")}
+	push := ">2\r\n+message\r\n+hi\r\n"
+	stub.Reply.Write([]byte(push))
+	if got := readChunks(replies); string(got) != push {
+		t.Errorf("Expected the error to wait for an answer after a push, got %q", got)
+	}
+	// A map answering HGETALL, in two writes
+	answer := "%2\r\n$1\r\na\r\n*2\r\n:1\r\n$-1\r\n+b\r\n_\r\n"
+	stub.Reply.Write([]byte(answer[:20]))
+	stub.Reply.Write([]byte(answer[20:]))
+
+	reply := readChunks(replies)
+	if !bytes.HasSuffix(reply, []byte(answer+"-ERR command failed by toxiproxy\r\n")) {
+		t.Errorf("Expected the error after the map, got %q", reply)
+	}
+	close(input)
+}
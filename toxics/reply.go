@@ -0,0 +1,187 @@
+package toxics
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+// Replies writes to one peer of a connection, both the messages the other peer
+// sends it and the replies toxics answer its requests with themselves. A reply
+// is held back until the peer got the end of the message being written, and
+// the answers to the requests forwarded before it, so that pipelined requests
+// are still answered in order.
+type Replies struct {
+	lock sync.Mutex
+	w    io.Writer
+	// Splits what is written into messages, and reports the messages that end
+	// the answer to a request. Without it, replies are written between writes.
+	framer   stream.Framer
+	answers  func(message []byte) bool
+	framed   bool
+	watchers []func(message []byte)
+	// Bytes of the message being written, and how many of them the framer
+	// already scanned
+	partial []byte
+	scanned int
+	// Requests forwarded to the other peer, and those it answered
+	requests int
+	answered int
+	queue    []queuedReply
+}
+
+type queuedReply struct {
+	data []byte
+	// Number of answered requests the reply waits for
+	after int
+}
+
+func NewReplies(w io.Writer) *Replies {
+	return &Replies{w: w}
+}
+
+// SetFraming lets replies wait for whole messages framed by framer, and for
+// the answers to forwarded requests, which end with the messages answers
+// returns true for. Protocols whose clients wait for each answer before the
+// next request have no need for answers, which may be nil. Only the first
+// framing set on a connection is used, as toxics of the same protocol set the
+// same one.
+func (r *Replies) SetFraming(framer stream.Framer, answers func(message []byte) bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.framed {
+		r.framed = true
+		r.framer = framer
+		r.answers = answers
+	}
+}
+
+// ClearFraming stops framing what is written, when the toxic that set it is
+// removed, and writes the replies still queued.
+func (r *Replies) ClearFraming() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.framed = false
+	r.framer = nil
+	r.answers = nil
+	r.watchers = nil
+	r.partial = nil
+	r.scanned = 0
+	return r.flush()
+}
+
+// Forwarded counts a request forwarded to the other peer, which replies sent
+// afterwards wait for the answer to. It must be called before the request is
+// forwarded, and only for requests that are always answered. Requests aren't
+// counted if the framing can't tell the answers apart.
+func (r *Replies) Forwarded() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.framer != nil && r.answers != nil {
+		r.requests++
+	}
+}
+
+// Watch calls f with each message the peer is sent once framing is set, before
+// it is written, so that toxics reading the peer's answers can follow what it
+// was asked. f must not use the Replies.
+func (r *Replies) Watch(f func(message []byte)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.watchers = append(r.watchers, f)
+}
+
+// Send writes a reply to the peer once the requests forwarded before were
+// answered.
+func (r *Replies) Send(reply []byte) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.queue = append(r.queue, queuedReply{bytes.Clone(reply), r.requests})
+	if len(r.partial) > 0 {
+		return nil
+	}
+	return r.flush()
+}
+
+// Write writes what the other peer sends, followed by the replies that were
+// waiting for it.
+func (r *Replies) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// The messages are framed first, as the peer may answer them right away
+	r.frame(p)
+	n, err := r.w.Write(p)
+	if err != nil || len(r.partial) > 0 {
+		return n, err
+	}
+	return n, r.flush()
+}
+
+// frame splits what is written into messages, counting the answers among them.
+func (r *Replies) frame(p []byte) {
+	if r.framer == nil {
+		return
+	}
+	r.partial = append(r.partial, p...)
+	offset := 0
+	for {
+		var size int
+		var err error
+		if resumable, ok := r.framer.(stream.ResumableFramer); ok && offset == 0 {
+			size, err = resumable.Resume(r.partial, r.scanned)
+		} else {
+			size, err = r.framer.Frame(r.partial[offset:])
+		}
+		if err == nil && size == 0 && len(r.partial)-offset > stream.MaxMessageSize {
+			err = stream.ErrMessageTooLarge
+		}
+		if err != nil {
+			// Without messages, replies only wait for the end of a write
+			r.framer = nil
+			r.partial = nil
+			r.scanned = 0
+			return
+		}
+		if size == 0 {
+			break
+		}
+		message := r.partial[offset : offset+size]
+		for _, watch := range r.watchers {
+			watch(message)
+		}
+		if r.answered < r.requests && r.answers != nil && r.answers(message) {
+			r.answered++
+		}
+		offset += size
+	}
+	r.partial = append(r.partial[:0], r.partial[offset:]...)
+	r.scanned = len(r.partial)
+}
+
+// Close writes the replies still queued, as the answers they wait for won't
+// come anymore.
+func (r *Replies) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.framer = nil
+	r.partial = nil
+	return r.flush()
+}
+
+// flush writes the queued replies whose requests were answered. It must only
+// be called between messages.
+func (r *Replies) flush() error {
+	for len(r.queue) > 0 {
+		if r.framer != nil && r.queue[0].after > r.answered {
+			return nil
+		}
+		_, err := r.w.Write(r.queue[0].data)
+		r.queue = r.queue[1:]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
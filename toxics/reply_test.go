@@ -0,0 +1,110 @@
+package toxics_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+// lastLine reports whether a line is the last of an answer, ending with a dot.
+func lastLine(message []byte) bool {
+	return bytes.Equal(message, []byte(".\n"))
+}
+
+func TestRepliesWaitForTheEndOfAMessage(t *testing.T) {
+	var peer bytes.Buffer
+	replies := toxics.NewReplies(&peer)
+	replies.SetFraming(stream.LineFramer{}, lastLine)
+
+	replies.Write([]byte("event"))
+	replies.Send([]byte("reply\n"))
+	if peer.String() != "event" {
+		t.Errorf("Expected the reply to wait for the end of the line, got %q", peer.String())
+	}
+	replies.Write([]byte(" 1\n"))
+	if peer.String() != "event 1\nreply\n" {
+		t.Errorf("Expected the reply after the line, got %q", peer.String())
+	}
+}
+
+func TestRepliesWaitForForwardedRequests(t *testing.T) {
+	var peer bytes.Buffer
+	replies := toxics.NewReplies(&peer)
+	replies.SetFraming(stream.LineFramer{}, lastLine)
+
+	replies.Forwarded()
+	replies.Forwarded()
+	replies.Send([]byte("reply\n"))
+	replies.Write([]byte("answer 1\n.\nanswer 2\n"))
+	if peer.String() != "answer 1\n.\nanswer 2\n" {
+		t.Errorf("Expected the reply to wait for the second answer, got %q", peer.String())
+	}
+	replies.Write([]byte(".\n"))
+	if peer.String() != "answer 1\n.\nanswer 2\n.\nreply\n" {
+		t.Errorf("Expected the reply after the second answer, got %q", peer.String())
+	}
+
+	replies.Send([]byte("next\n"))
+	if !bytes.HasSuffix(peer.Bytes(), []byte("reply\nnext\n")) {
+		t.Errorf("Expected replies without outstanding requests to be sent, got %q", peer.String())
+	}
+}
+
+func TestRepliesWithoutFraming(t *testing.T) {
+	var peer bytes.Buffer
+	replies := toxics.NewReplies(&peer)
+
+	replies.Forwarded()
+	replies.Send([]byte("reply"))
+	replies.Write([]byte("data"))
+	if peer.String() != "replydata" {
+		t.Errorf("Expected the reply to be sent right away, got %q", peer.String())
+	}
+}
+
+func TestRepliesSentOnClose(t *testing.T) {
+	var peer bytes.Buffer
+	replies := toxics.NewReplies(&peer)
+	replies.SetFraming(stream.LineFramer{}, lastLine)
+
+	replies.Forwarded()
+	replies.Send([]byte("reply\n"))
+	replies.Close()
+	if peer.String() != "reply\n" {
+		t.Errorf("Expected queued replies to be sent on close, got %q", peer.String())
+	}
+}
+
+func TestRepliesWithoutAnswers(t *testing.T) {
+	var peer bytes.Buffer
+	replies := toxics.NewReplies(&peer)
+	replies.SetFraming(stream.LineFramer{}, nil)
+
+	// Requests can't be counted without answers, e.g. for another toxic
+	replies.Forwarded()
+	replies.Write([]byte("answer\n"))
+	replies.Send([]byte("reply\n"))
+	if peer.String() != "answer\nreply\n" {
+		t.Errorf("Expected the reply to be sent between messages, got %q", peer.String())
+	}
+}
+
+func TestRepliesClearFraming(t *testing.T) {
+	var peer bytes.Buffer
+	replies := toxics.NewReplies(&peer)
+	replies.SetFraming(stream.LineFramer{}, lastLine)
+
+	replies.Forwarded()
+	replies.Send([]byte("reply\n"))
+	replies.ClearFraming()
+	if peer.String() != "reply\n" {
+		t.Errorf("Expected queued replies to be sent once framing is cleared, got %q", peer.String())
+	}
+	replies.Write([]byte("event"))
+	replies.Send([]byte("next\n"))
+	if peer.String() != "reply\neventnext\n" {
+		t.Errorf("Expected replies to be sent between writes, got %q", peer.String())
+	}
+}
@@ -0,0 +1,376 @@
+package toxics
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const (
+	smtpMaxLineSize = 64 * 1024
+
+	smtpStartMailInput      = 354
+	smtpServiceNotAvailable = 421
+)
+
+var (
+	smtpEndOfData  = []byte("\r\n.\r\n")
+	smtpPipelining = []byte("PIPELINING")
+)
+
+var (
+	errSMTPReplyCode = errors.New("reply_code must be between 200 and 599")
+	errSMTPReplyText = errors.New("reply_text can't contain line breaks")
+)
+
+var smtpReplies = map[int]string{
+	421: "Service not available, closing transmission channel",
+	450: "Requested mail action not taken: mailbox unavailable",
+	451: "Requested action aborted: local error in processing",
+	452: "Requested action not taken: insufficient system storage",
+	550: "Requested action not taken: mailbox unavailable",
+	551: "User not local",
+	552: "Requested mail action aborted: exceeded storage allocation",
+	553: "Requested action not taken: mailbox name not allowed",
+	554: "Transaction failed",
+}
+
+// The SMTPToxic answers the SMTP commands matching a command and argument
+// pattern with a reply code of its own, or slows them down. Added upstream it
+// acts on commands, and its replies come after the server's replies to the
+// commands pipelined before. Added downstream it slows down the greeting
+// banner, and removes PIPELINING from EHLO replies so that clients wait for
+// each reply. After STARTTLS the connection is left alone.
+type SMTPToxic struct {
+	// Regular expression matched against the upper-cased command verb, e.g.
+	// "^RCPT$". An empty pattern matches every command.
+	Command string `json:"command"`
+	// Regular expression matched against the rest of the command line
+	Argument string `json:"argument"`
+	// Reply code to answer matching commands with, e.g. 451 or 550. The
+	// connection is closed after a 421. If 0, matching commands are only
+	// delayed.
+	ReplyCode int    `json:"reply_code"`
+	ReplyText string `json:"reply_text"`
+	// Milliseconds to wait before a matching command, or the greeting banner
+	// on the downstream stream, is handled
+	Latency int64 `json:"latency"`
+}
+
+type SMTPToxicState struct {
+	buffer      messageBuffer
+	started     bool
+	passthrough bool
+	// Whether this is the server side of the connection
+	server bool
+	// DATA was sent, the server's reply to it tells whether the message
+	// content follows
+	dataSent bool
+	// Code of the last reply the server sent, 0 if it isn't known
+	lastReply atomic.Int32
+	// Passing through the content of a message after DATA
+	data      bool
+	dataStart bool
+	// Whether the greeting banner was forwarded
+	greeted bool
+}
+
+func (t *SMTPToxic) Validate() error {
+	if err := validatePatterns(t.Command, t.Argument); err != nil {
+		return err
+	}
+	if t.ReplyCode != 0 && (t.ReplyCode < 200 || t.ReplyCode > 599) {
+		return errSMTPReplyCode
+	}
+	if strings.ContainsAny(t.ReplyText, "\r\n") {
+		return errSMTPReplyText
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+func (t *SMTPToxic) reply() []byte {
+	text := t.ReplyText
+	if text == "" {
+		text = smtpReplies[t.ReplyCode]
+	}
+	if text == "" {
+		text = "command rejected by toxiproxy"
+	}
+	return []byte(strconv.Itoa(t.ReplyCode) + " " + text + "\r\n")
+}
+
+// smtpLine returns the size of the line at the start of data including its
+// line ending, 0 if it is incomplete or -1 if it is too long.
+func smtpLine(data []byte) int {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		if len(data) > smtpMaxLineSize {
+			return -1
+		}
+		return 0
+	}
+	return i + 1
+}
+
+// smtpReplyFramer frames SMTP replies, whose lines but the last have a dash
+// after the reply code.
+type smtpReplyFramer struct{}
+
+func (smtpReplyFramer) Frame(data []byte) (int, error) {
+	size := 0
+	for {
+		n := smtpLine(data[size:])
+		if n < 0 {
+			return 0, stream.ErrMessageTooLarge
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		line := data[size : size+n]
+		size += n
+		if len(line) < 4 || line[3] != '-' {
+			return size, nil
+		}
+	}
+}
+
+// smtpAnswer reports whether a reply answers a command, which all replies but
+// the greeting banner do.
+func smtpAnswer([]byte) bool {
+	return true
+}
+
+func (t *SMTPToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*SMTPToxicState)
+	buf := &state.buffer
+
+	var argument *regexp.Regexp
+	command, err := regexp.Compile(t.Command)
+	if err == nil {
+		argument, err = regexp.Compile(t.Argument)
+	}
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !buf.fill(stub, 1) {
+			return
+		}
+		if !state.started {
+			// Servers start with a reply code
+			if !buf.fill(stub, 3) {
+				return
+			}
+			state.started = true
+			_, codeErr := strconv.Atoi(string(buf.data[:3]))
+			state.server = codeErr == nil
+			if state.server && !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+				return
+			}
+			if !state.server {
+				// Clients only speak after the greeting banner
+				stub.Reply.SetFraming(smtpReplyFramer{}, smtpAnswer)
+				stub.Reply.Watch(func(reply []byte) {
+					if code, err := strconv.Atoi(string(reply[:min(len(reply), 3)])); err == nil {
+						state.lastReply.Store(int32(code))
+					}
+				})
+			}
+		}
+
+		if state.server {
+			if !t.pipeReply(stub) {
+				return
+			}
+			continue
+		}
+
+		if state.dataSent {
+			// Clients wait for the reply to DATA before they go on, so it was
+			// seen unless the reply framing was lost.
+			state.dataSent = false
+			code := state.lastReply.Load()
+			state.data = code == 0 || code == smtpStartMailInput
+			state.dataStart = state.data
+		}
+
+		if state.data {
+			// The message ends with a line containing a single dot
+			if !buf.fill(stub, 3) {
+				return
+			}
+			if state.dataStart && bytes.HasPrefix(buf.data, smtpEndOfData[2:]) {
+				stub.Reply.Forwarded()
+				buf.forward(stub, len(smtpEndOfData)-2)
+				state.data = false
+				continue
+			}
+			state.dataStart = false
+			end := bytes.Index(buf.data, smtpEndOfData)
+			if end < 0 {
+				keep := min(len(buf.data), len(smtpEndOfData)-1)
+				buf.forward(stub, len(buf.data)-keep)
+				if !buf.fill(stub, keep+1) {
+					return
+				}
+				continue
+			}
+			stub.Reply.Forwarded()
+			buf.forward(stub, end+len(smtpEndOfData))
+			state.data = false
+			continue
+		}
+
+		size := smtpLine(buf.data)
+		if size < 0 {
+			state.passthrough = true
+			continue
+		}
+		if size == 0 {
+			if !buf.fill(stub, len(buf.data)+1) {
+				return
+			}
+			continue
+		}
+
+		line := bytes.TrimRight(buf.data[:size], "\r\n")
+		verb, arg, _ := bytes.Cut(line, []byte{' '})
+		verb = bytes.ToUpper(verb)
+
+		if !command.Match(verb) || !argument.Match(arg) {
+			t.forwardCommand(stub, verb, arg, size)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		if t.ReplyCode == 0 {
+			t.forwardCommand(stub, verb, arg, size)
+			continue
+		}
+		buf.discard(size)
+		stub.Reply.Send(t.reply())
+		if t.ReplyCode == smtpServiceNotAvailable {
+			buf.discard(len(buf.data))
+			stub.Close()
+			return
+		}
+	}
+}
+
+// forwardCommand sends a command to the server, keeping track of the commands
+// that change how the rest of the stream is parsed.
+func (t *SMTPToxic) forwardCommand(stub *ToxicStub, verb, arg []byte, size int) {
+	state := stub.State.(*SMTPToxicState)
+	buf := &state.buffer
+	if string(verb) == "DATA" {
+		// Before the server can answer it
+		state.lastReply.Store(0)
+		state.dataSent = true
+	}
+	stub.Reply.Forwarded()
+	buf.forward(stub, size)
+
+	switch string(verb) {
+	case "BDAT":
+		// BDAT <size> [LAST]
+		fields := bytes.Fields(arg)
+		if len(fields) > 0 {
+			if n, err := strconv.Atoi(string(fields[0])); err == nil && n >= 0 {
+				buf.pass(n)
+			}
+		}
+	case "STARTTLS":
+		state.passthrough = true
+	}
+}
+
+// pipeReply forwards a reply from the server, removing PIPELINING from EHLO
+// replies. It returns false if the toxic was interrupted.
+func (t *SMTPToxic) pipeReply(stub *ToxicStub) bool {
+	state := stub.State.(*SMTPToxicState)
+	buf := &state.buffer
+
+	// Multiline replies use a dash after the code on all but the last line
+	var lines [][]byte
+	size := 0
+	for {
+		n := smtpLine(buf.data[size:])
+		if n < 0 {
+			state.passthrough = true
+			return true
+		}
+		if n == 0 {
+			if !buf.fill(stub, len(buf.data)+1) {
+				return false
+			}
+			continue
+		}
+		line := buf.data[size : size+n]
+		lines = append(lines, line)
+		size += n
+		if len(line) < 4 || line[3] != '-' {
+			break
+		}
+	}
+
+	if bytes.HasPrefix(lines[0], []byte("220")) && state.greeted {
+		// Ready to start TLS
+		buf.forward(stub, size)
+		state.passthrough = true
+		return true
+	}
+	state.greeted = true
+
+	var reply []byte
+	removed := false
+	for i, line := range lines {
+		if i > 0 && len(line) >= 4 &&
+			bytes.EqualFold(bytes.TrimRight(line[4:], "\r\n"), smtpPipelining) {
+			removed = true
+			if i == len(lines)-1 {
+				// The previous line becomes the last one
+				reply[len(reply)-len(lines[i-1])+3] = ' '
+			}
+			continue
+		}
+		reply = append(reply, line...)
+	}
+	if !removed {
+		buf.forward(stub, size)
+		return true
+	}
+	buf.discard(size)
+	stub.Output <- &stream.StreamChunk{Data: reply, Timestamp: buf.timestamp}
+	return true
+}
+
+func (t *SMTPToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*SMTPToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *SMTPToxic) NewState() interface{} {
+	return new(SMTPToxicState)
+}
+
+func init() {
+	Register("smtp", new(SMTPToxic))
+}
@@ -0,0 +1,115 @@
+package toxics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+func TestSMTPToxicRejectsRecipients(t *testing.T) {
+	toxic := &toxics.SMTPToxic{Command: "^RCPT$", Argument: "@bounce\\.example>", ReplyCode: 550}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: []byte("EHLO client\r\nMAIL FROM:<a@example.com>\r\n")}
+	recipients := "RCPT TO:<b@bounce.example>\r\nRCPT TO:<c@example.com>\r\n"
+	input <- &stream.StreamChunk{Data: []byte(recipients)}
+
+	expected := "EHLO client\r\nMAIL FROM:<a@example.com>\r\nRCPT TO:<c@example.com>\r\n"
+	if got := readChunks(output); string(got) != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	// The reply waits for the server's replies to the pipelined commands
+	stub.Reply.Write([]byte("250-mx.example\r\n250 PIPELINING\r\n"))
+	if got := readChunks(replies); string(got) != "250-mx.example\r\n250 PIPELINING\r\n" {
+		t.Errorf("Expected only the EHLO reply, got %q", got)
+	}
+	stub.Reply.Write([]byte("250 OK\r\n"))
+	expected = "250 OK\r\n550 Requested action not taken: mailbox unavailable\r\n"
+	if got := readChunks(replies); string(got) != expected {
+		t.Errorf("Expected 550 reply after the MAIL reply, got %q", got)
+	}
+	close(input)
+}
+
+func TestSMTPToxicIgnoresMessageContent(t *testing.T) {
+	toxic := &toxics.SMTPToxic{Command: "^QUIT$", ReplyCode: 451, ReplyText: "4.3.0 Try again later"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: []byte("DATA\r\n")}
+	readChunks(output)
+	stub.Reply.Write([]byte("354 Start mail input\r\n"))
+
+	data := "Subject: hi\r\n\r\nQUIT\r\n.\r\n"
+	input <- &stream.StreamChunk{Data: []byte(data[:14])}
+	input <- &stream.StreamChunk{Data: []byte(data[14:])}
+	if got := readChunks(output); string(got) != data {
+		t.Errorf("Expected message to pass through, got %q", got)
+	}
+	stub.Reply.Write([]byte("250 OK\r\n"))
+
+	input <- &stream.StreamChunk{Data: []byte("QUIT\r\n")}
+	expected := "354 Start mail input\r\n250 OK\r\n451 4.3.0 Try again later\r\n"
+	if got := readChunks(replies); string(got) != expected {
+		t.Errorf("Expected 451 reply, got %q", got)
+	}
+	close(input)
+}
+
+func TestSMTPToxicParsesCommandsAfterRejectedData(t *testing.T) {
+	toxic := &toxics.SMTPToxic{Command: "^QUIT$", ReplyCode: 451}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: []byte("DATA\r\n")}
+	readChunks(output)
+	stub.Reply.Write([]byte("554 No valid recipients\r\n"))
+
+	input <- &stream.StreamChunk{Data: []byte("QUIT\r\n")}
+	if got := readChunks(output); len(got) != 0 {
+		t.Errorf("Expected QUIT to be answered by the toxic, got %q", got)
+	}
+	expected := "554 No valid recipients\r\n" +
+		"451 Requested action aborted: local error in processing\r\n"
+	if got := readChunks(replies); string(got) != expected {
+		t.Errorf("Expected 451 reply, got %q", got)
+	}
+	close(input)
+}
+
+func TestSMTPToxicClosesAfterServiceNotAvailable(t *testing.T) {
+	toxic := &toxics.SMTPToxic{Command: "^MAIL$", ReplyCode: 421}
+	stub, input, _, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	input <- &stream.StreamChunk{Data: []byte("MAIL FROM:<a@example.com>\r\n")}
+
+	expected := "421 Service not available, closing transmission channel\r\n"
+	if got := readChunks(replies); string(got) != expected {
+		t.Errorf("Expected 421 reply, got %q", got)
+	}
+	if !stub.Closed() {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestSMTPToxicDelaysBannerAndRemovesPipelining(t *testing.T) {
+	toxic := &toxics.SMTPToxic{Latency: 100}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := time.Now()
+	input <- &stream.StreamChunk{Data: []byte("220 mx.example ESMTP\r\n")}
+	<-output
+	AssertDeltaTime(t, "Banner", time.Since(start), 100*time.Millisecond, 20*time.Millisecond)
+
+	ehlo := "250-mx.example\r\n250-SIZE 1000\r\n250 PIPELINING\r\n"
+	input <- &stream.StreamChunk{Data: []byte(ehlo)}
+	if got := readChunks(output); string(got) != "250-mx.example\r\n250 SIZE 1000\r\n" {
+		t.Errorf("Expected PIPELINING to be removed, got %q", got)
+	}
+	close(input)
+}
@@ -1,16 +1,44 @@
 package toxics
 
-import "time"
+import (
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
 
 // The TimeoutToxic stops any data from flowing through,
 // and will close the connection after a timeout.
 // If the timeout is set to 0, then the connection will not be closed.
+// With a framing, whole messages flow through until the Nth one.
 type TimeoutToxic struct {
 	// Times in milliseconds
 	Timeout int64 `json:"timeout"`
+	// Framing of messages, see stream.ParseFraming. If empty, data stops
+	// flowing right away.
+	Framing string `json:"framing"`
+	// Stop data from flowing at the Nth message
+	Every int64 `json:"every,omitempty"`
+}
+
+type TimeoutToxicState struct {
+	buffer messageBuffer
+	// Messages forwarded so far
+	messages int64
+	// Data stopped flowing
+	stopped bool
+}
+
+func (t *TimeoutToxic) Validate() error {
+	return validateFraming(t.Framing, t.Every)
 }
 
 func (t *TimeoutToxic) Pipe(stub *ToxicStub) {
+	if framer, err := stream.ParseFraming(t.Framing); err == nil {
+		if !t.pipeMessages(stub, framer) {
+			return
+		}
+	}
+
 	timeout := time.Duration(t.Timeout) * time.Millisecond
 	if timeout > 0 {
 		for {
@@ -44,10 +72,42 @@ func (t *TimeoutToxic) Pipe(stub *ToxicStub) {
 	}
 }
 
+// pipeMessages forwards messages framed by framer until the Nth one. It
+// returns true once data should stop flowing.
+func (t *TimeoutToxic) pipeMessages(stub *ToxicStub, framer stream.Framer) bool {
+	state := stub.State.(*TimeoutToxicState)
+	buf := &state.buffer
+	for !state.stopped {
+		size, ok := buf.message(stub, framer)
+		if !ok {
+			return false
+		}
+		if size < 0 || nth(state.messages+1, t.Every) {
+			state.stopped = true
+			break
+		}
+		buf.forward(stub, size)
+		state.messages++
+	}
+	// Drop the data on the ground.
+	buf.discard(len(buf.data))
+	return true
+}
+
 func (t *TimeoutToxic) Cleanup(stub *ToxicStub) {
+	// Connections are only left open if data is still flowing
+	state, ok := stub.State.(*TimeoutToxicState)
+	if _, err := stream.ParseFraming(t.Framing); ok && err == nil && !state.stopped {
+		state.buffer.flush(stub)
+		return
+	}
 	stub.Close()
 }
 
+func (t *TimeoutToxic) NewState() interface{} {
+	return new(TimeoutToxicState)
+}
+
 func init() {
-	Register("timeout", new(TimeoutToxic))
+	Register("timeout", &TimeoutToxic{Every: 1})
 }
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/Shopify/toxiproxy/v2"
+	"github.com/Shopify/toxiproxy/v2/stream"
 	"github.com/Shopify/toxiproxy/v2/testhelper"
 	"github.com/Shopify/toxiproxy/v2/toxics"
 )
@@ -118,3 +119,22 @@ func TestTimeoutToxicClosesConnectionOnRemove(t *testing.T) {
 		}
 	})
 }
+
+func TestTimeoutToxicFraming(t *testing.T) {
+	toxic := &toxics.TimeoutToxic{Timeout: 100, Framing: "line", Every: 3}
+	stub, input, output := NewFramedStub(toxic)
+	go toxic.Pipe(stub)
+
+	start := time.Now()
+	input <- &stream.StreamChunk{Data: []byte("one\ntwo\nthree\nfour\n")}
+
+	if got := readChunks(output); string(got) != "one\ntwo\n" {
+		t.Errorf("Expected the first two messages, got %q", got)
+	}
+	for !stub.Closed() && time.Since(start) < time.Second {
+		time.Sleep(time.Millisecond)
+	}
+	if !stub.Closed() {
+		t.Fatal("Expected the connection to be closed")
+	}
+}
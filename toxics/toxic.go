@@ -3,7 +3,10 @@ package toxics
 import (
 	"fmt"
 	"math/rand"
+	"net"
+	"path"
 	"reflect"
+	"strings"
 	"sync"
 	"time"
 
@@ -47,24 +50,44 @@ type StatefulToxic interface {
 	NewState() interface{}
 }
 
+// Validated toxics check their attributes when they are created or updated.
+type ValidatedToxic interface {
+	// Returns an error if the attributes can't be used
+	Validate() error
+}
+
+// Datagram toxics handle the framed UDP datagrams of proxies with the udp and
+// dns protocols, and can't be added to other proxies.
+type DatagramToxic interface {
+	// Marks the toxic, which does nothing else
+	DatagramOnly()
+}
+
 type ToxicWrapper struct {
-	Toxic      `json:"attributes"`
-	Name       string           `json:"name"`
-	Type       string           `json:"type"`
-	Stream     string           `json:"stream"`
-	Toxicity   float32          `json:"toxicity"`
-	Direction  stream.Direction `json:"-"`
-	Index      int              `json:"-"`
-	BufferSize int              `json:"-"`
+	Toxic       `json:"attributes"`
+	Name        string           `json:"name"`
+	Type        string           `json:"type"`
+	Stream      string           `json:"stream"`
+	Toxicity    float32          `json:"toxicity"`
+	Destination string           `json:"destination,omitempty"`
+	Direction   stream.Direction `json:"-"`
+	Index       int              `json:"-"`
+	BufferSize  int              `json:"-"`
 }
 
 type ToxicStub struct {
-	Input     <-chan *stream.StreamChunk
-	Output    chan<- *stream.StreamChunk
-	State     interface{}
-	Interrupt chan struct{}
-	running   chan struct{}
-	closed    chan struct{}
+	Input  <-chan *stream.StreamChunk
+	Output chan<- *stream.StreamChunk
+	// Reply writes back to the peer the Input is read from, skipping the other
+	// end of the link. Protocol-aware toxics use it to answer requests
+	// themselves. It is nil if the link source can't be written to.
+	Reply *Replies
+	// Destination is the host:port the link's connection was dialed to.
+	Destination string
+	State       interface{}
+	Interrupt   chan struct{}
+	running     chan struct{}
+	closed      chan struct{}
 }
 
 func NewToxicStub(input <-chan *stream.StreamChunk, output chan<- *stream.StreamChunk) *ToxicStub {
@@ -77,18 +100,44 @@ func NewToxicStub(input <-chan *stream.StreamChunk, output chan<- *stream.Stream
 }
 
 // Begin running a toxic on this stub, can be interrupted.
-// Runs a noop toxic randomly depending on toxicity.
+// Runs a noop toxic randomly depending on toxicity, or if the toxic is limited
+// to another destination.
 func (s *ToxicStub) Run(toxic *ToxicWrapper) {
 	s.running = make(chan struct{})
 	defer close(s.running)
 	randomToxicity := rand.Float32() // #nosec G404 -- was ignored before too
-	if randomToxicity < toxic.Toxicity {
+	if randomToxicity < toxic.Toxicity && toxic.MatchesDestination(s.Destination) {
 		toxic.Pipe(s)
 	} else {
 		new(NoopToxic).Pipe(s)
 	}
 }
 
+// MatchesDestination reports whether the toxic applies to links dialed to
+// destination. Toxics without a destination apply to all links, and toxics
+// with a destination without a port to all ports of the host. The destination
+// may have * and ? wildcards, as in path.Match, e.g. *.example.com or *:443.
+func (t *ToxicWrapper) MatchesDestination(destination string) bool {
+	if t.Destination == "" {
+		return true
+	}
+	pattern := strings.ToLower(t.Destination)
+	destination = strings.ToLower(destination)
+	if _, _, err := net.SplitHostPort(pattern); err != nil {
+		pattern = strings.Trim(pattern, "[]")
+		destination, _, err = net.SplitHostPort(destination)
+		if err != nil {
+			return false
+		}
+	}
+	// IPv6 addresses in brackets would be read as character classes
+	if pattern == destination {
+		return true
+	}
+	matched, _ := path.Match(pattern, destination)
+	return matched
+}
+
 // WriteOutput allows to write to Output with timeout to avoid deadlocks.
 // If duration is 0, then wait until other goroutines finish reading from Output.
 func (s *ToxicStub) WriteOutput(p *stream.StreamChunk, d time.Duration) error {
@@ -156,7 +205,10 @@ func New(wrapper *ToxicWrapper) Toxic {
 	if !ok {
 		return nil
 	}
-	wrapper.Toxic = reflect.New(reflect.TypeOf(orig).Elem()).Interface().(Toxic)
+	// The registered toxic holds the defaults of the attributes
+	toxic := reflect.New(reflect.TypeOf(orig).Elem())
+	toxic.Elem().Set(reflect.ValueOf(orig).Elem())
+	wrapper.Toxic = toxic.Interface().(Toxic)
 	if buffered, ok := wrapper.Toxic.(BufferedToxic); ok {
 		wrapper.BufferSize = buffered.GetBufferSize()
 	} else {
@@ -151,6 +151,37 @@ func AssertEchoResponse(t *testing.T, client, server net.Conn) {
 	}
 }
 
+// NewReplyStub returns a stub running toxic like on a link whose source can
+// be answered, with the replies the toxic sends written to replies.
+func NewReplyStub(toxic toxics.StatefulToxic) (
+	stub *toxics.ToxicStub, input, output, replies chan *stream.StreamChunk,
+) {
+	input = make(chan *stream.StreamChunk)
+	output = make(chan *stream.StreamChunk, 100)
+	replies = make(chan *stream.StreamChunk, 100)
+	stub = toxics.NewToxicStub(input, output)
+	stub.Reply = toxics.NewReplies(stream.NewChanWriter(replies))
+	stub.State = toxic.NewState()
+	return stub, input, output, replies
+}
+
+// readChunks returns the data of the chunks sent to output until it is closed
+// or nothing is sent for 100ms.
+func readChunks(output chan *stream.StreamChunk) []byte {
+	var buf bytes.Buffer
+	for {
+		select {
+		case c := <-output:
+			if c == nil {
+				return buf.Bytes()
+			}
+			buf.Write(c.Data)
+		case <-time.After(100 * time.Millisecond):
+			return buf.Bytes()
+		}
+	}
+}
+
 func TestPersistentConnections(t *testing.T) {
 	ctx := context.Background()
 
@@ -399,3 +430,40 @@ func TestToxicStub_WriteOutput(t *testing.T) {
 		}
 	})
 }
+
+func TestToxicWrapper_MatchesDestination(t *testing.T) {
+	cases := []struct {
+		toxic       string
+		destination string
+		matches     bool
+	}{
+		{"", "example.com:443", true},
+		{"example.com:443", "example.com:443", true},
+		{"Example.com:443", "example.com:443", true},
+		{"example.com:443", "example.com:80", false},
+		{"example.com", "example.com:80", true},
+		{"example.com", "example.org:80", false},
+		{"::1", "[::1]:80", true},
+		{"[::1]", "[::1]:80", true},
+		{"example.com", "", false},
+		{"*", "example.com:443", true},
+		{"*.example.com", "api.example.com:443", true},
+		{"*.example.com", "example.com:443", false},
+		{"*:443", "api.example.com:443", true},
+		{"*:443", "api.example.com:80", false},
+		{"api.*.com:*", "api.example.com:80", true},
+		{"api.*.com:*", "web.example.com:80", false},
+		{"db?.example.com", "db1.example.com:5432", true},
+		{"db?.example.com", "db12.example.com:5432", false},
+		{"[::1]:80", "[::1]:80", true},
+	}
+	for _, tc := range cases {
+		toxic := &toxics.ToxicWrapper{Destination: tc.toxic}
+		if toxic.MatchesDestination(tc.destination) != tc.matches {
+			t.Errorf(
+				"Expected toxic for %q to match %q: %v",
+				tc.toxic, tc.destination, tc.matches,
+			)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package toxics
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+)
+
+const (
+	wsFin    = 0x80
+	wsOpcode = 0x0F
+	wsMasked = 0x80
+
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPong         = 0xA
+
+	wsMaxHeaderSize = 64 * 1024
+	wsMaxFrameSize  = 16 * 1024 * 1024
+
+	// Going away
+	wsDefaultCloseCode = 1001
+)
+
+var (
+	errWebSocketCloseCode    = errors.New("close_code must be between 1000 and 4999")
+	errWebSocketFragmentSize = errors.New("fragment_size can't be negative")
+)
+
+var (
+	wsEndOfHeaders   = []byte("\r\n\r\n")
+	wsUpgrade        = regexp.MustCompile(`(?im)^upgrade:[ \t]*websocket[ \t]*\r?$`)
+	wsSwitchProtocol = regexp.MustCompile(`^HTTP/1\.1 101\b`)
+)
+
+// The WebSocketToxic acts on the text and binary messages of a WebSocket
+// connection with a matching payload, after its HTTP Upgrade handshake: they
+// can be answered with a Close frame, dropped, split into continuation frames
+// or slowed down. It can also drop Pong frames for the other side to see a
+// dead connection. Added upstream it acts on what clients send, added
+// downstream on what they receive. Connections without a WebSocket handshake
+// are left alone.
+type WebSocketToxic struct {
+	// Type of messages to match: text, binary, or empty for both
+	MessageType string `json:"message_type"`
+	// Regular expression matched against the payload of messages. Only the
+	// first frame of fragmented messages is matched. An empty pattern matches
+	// every message.
+	Payload string `json:"payload"`
+	// What to do with matching messages: close to send a Close frame and
+	// close the connection, drop to drop them, fragment to split them into
+	// continuation frames, or drop_pong to drop every Pong. If empty, matching
+	// messages are only delayed.
+	Action string `json:"action"`
+	// Status code and reason of the Close frame
+	CloseCode   int    `json:"close_code"`
+	CloseReason string `json:"close_reason"`
+	// Size in bytes of the payload of each fragment, defaults to 1
+	FragmentSize int `json:"fragment_size"`
+	// Milliseconds to wait before a matching message is handled
+	Latency int64 `json:"latency"`
+}
+
+type WebSocketToxicState struct {
+	buffer      messageBuffer
+	started     bool
+	passthrough bool
+	// Whether this is the client side of the connection
+	client bool
+	// Whether the handshake completed and frames are parsed
+	upgraded bool
+	// Dropping the continuation frames of a dropped message
+	dropping bool
+	// Waiting for the client to answer a Close frame sent by the toxic
+	closing bool
+}
+
+// wsHeaderSize returns the size of a frame header from its second byte.
+func wsHeaderSize(b byte) int {
+	size := 2
+	switch b & 0x7F {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if b&wsMasked != 0 {
+		size += 4
+	}
+	return size
+}
+
+// wsPayloadLength returns the payload length of the frame header at the
+// start of data.
+func wsPayloadLength(data []byte) uint64 {
+	switch data[1] & 0x7F {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(data[2:]))
+	case 127:
+		return binary.BigEndian.Uint64(data[2:])
+	}
+	return uint64(data[1] & 0x7F)
+}
+
+// wsFramer frames the response to the handshake, and then WebSocket frames.
+type wsFramer struct{}
+
+func (wsFramer) Frame(data []byte) (int, error) {
+	if len(data) < 2 {
+		return 0, nil
+	}
+	if data[0] == 'H' {
+		end := bytes.Index(data, wsEndOfHeaders)
+		if end < 0 {
+			if len(data) > wsMaxHeaderSize {
+				return 0, stream.ErrMessageTooLarge
+			}
+			return 0, nil
+		}
+		return end + len(wsEndOfHeaders), nil
+	}
+	header := wsHeaderSize(data[1])
+	if len(data) < header {
+		return 0, nil
+	}
+	length := wsPayloadLength(data)
+	if length > stream.MaxMessageSize {
+		return 0, stream.ErrMessageTooLarge
+	}
+	size := header + int(length)
+	if len(data) < size {
+		return 0, nil
+	}
+	return size, nil
+}
+
+func wsMask(payload, key []byte) {
+	for i := range payload {
+		payload[i] ^= key[i%4]
+	}
+}
+
+// wsAppendFrame appends a frame to data, masking its payload if key is set.
+func wsAppendFrame(data []byte, b0 byte, payload, key []byte) []byte {
+	var masked byte
+	if key != nil {
+		masked = wsMasked
+	}
+	data = append(data, b0)
+	switch {
+	case len(payload) < 126:
+		data = append(data, masked|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		data = append(data, masked|126)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(payload)))
+	default:
+		data = append(data, masked|127)
+		data = binary.BigEndian.AppendUint64(data, uint64(len(payload)))
+	}
+	if key == nil {
+		return append(data, payload...)
+	}
+	data = append(data, key...)
+	start := len(data)
+	data = append(data, payload...)
+	wsMask(data[start:], key)
+	return data
+}
+
+func (t *WebSocketToxic) Validate() error {
+	if err := validatePatterns(t.Payload); err != nil {
+		return err
+	}
+	if err := validateChoice("message_type", t.MessageType, "", "text", "binary"); err != nil {
+		return err
+	}
+	actions := []string{"", "close", "drop", "fragment", "drop_pong"}
+	if err := validateChoice("action", t.Action, actions...); err != nil {
+		return err
+	}
+	if t.CloseCode != 0 && (t.CloseCode < 1000 || t.CloseCode > 4999) {
+		return errWebSocketCloseCode
+	}
+	if t.FragmentSize < 0 {
+		return errWebSocketFragmentSize
+	}
+	if t.Latency < 0 {
+		return errLatency
+	}
+	return nil
+}
+
+func (t *WebSocketToxic) closeFrame() []byte {
+	code := t.CloseCode
+	if code == 0 {
+		code = wsDefaultCloseCode
+	}
+	reason := t.CloseReason[:min(len(t.CloseReason), 123)]
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	return wsAppendFrame(nil, wsFin|wsClose, payload, nil)
+}
+
+// fragment splits the payload of a message into a frame and continuation
+// frames, keeping the reserved bits on the first one only.
+func (t *WebSocketToxic) fragment(b0 byte, payload, key []byte) []byte {
+	size := t.FragmentSize
+	if size <= 0 {
+		size = 1
+	}
+	var data []byte
+	first := b0 &^ wsFin
+	for len(payload) > size {
+		data = wsAppendFrame(data, first, payload[:size], key)
+		payload = payload[size:]
+		first = wsContinuation
+	}
+	return wsAppendFrame(data, wsFin|first, payload, key)
+}
+
+func (t *WebSocketToxic) Pipe(stub *ToxicStub) {
+	state := stub.State.(*WebSocketToxicState)
+	buf := &state.buffer
+
+	payload, err := regexp.Compile(t.Payload)
+	for {
+		if state.passthrough || err != nil || stub.Reply == nil {
+			buf.flush(stub)
+			new(NoopToxic).Pipe(stub)
+			return
+		}
+
+		if !state.upgraded {
+			if !buf.fill(stub, 1) {
+				return
+			}
+			end := bytes.Index(buf.data, wsEndOfHeaders)
+			if end < 0 {
+				if len(buf.data) > wsMaxHeaderSize {
+					state.passthrough = true
+				} else if !buf.fill(stub, len(buf.data)+1) {
+					return
+				}
+				continue
+			}
+			size := end + len(wsEndOfHeaders)
+			headers := buf.data[:size]
+			if !state.started {
+				// Clients start with the request, servers with the response
+				state.started = true
+				state.client = !bytes.HasPrefix(headers, []byte("HTTP/"))
+			}
+			if state.client {
+				state.upgraded = bytes.HasPrefix(headers, []byte("GET ")) && wsUpgrade.Match(headers)
+				if state.upgraded {
+					// Close frames wait for whole frames from the server, which
+					// answers the handshake once it is forwarded.
+					stub.Reply.SetFraming(wsFramer{}, nil)
+				}
+			} else {
+				state.upgraded = wsSwitchProtocol.Match(headers)
+			}
+			buf.forward(stub, size)
+			state.passthrough = !state.upgraded
+			continue
+		}
+
+		if !buf.fill(stub, 2) {
+			return
+		}
+		header := wsHeaderSize(buf.data[1])
+		if !buf.fill(stub, header) {
+			return
+		}
+		length := wsPayloadLength(buf.data)
+		if length > 1<<62 {
+			state.passthrough = true
+			continue
+		}
+		if length > wsMaxFrameSize {
+			buf.pass(header + int(length))
+			continue
+		}
+		size := header + int(length)
+		b0 := buf.data[0]
+		opcode := b0 & wsOpcode
+
+		if state.closing {
+			// Everything but the client's Close frame is ignored after a close
+			if !buf.fill(stub, size) {
+				return
+			}
+			buf.discard(size)
+			if opcode == wsClose {
+				buf.discard(len(buf.data))
+				stub.Close()
+				return
+			}
+			continue
+		}
+
+		switch {
+		case opcode == wsPong && t.Action == "drop_pong",
+			opcode == wsContinuation && state.dropping:
+			if !buf.fill(stub, size) {
+				return
+			}
+			buf.discard(size)
+			if opcode == wsContinuation && b0&wsFin != 0 {
+				state.dropping = false
+			}
+			continue
+		case opcode == wsText && t.MessageType != "binary",
+			opcode == wsBinary && t.MessageType != "text":
+		default:
+			buf.pass(size)
+			continue
+		}
+
+		if !buf.fill(stub, size) {
+			return
+		}
+		var key []byte
+		if buf.data[1]&wsMasked != 0 {
+			key = append(key, buf.data[header-4:header]...)
+		}
+		data := append([]byte{}, buf.data[header:size]...)
+		if key != nil {
+			wsMask(data, key)
+		}
+		if !payload.Match(data) {
+			buf.forward(stub, size)
+			continue
+		}
+
+		if !sleep(stub, time.Duration(t.Latency)*time.Millisecond) {
+			return
+		}
+
+		switch t.Action {
+		case "close":
+			buf.discard(len(buf.data))
+			if state.client {
+				stub.Reply.Send(t.closeFrame())
+				state.closing = true
+				continue
+			}
+			stub.Output <- &stream.StreamChunk{Data: t.closeFrame(), Timestamp: buf.timestamp}
+			stub.Close()
+			return
+		case "drop":
+			buf.discard(size)
+			state.dropping = b0&wsFin == 0
+		case "fragment":
+			if b0&wsFin == 0 {
+				// Already fragmented
+				buf.forward(stub, size)
+				continue
+			}
+			buf.discard(size)
+			stub.Output <- &stream.StreamChunk{
+				Data:      t.fragment(b0, data, key),
+				Timestamp: buf.timestamp,
+			}
+		default:
+			buf.forward(stub, size)
+		}
+	}
+}
+
+func (t *WebSocketToxic) Cleanup(stub *ToxicStub) {
+	state := stub.State.(*WebSocketToxicState)
+	state.buffer.flush(stub)
+	if stub.Reply != nil {
+		stub.Reply.ClearFraming()
+	}
+}
+
+func (t *WebSocketToxic) NewState() interface{} {
+	return new(WebSocketToxicState)
+}
+
+func init() {
+	Register("websocket", new(WebSocketToxic))
+}
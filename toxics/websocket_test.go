@@ -0,0 +1,139 @@
+package toxics_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Shopify/toxiproxy/v2/stream"
+	"github.com/Shopify/toxiproxy/v2/toxics"
+)
+
+const (
+	wsRequest = "GET /socket HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	wsResponse = "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n"
+)
+
+// wsFrame builds a frame with a payload shorter than 126 bytes, masked like
+// client frames if key is set.
+func wsFrame(b0 byte, payload string, key []byte) []byte {
+	if key == nil {
+		return append([]byte{b0, byte(len(payload))}, payload...)
+	}
+	frame := append([]byte{b0, 0x80 | byte(len(payload))}, key...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^key[i%4])
+	}
+	return frame
+}
+
+func TestWebSocketToxicDropsMessages(t *testing.T) {
+	toxic := &toxics.WebSocketToxic{Payload: `"type":"ack"`, Action: "drop"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	key := []byte{1, 2, 3, 4}
+	ping := wsFrame(0x89, "", key)
+	kept := wsFrame(0x81, `{"type":"msg"}`, key)
+
+	var data []byte
+	data = append(data, wsRequest...)
+	data = append(data, wsFrame(0x81, `{"type":"ack"}`, key)...)
+	// A fragmented message with a ping in between
+	data = append(data, wsFrame(0x01, `{"type":"ack",`, key)...)
+	data = append(data, ping...)
+	data = append(data, wsFrame(0x80, `"id":1}`, key)...)
+	data = append(data, kept...)
+	input <- &stream.StreamChunk{Data: data[:len(wsRequest)+5]}
+	input <- &stream.StreamChunk{Data: data[len(wsRequest)+5:]}
+
+	expected := append(append([]byte(wsRequest), ping...), kept...)
+	if got := readChunks(output); !bytes.Equal(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	close(input)
+}
+
+func TestWebSocketToxicClosesClientConnection(t *testing.T) {
+	toxic := &toxics.WebSocketToxic{Action: "close", CloseCode: 1011, CloseReason: "boom"}
+	stub, input, output, replies := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	key := []byte{1, 2, 3, 4}
+	input <- &stream.StreamChunk{Data: []byte(wsRequest)}
+	readChunks(output)
+	// The server accepts the handshake and is in the middle of a message
+	message := wsFrame(0x81, "welcome", nil)
+	stub.Reply.Write(append([]byte(wsResponse), message[:4]...))
+	input <- &stream.StreamChunk{Data: wsFrame(0x81, "hello", key)}
+	if got := readChunks(replies); string(got) != wsResponse+string(message[:4]) {
+		t.Errorf("Expected the Close frame to wait for the end of the message, got %q", got)
+	}
+
+	stub.Reply.Write(message[4:])
+	closeFrame := []byte{0x88, 6, 0x03, 0xF3, 'b', 'o', 'o', 'm'}
+	if got := readChunks(replies); !bytes.Equal(got, append(message[4:], closeFrame...)) {
+		t.Errorf("Expected a Close frame, got %q", got)
+	}
+	input <- &stream.StreamChunk{Data: wsFrame(0x82, "late", key)}
+	input <- &stream.StreamChunk{Data: wsFrame(0x88, "\x03\xF3", key)}
+
+	if got := readChunks(output); len(got) != 0 {
+		t.Errorf("Expected only the handshake to be forwarded, got %q", got)
+	}
+	if !stub.Closed() {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestWebSocketToxicFragmentsMessages(t *testing.T) {
+	toxic := &toxics.WebSocketToxic{MessageType: "text", Action: "fragment", FragmentSize: 2}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	binary := wsFrame(0x82, "bin", nil)
+	input <- &stream.StreamChunk{Data: []byte(wsResponse)}
+	input <- &stream.StreamChunk{Data: append(wsFrame(0xC1, "hello", nil), binary...)}
+
+	var expected []byte
+	expected = append(expected, wsResponse...)
+	expected = append(expected, wsFrame(0x41, "he", nil)...)
+	expected = append(expected, wsFrame(0x00, "ll", nil)...)
+	expected = append(expected, wsFrame(0x80, "o", nil)...)
+	expected = append(expected, binary...)
+	if got := readChunks(output); !bytes.Equal(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	close(input)
+}
+
+func TestWebSocketToxicDropsPongs(t *testing.T) {
+	toxic := &toxics.WebSocketToxic{Action: "drop_pong"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	message := wsFrame(0x81, "hi", nil)
+	input <- &stream.StreamChunk{Data: []byte(wsResponse)}
+	input <- &stream.StreamChunk{Data: append(wsFrame(0x8A, "", nil), message...)}
+
+	if got := readChunks(output); !bytes.Equal(got, append([]byte(wsResponse), message...)) {
+		t.Errorf("Expected the pong to be dropped, got %q", got)
+	}
+	close(input)
+}
+
+func TestWebSocketToxicPassesThroughPlainHTTP(t *testing.T) {
+	toxic := &toxics.WebSocketToxic{Action: "drop"}
+	stub, input, output, _ := NewReplyStub(toxic)
+	go toxic.Pipe(stub)
+
+	data := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n\x81\x02hi"
+	input <- &stream.StreamChunk{Data: []byte(data)}
+
+	if got := readChunks(output); string(got) != data {
+		t.Errorf("Expected %q, got %q", data, got)
+	}
+	close(input)
+}
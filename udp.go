@@ -0,0 +1,264 @@
+package toxiproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Time after which the links of a UDP client without any traffic are
+	// closed
+	packetIdleTimeout = 30 * time.Second
+
+	maxDatagramSize = 65535
+)
+
+// dialPackets dials a UDP address.
+func (proxy *Proxy) dialPackets(ctx context.Context, address string) (net.Conn, error) {
+	return proxy.dialer("udp").DialContext(ctx, "udp", address)
+}
+
+// servePackets proxies UDP datagrams. Each client address gets a session with
+// its own links, on which datagrams are framed with a 2-byte big-endian length
+// prefix, as in DNS over TCP, so toxics can tell them apart.
+func (proxy *Proxy) servePackets(listener net.PacketConn) {
+	var lock sync.Mutex
+	clients := make(map[string]*packetClientConn)
+
+	// Sessions dial their upstream in their own goroutines, which are stopped
+	// and waited for with the proxy.
+	ctx, cancel := context.WithCancel(context.Background())
+	var dials sync.WaitGroup
+	defer dials.Wait()
+	defer cancel()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := listener.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				proxy.Logger.
+					Warn().
+					Err(err).
+					Msg("Error while reading datagram")
+			}
+			return
+		}
+
+		name := "udp:" + addr.String()
+		lock.Lock()
+		client, ok := clients[name]
+		if !ok {
+			client = newPacketClientConn(listener, addr, func() {
+				lock.Lock()
+				delete(clients, name)
+				lock.Unlock()
+			})
+			clients[name] = client
+		}
+		lock.Unlock()
+		if !ok {
+			proxy.Logger.
+				Info().
+				Str("client", name).
+				Msg("Accepted client")
+			dials.Add(1)
+			go func() {
+				defer dials.Done()
+				proxy.serveSession(ctx, name, client)
+			}()
+		}
+		// Datagrams are queued on the session while its upstream is dialed
+		client.receive(buf[:n])
+	}
+}
+
+// serveSession dials the upstream of a new UDP session and starts its links.
+// The session is closed if ctx is done first.
+func (proxy *Proxy) serveSession(ctx context.Context, name string, client *packetClientConn) {
+	upstream, destination, err := proxy.dialUpstream(ctx, proxy.dialPackets)
+	if err != nil {
+		proxy.Logger.
+			Err(err).
+			Str("client", name).
+			Msg("Unable to open connection to upstream")
+		client.Close()
+		return
+	}
+	if ctx.Err() != nil {
+		// The proxy stopped while dialing
+		upstream.Close()
+		client.Close()
+		return
+	}
+	proxy.startLinks(name, destination, client, &packetUpstreamConn{Conn: upstream})
+}
+
+// packetFrames splits data into the datagrams framed with a length prefix,
+// returning the incomplete rest.
+func packetFrames(data []byte, f func(msg []byte) error) ([]byte, error) {
+	for len(data) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(data))
+		if len(data) < size {
+			break
+		}
+		if err := f(data[2:size]); err != nil {
+			return nil, err
+		}
+		data = data[size:]
+	}
+	return data, nil
+}
+
+func packetFrame(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+}
+
+// packetClientConn is the session of a UDP client. Datagrams from the client
+// are read with a length prefix, and writes are split into datagrams at their
+// length prefixes.
+type packetClientConn struct {
+	listener net.PacketConn
+	addr     net.Addr
+	onClose  func()
+
+	datagrams chan []byte
+	read      []byte
+
+	lock      sync.Mutex
+	written   []byte
+	lastUsed  time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPacketClientConn(listener net.PacketConn, addr net.Addr, onClose func()) *packetClientConn {
+	return &packetClientConn{
+		listener:  listener,
+		addr:      addr,
+		onClose:   onClose,
+		datagrams: make(chan []byte, 64),
+		lastUsed:  time.Now(),
+		closed:    make(chan struct{}),
+	}
+}
+
+func (c *packetClientConn) touch() {
+	c.lock.Lock()
+	c.lastUsed = time.Now()
+	c.lock.Unlock()
+}
+
+// receive queues a datagram from the client, dropping it if the link is
+// falling behind.
+func (c *packetClientConn) receive(datagram []byte) {
+	c.touch()
+	select {
+	case c.datagrams <- packetFrame(datagram):
+	default:
+	}
+}
+
+func (c *packetClientConn) Read(p []byte) (int, error) {
+	for len(c.read) == 0 {
+		c.lock.Lock()
+		idle := time.Until(c.lastUsed.Add(packetIdleTimeout))
+		c.lock.Unlock()
+		if idle <= 0 {
+			c.Close()
+			return 0, io.EOF
+		}
+
+		timer := time.NewTimer(idle)
+		select {
+		case c.read = <-c.datagrams:
+		case <-timer.C:
+		case <-c.closed:
+			timer.Stop()
+			return 0, io.EOF
+		}
+		timer.Stop()
+	}
+	n := copy(p, c.read)
+	c.read = c.read[n:]
+	return n, nil
+}
+
+func (c *packetClientConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastUsed = time.Now()
+
+	var err error
+	c.written, err = packetFrames(append(c.written, p...), func(msg []byte) error {
+		_, err := c.listener.WriteTo(msg, c.addr)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *packetClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.onClose()
+	})
+	return nil
+}
+
+func (c *packetClientConn) LocalAddr() net.Addr                { return c.listener.LocalAddr() }
+func (c *packetClientConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *packetClientConn) SetDeadline(t time.Time) error      { return nil }
+func (c *packetClientConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *packetClientConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// packetUpstreamConn is the UDP connection to the upstream of a session,
+// framing datagrams like packetClientConn.
+type packetUpstreamConn struct {
+	net.Conn
+	read []byte
+
+	lock    sync.Mutex
+	written []byte
+}
+
+func (c *packetUpstreamConn) Read(p []byte) (int, error) {
+	if len(c.read) == 0 {
+		datagram := make([]byte, maxDatagramSize)
+		n, err := c.Conn.Read(datagram)
+		if err != nil {
+			return 0, err
+		}
+		c.read = packetFrame(datagram[:n])
+	}
+	n := copy(p, c.read)
+	c.read = c.read[n:]
+	return n, nil
+}
+
+func (c *packetUpstreamConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var err error
+	c.written, err = packetFrames(append(c.written, p...), func(msg []byte) error {
+		_, err := c.Conn.Write(msg)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,104 @@
+package toxiproxy_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+
+	"github.com/Shopify/toxiproxy/v2"
+)
+
+// WithUDPEchoServer runs a UDP server sending every datagram back.
+func WithUDPEchoServer(t *testing.T, f func(addr string)) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create UDP server", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	f(conn.LocalAddr().String())
+}
+
+func NewUDPProxy(upstream string) (*toxiproxy.ApiServer, *toxiproxy.Proxy) {
+	srv := toxiproxy.NewServer(
+		toxiproxy.NewMetricsContainer(prometheus.NewRegistry()),
+		zerolog.Nop(),
+	)
+	proxy := toxiproxy.NewProxy(srv, "udp", "127.0.0.1:0", upstream)
+	proxy.Protocol = toxiproxy.ProtocolUDP
+	return srv, proxy
+}
+
+func TestUDPProxiesDatagrams(t *testing.T) {
+	WithUDPEchoServer(t, func(upstream string) {
+		_, proxy := NewUDPProxy(upstream)
+		if err := proxy.Start(); err != nil {
+			t.Fatal("Failed to start proxy", err)
+		}
+		defer proxy.Stop()
+
+		conn, err := net.Dial("udp", proxy.Listen)
+		if err != nil {
+			t.Fatal("Unable to dial proxy", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+
+		// Datagram boundaries are kept
+		for _, payload := range []string{"hello", "", strings.Repeat("x", 40000)} {
+			conn.Write([]byte(payload))
+		}
+		buf := make([]byte, 65535)
+		for _, expected := range []int{5, 0, 40000} {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal("Unable to read datagram", err)
+			}
+			if n != expected {
+				t.Errorf("Expected a datagram of %d bytes, got %d", expected, n)
+			}
+		}
+	})
+}
+
+func TestUDPPacketLoss(t *testing.T) {
+	WithUDPEchoServer(t, func(upstream string) {
+		_, proxy := NewUDPProxy(upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		_, err := proxy.Toxics.AddToxicJson(strings.NewReader(
+			`{"type": "packet_loss", "attributes": {"probability": 1}}`,
+		))
+		if err != nil {
+			t.Fatal("Failed to add toxic", err)
+		}
+
+		conn, err := net.Dial("udp", proxy.Listen)
+		if err != nil {
+			t.Fatal("Unable to dial proxy", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+
+		conn.Write([]byte("hello"))
+		if n, err := conn.Read(make([]byte, 16)); err == nil {
+			t.Errorf("Expected the reply to be lost, got %d bytes", n)
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package toxiproxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Strategies to pick which of a proxy's upstreams a client is connected to.
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyRandom     = "random"
+	StrategyWeighted   = "weighted"
+	StrategyFailover   = "failover"
+)
+
+var upstreamStrategies = map[string]bool{
+	StrategyRoundRobin: true,
+	StrategyRandom:     true,
+	StrategyWeighted:   true,
+	StrategyFailover:   true,
+}
+
+// ValidUpstreamStrategy reports whether strategy is a known upstream strategy.
+func ValidUpstreamStrategy(strategy string) bool {
+	return upstreamStrategies[strategy]
+}
+
+// ValidUpstreamWeights reports whether weights can be used for the upstreams
+// of upstream. Without weights, all upstreams have the same weight.
+func ValidUpstreamWeights(upstream string, weights []int) bool {
+	if len(weights) == 0 {
+		return true
+	}
+	if len(weights) != len(upstreamAddresses(upstream)) {
+		return false
+	}
+	for _, weight := range weights {
+		if weight < 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// upstreamAddresses splits the comma separated addresses of an Upstream.
+func upstreamAddresses(upstream string) []string {
+	var addresses []string
+	for _, address := range strings.Split(upstream, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+var errNoUpstream = errors.New("no upstream address")
+
+// upstreamBalancer spreads the connections of a proxy over its upstreams.
+type upstreamBalancer struct {
+	upstream  string
+	addresses []string
+	weights   []int
+	strategy  string
+	next      atomic.Uint64
+
+	dialTimeout     time.Duration
+	resolveInterval time.Duration
+	// Addresses the host names of upstreams resolved to, by upstream
+	resolved map[string][]string
+	lock     sync.Mutex
+	done     chan struct{}
+	logger   *zerolog.Logger
+}
+
+func newUpstreamBalancer(proxy *Proxy) *upstreamBalancer {
+	balancer := &upstreamBalancer{
+		upstream:        proxy.Upstream,
+		addresses:       upstreamAddresses(proxy.Upstream),
+		weights:         proxy.UpstreamWeights,
+		strategy:        proxy.UpstreamStrategy,
+		dialTimeout:     time.Duration(proxy.DialTimeout) * time.Millisecond,
+		resolveInterval: time.Duration(proxy.ResolveInterval) * time.Millisecond,
+		resolved:        make(map[string][]string),
+		done:            make(chan struct{}),
+		logger:          proxy.Logger,
+	}
+	if len(balancer.weights) != len(balancer.addresses) {
+		balancer.weights = make([]int, len(balancer.addresses))
+		for i := range balancer.weights {
+			balancer.weights[i] = 1
+		}
+	}
+	return balancer
+}
+
+// order returns the upstreams in the order they should be dialed, falling
+// back to the next one when dialing fails.
+func (b *upstreamBalancer) order() []string {
+	n := len(b.addresses)
+	order := make([]string, 0, n)
+	switch b.strategy {
+	case StrategyRandom:
+		for _, i := range rand.Perm(n) { // #nosec G404 -- not used for security
+			order = append(order, b.addresses[i])
+		}
+	case StrategyWeighted:
+		weights := append([]int{}, b.weights...)
+		total := 0
+		for _, weight := range weights {
+			total += weight
+		}
+		for len(order) < n {
+			pick := rand.Intn(total) // #nosec G404 -- not used for security
+			for i, weight := range weights {
+				if pick < weight {
+					order = append(order, b.addresses[i])
+					total -= weight
+					weights[i] = 0
+					break
+				}
+				pick -= weight
+			}
+		}
+	case StrategyFailover:
+		order = append(order, b.addresses...)
+	default:
+		start := int(b.next.Add(1)-1) % n
+		order = append(order, b.addresses[start:]...)
+		order = append(order, b.addresses[:start]...)
+	}
+	return order
+}
+
+// dialUpstream connects to one of the proxy's upstreams with dial, skipping
+// the upstreams that can't be dialed, until ctx is done. It returns the
+// upstream it connected to.
+func (proxy *Proxy) dialUpstream(ctx context.Context, dial dialFunc) (net.Conn, string, error) {
+	balancer := proxy.upstreams.Load()
+	if len(balancer.addresses) == 0 {
+		return nil, "", errNoUpstream
+	}
+
+	var err error
+	for _, address := range balancer.order() {
+		var conn net.Conn
+		conn, err = balancer.dial(ctx, address, dial)
+		if err == nil {
+			return conn, address, nil
+		}
+		if len(balancer.addresses) > 1 {
+			proxy.Logger.
+				Warn().
+				Err(err).
+				Str("address", address).
+				Msg("Skipping upstream that can't be dialed")
+		}
+	}
+	return nil, "", err
+}
+
+// currentUpstream returns the Upstream of a running proxy that new clients are
+// connected to, which may be updated while links are running.
+func (proxy *Proxy) currentUpstream() string {
+	if balancer := proxy.upstreams.Load(); balancer != nil {
+		return balancer.upstream
+	}
+	return proxy.Upstream
+}
+
+// dialFunc connects to an address an upstream resolved to.
+type dialFunc func(ctx context.Context, address string) (net.Conn, error)
+
+// dialDestination connects to a TCP address a client asked for, within the
+// dial timeout and until ctx is done.
+func (proxy *Proxy) dialDestination(ctx context.Context, destination string) (net.Conn, error) {
+	if timeout := proxy.upstreams.Load().dialTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return proxy.dialer("tcp").DialContext(ctx, "tcp", destination)
+}
+
+// dialStream dials a TCP or unix domain socket address.
+func (proxy *Proxy) dialStream(ctx context.Context, addr string) (net.Conn, error) {
+	network, address := splitAddress(addr)
+	return proxy.dialer(network).DialContext(ctx, network, address)
+}
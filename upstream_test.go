@@ -0,0 +1,245 @@
+package toxiproxy_test
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/toxiproxy/v2"
+)
+
+// WithNamedServers runs a TCP server for each one letter name that writes its
+// name to clients and then echoes what they send.
+func WithNamedServers(t *testing.T, names []string, f func(addrs []string)) {
+	var addrs []string
+	for _, name := range names {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("Failed to create TCP server", err)
+		}
+		defer ln.Close()
+
+		go func(name string) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func(conn net.Conn) {
+					defer conn.Close()
+					io.WriteString(conn, name)
+					io.Copy(conn, conn)
+				}(conn)
+			}
+		}(name)
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	f(addrs)
+}
+
+// closedAddress returns an address nothing listens on.
+func closedAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to create TCP server", err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+// dialNamedServer connects to a named server through the proxy and returns
+// the connection along with the server's name.
+func dialNamedServer(t *testing.T, proxy *toxiproxy.Proxy) (net.Conn, string) {
+	conn, err := net.Dial("tcp", proxy.Listen)
+	if err != nil {
+		t.Fatal("Unable to dial proxy", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	name := make([]byte, 1)
+	io.ReadFull(conn, name)
+	return conn, string(name)
+}
+
+// upstreamNames returns the names of the upstreams n clients are connected to.
+func upstreamNames(t *testing.T, proxy *toxiproxy.Proxy, n int) []string {
+	var names []string
+	for i := 0; i < n; i++ {
+		conn, name := dialNamedServer(t, proxy)
+		conn.Close()
+		names = append(names, name)
+	}
+	return names
+}
+
+func countNames(names []string) map[string]int {
+	counts := make(map[string]int)
+	for _, name := range names {
+		counts[name]++
+	}
+	return counts
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b", "c"}, func(addrs []string) {
+		proxy := NewTestProxy("test", strings.Join(addrs, ","))
+		proxy.Start()
+		defer proxy.Stop()
+
+		names := strings.Join(upstreamNames(t, proxy, 6), "")
+		if names != "abcabc" {
+			t.Errorf("Expected clients to be spread in turn, got %s", names)
+		}
+	})
+}
+
+func TestUpstreamRoundRobinSkipsDownUpstreams(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		upstream := addrs[0] + "," + closedAddress(t) + "," + addrs[1]
+		proxy := NewTestProxy("test", upstream)
+		proxy.Start()
+		defer proxy.Stop()
+
+		names := strings.Join(upstreamNames(t, proxy, 3), "")
+		if names != "abb" {
+			t.Errorf("Expected the down upstream to be skipped, got %s", names)
+		}
+	})
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxy := NewTestProxy("test", closedAddress(t)+", "+addrs[0]+", "+addrs[1])
+		proxy.UpstreamStrategy = toxiproxy.StrategyFailover
+		proxy.Start()
+		defer proxy.Stop()
+
+		names := strings.Join(upstreamNames(t, proxy, 3), "")
+		if names != "aaa" {
+			t.Errorf("Expected clients to use the first upstream up, got %s", names)
+		}
+	})
+}
+
+func TestUpstreamRandom(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxy := NewTestProxy("test", strings.Join(addrs, ","))
+		proxy.UpstreamStrategy = toxiproxy.StrategyRandom
+		proxy.Start()
+		defer proxy.Stop()
+
+		counts := countNames(upstreamNames(t, proxy, 50))
+		if counts["a"] == 0 || counts["b"] == 0 || counts["a"]+counts["b"] != 50 {
+			t.Errorf("Expected clients to be spread over both upstreams, got %v", counts)
+		}
+	})
+}
+
+func TestUpstreamWeighted(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxy := NewTestProxy("test", strings.Join(addrs, ","))
+		proxy.UpstreamStrategy = toxiproxy.StrategyWeighted
+		proxy.UpstreamWeights = []int{9, 1}
+		proxy.Start()
+		defer proxy.Stop()
+
+		counts := countNames(upstreamNames(t, proxy, 100))
+		if counts["a"] < 70 || counts["a"]+counts["b"] != 100 {
+			t.Errorf("Expected most clients on the heavier upstream, got %v", counts)
+		}
+	})
+}
+
+func TestUpstreamWeightsValidation(t *testing.T) {
+	cases := []struct {
+		upstream string
+		weights  []int
+		valid    bool
+	}{
+		{"a:1,b:2", nil, true},
+		{"a:1,b:2", []int{3, 1}, true},
+		{"a:1, b:2", []int{1}, false},
+		{"a:1,b:2", []int{1, 0}, false},
+		{"a:1", []int{-1}, false},
+	}
+	for _, tc := range cases {
+		if toxiproxy.ValidUpstreamWeights(tc.upstream, tc.weights) != tc.valid {
+			t.Errorf("Expected weights %v of %q to be valid: %v", tc.weights, tc.upstream, tc.valid)
+		}
+	}
+}
+
+func TestUpstreamUpdateKeepsConnections(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxy := NewTestProxy("test", addrs[0])
+		proxy.Start()
+		defer proxy.Stop()
+
+		conn, name := dialNamedServer(t, proxy)
+		defer conn.Close()
+		if name != "a" {
+			t.Fatalf("Expected to reach upstream a, got %q", name)
+		}
+
+		err := proxy.Update(&toxiproxy.Proxy{
+			Listen:          proxy.Listen,
+			Upstream:        addrs[1],
+			Enabled:         true,
+			KeepConnections: true,
+		})
+		if err != nil {
+			t.Fatal("Failed to update proxy", err)
+		}
+
+		io.WriteString(conn, "ping")
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+			t.Errorf("Expected the established connection to keep running, got %q %v", reply, err)
+		}
+		if names := strings.Join(upstreamNames(t, proxy, 2), ""); names != "bb" {
+			t.Errorf("Expected new clients to reach upstream b, got %s", names)
+		}
+	})
+}
+
+func TestUpstreamUpdateDropsConnections(t *testing.T) {
+	WithNamedServers(t, []string{"a", "b"}, func(addrs []string) {
+		proxy := NewTestProxy("test", addrs[0])
+		proxy.Start()
+		defer proxy.Stop()
+
+		conn, _ := dialNamedServer(t, proxy)
+		defer conn.Close()
+
+		err := proxy.Update(&toxiproxy.Proxy{
+			Listen:   proxy.Listen,
+			Upstream: addrs[1],
+			Enabled:  true,
+		})
+		if err != nil {
+			t.Fatal("Failed to update proxy", err)
+		}
+
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Error("Expected the established connection to be closed, got", err)
+		}
+		if names := strings.Join(upstreamNames(t, proxy, 1), ""); names != "b" {
+			t.Errorf("Expected new clients to reach upstream b, got %s", names)
+		}
+	})
+}
+
+func TestUpstreamResolveInterval(t *testing.T) {
+	WithNamedServers(t, []string{"a"}, func(addrs []string) {
+		proxy := NewTestProxy("test", "localhost:"+listenPort(t, addrs[0]))
+		proxy.ResolveInterval = 50
+		proxy.Start()
+		defer proxy.Stop()
+
+		if names := strings.Join(upstreamNames(t, proxy, 2), ""); names != "aa" {
+			t.Errorf("Expected clients to reach the resolved upstream, got %s", names)
+		}
+	})
+}